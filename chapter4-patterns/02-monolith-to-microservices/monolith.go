@@ -1,3 +1,5 @@
+//go:build ignore
+
 // Monolithic server (before decomposition)
 package main
 
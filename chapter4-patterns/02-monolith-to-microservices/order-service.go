@@ -1,3 +1,5 @@
+//go:build ignore
+
 // Order Service (after decomposition)
 package main
 
@@ -1,3 +1,5 @@
+//go:build ignore
+
 // User Service (after decomposition)
 package main
 
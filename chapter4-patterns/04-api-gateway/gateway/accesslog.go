@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --- Access log ---
+//
+// Every request through the gateway produces one JSON line on stdout
+// (the gateway's own log.Printf messages go to stderr):
+//
+//	{"time":"2025-10-01T12:00:00.123Z","request_id":"9f86d081884c7d65","method":"GET",
+//	 "path":"/users/42","route":"/users/","client_id":"demo-client","auth_method":"api_key",
+//	 "ip":"127.0.0.1","upstream":"localhost:7001","status":200,"bytes":57,"duration_ms":2.41}
+//
+// The same record feeds the per-request metrics (see metrics.go).
+
+var accessLog = log.New(os.Stdout, "", 0)
+
+type accessRecord struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Route      string  `json:"route"`
+	ClientID   string  `json:"client_id,omitempty"`
+	AuthMethod string  `json:"auth_method,omitempty"`
+	IP         string  `json:"ip"`
+	Variant    string  `json:"variant,omitempty"`
+	Upstream   string  `json:"upstream,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Cache      string  `json:"cache,omitempty"`
+
+	start time.Time
+}
+
+func newAccessRecord(r *http.Request, ip string) *accessRecord {
+	return &accessRecord{start: time.Now(), Method: r.Method, Path: r.URL.Path, Route: "unmatched", IP: ip}
+}
+
+func (a *accessRecord) setIdentity(id *identity) {
+	a.ClientID, a.AuthMethod = id.clientID, id.method
+}
+
+// finish records the metrics for the request and writes its log line.
+func (a *accessRecord) finish(sr *statusRecorder) {
+	elapsed := time.Since(a.start)
+	a.Time = a.start.UTC().Format(time.RFC3339Nano)
+	a.Status = sr.status
+	if a.Status == 0 {
+		a.Status = http.StatusOK // nothing written: net/http sends an empty 200
+	}
+	a.Bytes = sr.bytes
+	a.DurationMs = float64(elapsed.Microseconds()) / 1000
+	a.Cache = sr.Header().Get("X-Cache")
+
+	requestsTotal.inc(a.Route, methodLabel(a.Method), strconv.Itoa(a.Status/100)+"xx")
+	requestSeconds.observe(elapsed, a.Route)
+	if a.Cache != "" {
+		cacheTotal.inc(a.Route, a.Cache)
+	}
+
+	line, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	accessLog.Print(string(line))
+}
+
+// methodLabel keeps the method label of requestsTotal bounded: clients can
+// send any token as a method, and each new one would add a series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// statusRecorder remembers the status code and body size written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Authentication and per-route access rules ---
+//
+// A request proves who it is with either an API key (X-API-Key) or a JWT
+// (Authorization: Bearer). Both end up as an identity. Each route then
+// decides which of the two it accepts and what the caller must have:
+//
+//	"auth": {"accept": ["jwt"], "scopes": ["payments:write"], "tenants": ["acme"]}
+//
+// Scopes and tenants come from JWT claims, so a route that requires them
+// only admits JWTs. API keys are limited by their own prefixes instead.
+
+const (
+	authAPIKey = "api_key"
+	authJWT    = "jwt"
+)
+
+var (
+	errNoCredentials = errors.New("no credentials")
+	errJWTDisabled   = errors.New("bearer tokens are not enabled")
+	errForbidden     = errors.New("forbidden")
+)
+
+// JWT verifier, loaded from GATEWAY_JWKS (nil = bearer tokens disabled)
+var jwtAuth *jwtVerifier
+
+// Headers the gateway sets for upstreams. Anything a client sends under
+// these names is dropped first, so backends can trust them.
+var identityHeaders = []string{"X-Client-ID", "X-Auth-Method", "X-Auth-Subject", "X-Auth-Scopes", "X-Auth-Tenant"}
+
+type identity struct {
+	method   string // authAPIKey or authJWT
+	clientID string
+	subject  string
+	scopes   []string
+	tenant   string
+	tier     string
+	key      *apiKey // only for API keys
+}
+
+// authConfig is the "auth" block of a route in routes.json.
+type authConfig struct {
+	Accept  []string `json:"accept,omitempty"`  // default: both
+	Scopes  []string `json:"scopes,omitempty"`  // all of these are required
+	Tenants []string `json:"tenants,omitempty"` // any of these; empty = any tenant
+}
+
+func (c *authConfig) validate() error {
+	for _, a := range c.Accept {
+		if a != authAPIKey && a != authJWT {
+			return fmt.Errorf("auth.accept: unknown method %q", a)
+		}
+	}
+	return nil
+}
+
+// authenticate works out who is calling. It does not look at the route.
+func authenticate(r *http.Request, now time.Time) (*identity, error) {
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		token, ok := strings.CutPrefix(authz, "Bearer ")
+		if !ok {
+			return nil, errTokenMalformed
+		}
+		if jwtAuth == nil {
+			return nil, errJWTDisabled
+		}
+		c, err := jwtAuth.verify(strings.TrimSpace(token), now)
+		if err != nil {
+			return nil, err
+		}
+		tier := c.Tier
+		if _, ok := tierLimits[tier]; !ok {
+			tier = defaultTier
+		}
+		return &identity{
+			method:   authJWT,
+			clientID: c.Sub,
+			subject:  c.Sub,
+			scopes:   c.scopes(),
+			tenant:   c.Tenant,
+			tier:     tier,
+		}, nil
+	}
+
+	secret := r.Header.Get("X-API-Key")
+	if secret == "" {
+		return nil, errNoCredentials
+	}
+	k, err := keys.authenticate(secret, now)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{method: authAPIKey, clientID: k.ClientID, tier: k.Tier, key: k}, nil
+}
+
+// authorize applies the route's access rules to an authenticated caller.
+func authorize(id *identity, rt *route, path string) error {
+	rules := rt.auth
+	if len(rules.Accept) > 0 && !contains(rules.Accept, id.method) {
+		return errForbidden
+	}
+	if id.key != nil && !id.key.allows(path) {
+		return errForbidden
+	}
+	for _, s := range rules.Scopes {
+		if !contains(id.scopes, s) {
+			return errForbidden
+		}
+	}
+	if len(rules.Tenants) > 0 && !contains(rules.Tenants, id.tenant) {
+		return errForbidden
+	}
+	return nil
+}
+
+// setIdentityHeaders tells the upstream who the caller is.
+func setIdentityHeaders(h http.Header, id *identity) {
+	for _, name := range identityHeaders {
+		h.Del(name)
+	}
+	h.Set("X-Client-ID", id.clientID)
+	h.Set("X-Auth-Method", id.method)
+	if id.subject != "" {
+		h.Set("X-Auth-Subject", id.subject)
+	}
+	if len(id.scopes) > 0 {
+		h.Set("X-Auth-Scopes", strings.Join(id.scopes, " "))
+	}
+	if id.tenant != "" {
+		h.Set("X-Auth-Tenant", id.tenant)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Response cache (GET/HEAD) ---
+//
+// A route can opt in to caching:
+//
+//	{"prefix": "/users/", "upstream": "http://localhost:7001",
+//	 "cache": {"max_entry_size": 262144}}
+//
+// The gateway then behaves like a shared HTTP cache in front of that route:
+//   - freshness comes from the upstream's Cache-Control (s-maxage, max-age),
+//     or Expires; default_ttl only applies when the upstream says nothing
+//   - no-store and private responses are never stored, and neither are
+//     responses with Set-Cookie or Vary: *
+//   - responses to authenticated requests are only stored when the upstream
+//     allows it explicitly with public, s-maxage or must-revalidate (RFC 9111
+//     section 3.5), and default_ttl never applies to them. Every request the
+//     gateway proxies carries credentials, so in practice an upstream opts
+//     each response in
+//   - Vary is honored, including the identity headers the gateway adds, so
+//     an upstream whose answer depends on the caller says Vary: X-Client-ID
+//   - a stale entry with an ETag is revalidated with If-None-Match; a 304
+//     from the upstream refreshes it without moving the body again
+//   - clients sending If-None-Match get a 304 when their ETag still matches
+//   - many concurrent misses for the same key cause one upstream request;
+//     the others wait for it and are served from the cache
+//   - a successful POST/PUT/PATCH/DELETE to a URL drops the cached copies
+//     of that URL
+//
+// All routes share one LRU bounded by GATEWAY_CACHE_MB (default 64).
+// Responses report X-Cache: HIT, MISS, REVALIDATED or BYPASS.
+
+const defaultCacheEntrySize = 1 << 20
+
+// cacheConfig is the optional "cache" block of a route.
+type cacheConfig struct {
+	DefaultTTL   duration `json:"default_ttl,omitempty"`    // 0: only store what the upstream marks cacheable; never for authenticated requests
+	MaxEntrySize int      `json:"max_entry_size,omitempty"` // bytes of body; default 1MB
+}
+
+func (c *cacheConfig) validate() error {
+	if c.DefaultTTL < 0 || c.MaxEntrySize < 0 {
+		return fmt.Errorf("cache: default_ttl and max_entry_size must not be negative")
+	}
+	if c.MaxEntrySize == 0 {
+		c.MaxEntrySize = defaultCacheEntrySize
+	}
+	return nil
+}
+
+// Status codes that may be stored (RFC 9110 section 15.1).
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+type cacheEntry struct {
+	key     string
+	base    string
+	variant string
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	stored  time.Time     // when the upstream last sent or confirmed it
+	age     time.Duration // Age the upstream reported at that time
+	ttl     time.Duration // freshness lifetime
+	size    int
+}
+
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.currentAge(now) < e.ttl
+}
+
+// cacheBase groups the variants of one URL. vary is the list of request
+// headers the upstream said its answer depends on.
+type cacheBase struct {
+	vary []string
+	keys map[string]bool
+}
+
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	lru      *list.List // front = most recently used; values are *cacheEntry
+	entries  map[string]*list.Element
+	bases    map[string]*cacheBase
+	inflight map[string]chan struct{} // keys being fetched right now
+}
+
+func newResponseCache(maxBytes int) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		bases:    map[string]*cacheBase{},
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// serve answers a request on a route with caching enabled. fetch forwards a
+// request to the upstream and writes its response. variant keeps the
+// answers of a canary apart from those of stable (see variants.go); a write
+// to the URL still drops both.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, cfg *cacheConfig, variant string, id *identity, fetch http.HandlerFunc) {
+	base := strings.ToLower(r.Host) + r.URL.RequestURI()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sr := &statusRecorder{ResponseWriter: w}
+		fetch(sr, r)
+		if sr.status >= 200 && sr.status < 400 {
+			c.invalidate(base)
+		}
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		w.Header().Set("X-Cache", "BYPASS")
+		fetch(w, r)
+		return
+	}
+	_, noCache := reqCC["no-cache"]
+	revalidate := noCache || reqCC["max-age"] == "0" ||
+		(len(reqCC) == 0 && r.Header.Get("Pragma") == "no-cache")
+
+	hdr := varyHeader(r, id)
+	key := c.keyFor(base, variant, hdr)
+	e := c.lookup(key)
+	if e != nil && !revalidate && e.fresh(time.Now()) {
+		writeEntry(w, r, e, "HIT", time.Now())
+		return
+	}
+	if r.Method == http.MethodHead {
+		// Only a stored GET can answer a HEAD; don't store HEAD answers.
+		w.Header().Set("X-Cache", "MISS")
+		fetch(w, r)
+		return
+	}
+
+	done, leader := c.join(key)
+	if !leader {
+		// Someone is already fetching this key: wait, then look again.
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+		if e := c.lookup(c.keyFor(base, variant, hdr)); e != nil && e.fresh(time.Now()) {
+			writeEntry(w, r, e, "HIT", time.Now())
+			return
+		}
+		// The leader's answer wasn't storable (private, too big, ...).
+		c.fill(w, r, cfg, base, variant, hdr, id, nil, fetch)
+		return
+	}
+	defer c.leave(key, done)
+	c.fill(w, r, cfg, base, variant, hdr, id, e, fetch)
+}
+
+// fill fetches from the upstream, streams the answer to the client and
+// stores it if it may be stored. stale, if set, is revalidated.
+func (c *responseCache) fill(w http.ResponseWriter, r *http.Request, cfg *cacheConfig, base, variant string, hdr http.Header, id *identity, stale *cacheEntry, fetch http.HandlerFunc) {
+	// Ask for the full response so it can be stored; the client's own
+	// conditional headers are answered here.
+	out := r.Clone(r.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if stale != nil && stale.etag != "" {
+		out.Header.Set("If-None-Match", stale.etag)
+	}
+
+	cw := &cacheWriter{w: w, req: r, header: http.Header{}, limit: cfg.MaxEntrySize, conditional: out.Header.Get("If-None-Match") != ""}
+	fetch(cw, out)
+	now := time.Now()
+	authenticated := id != nil && id.method != ""
+
+	if cw.notModified {
+		e := stale.refreshed(cw.header, time.Duration(cfg.DefaultTTL), authenticated, now)
+		c.put(e, hdr)
+		writeEntry(w, r, e, "REVALIDATED", now)
+		return
+	}
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.tooBig || !cacheableStatus[cw.status] {
+		return
+	}
+	ttl, ok := freshness(cw.header, time.Duration(cfg.DefaultTTL), authenticated, now)
+	etag := cw.header.Get("ETag")
+	if !ok || (ttl <= 0 && etag == "") {
+		return
+	}
+	h := cw.header.Clone()
+	h.Del("X-Request-ID")
+	h.Del("Age")
+	c.put(&cacheEntry{
+		base:    base,
+		variant: variant,
+		status:  cw.status,
+		header:  h,
+		body:    cw.body.Bytes(),
+		etag:    etag,
+		stored:  now,
+		age:     headerSeconds(cw.header, "Age"),
+		ttl:     ttl,
+	}, hdr)
+}
+
+// refreshed is a copy of e updated with the headers of a 304 that confirmed it.
+func (e *cacheEntry) refreshed(h http.Header, defaultTTL time.Duration, authenticated bool, now time.Time) *cacheEntry {
+	ne := *e
+	ne.header = e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Date", "Expires", "ETag", "Vary"} {
+		if v := h.Values(name); len(v) > 0 {
+			ne.header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	ne.stored = now
+	ne.age = headerSeconds(h, "Age")
+	ne.ttl, _ = freshness(ne.header, defaultTTL, authenticated, now)
+	return &ne
+}
+
+// --- LRU bookkeeping ---
+
+func (c *responseCache) keyFor(base, variant string, hdr http.Header) string {
+	c.mu.Lock()
+	b := c.bases[base]
+	c.mu.Unlock()
+	var names []string
+	if b != nil {
+		names = b.vary
+	}
+	return varyKey(base, variant, names, hdr)
+}
+
+func (c *responseCache) lookup(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put stores e under the key its own Vary header gives it, evicting the
+// least recently used entries until the cache fits again.
+func (c *responseCache) put(e *cacheEntry, hdr http.Header) {
+	names, ok := varyNames(e.header)
+	if !ok {
+		return
+	}
+	e.key = varyKey(e.base, e.variant, names, hdr)
+	e.size = len(e.key) + len(e.body) + 256
+	for k, vs := range e.header {
+		e.size += len(k)
+		for _, v := range vs {
+			e.size += len(v)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.size > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.removeLocked(el)
+	}
+	b := c.bases[e.base]
+	if b != nil && strings.Join(b.vary, ",") != strings.Join(names, ",") {
+		// The upstream changed what it varies on: the old variants are keyed wrong.
+		c.dropBaseLocked(e.base)
+		b = nil
+	}
+	if b == nil {
+		b = &cacheBase{vary: names, keys: map[string]bool{}}
+		c.bases[e.base] = b
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	b.keys[e.key] = true
+	c.size += e.size
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate drops every copy of a URL.
+func (c *responseCache) invalidate(base string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropBaseLocked(base)
+}
+
+func (c *responseCache) dropBaseLocked(base string) {
+	if b := c.bases[base]; b != nil {
+		for key := range b.keys {
+			c.removeLocked(c.entries[key])
+		}
+		delete(c.bases, base)
+	}
+}
+
+func (c *responseCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	if b := c.bases[e.base]; b != nil {
+		delete(b.keys, e.key)
+		if len(b.keys) == 0 {
+			delete(c.bases, e.base)
+		}
+	}
+}
+
+// join registers interest in fetching key. The first caller becomes the
+// leader and must call leave; the others wait on the returned channel.
+func (c *responseCache) join(key string) (done chan struct{}, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.inflight[key]; ok {
+		return done, false
+	}
+	done = make(chan struct{})
+	c.inflight[key] = done
+	return done, true
+}
+
+func (c *responseCache) leave(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// --- Writing responses ---
+
+// cacheWriter sits between the proxy and the client: it passes the response
+// through while keeping a copy (up to limit bytes) for the cache.
+type cacheWriter struct {
+	w           http.ResponseWriter
+	req         *http.Request // as the client sent it
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	limit       int
+	tooBig      bool
+	conditional bool // the upstream request carried If-None-Match
+	notModified bool // ...and the upstream answered 304: nothing goes to the client yet
+	skipBody    bool // the client gets a 304 of its own
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	if cw.status != 0 && !cw.notModified {
+		return cw.w.Header() // trailers
+	}
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	if code == http.StatusNotModified && cw.conditional {
+		cw.notModified = true
+		return
+	}
+	h := cw.w.Header()
+	h.Set("X-Cache", "MISS")
+	if code == http.StatusOK && etagMatches(cw.req.Header.Get("If-None-Match"), cw.header.Get("ETag")) {
+		cw.skipBody = true
+		copyValidators(h, cw.header)
+		cw.w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for k, v := range cw.header {
+		h[k] = append([]string(nil), v...)
+	}
+	cw.w.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(p), nil
+	}
+	if !cw.tooBig {
+		if cw.body.Len()+len(p) > cw.limit {
+			cw.tooBig = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	if cw.skipBody || cw.req.Method == http.MethodHead {
+		return len(p), nil
+	}
+	return cw.w.Write(p)
+}
+
+func (cw *cacheWriter) Flush() {
+	if cw.status == 0 || cw.notModified || cw.skipBody {
+		return
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeEntry answers from a stored entry (or with a 304 if the client
+// already has it).
+func writeEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, xCache string, now time.Time) {
+	h := w.Header()
+	h.Set("X-Cache", xCache)
+	h.Set("Age", strconv.Itoa(int(e.currentAge(now).Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), e.etag) {
+		copyValidators(h, e.header)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// copyValidators copies the headers a 304 carries (RFC 9110 section 15.4.5).
+func copyValidators(dst, src http.Header) {
+	for _, name := range []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary"} {
+		if v := src.Values(name); len(v) > 0 {
+			dst[http.CanonicalHeaderKey(name)] = append([]string(nil), v...)
+		}
+	}
+}
+
+// --- Header parsing ---
+
+// parseCacheControl turns "max-age=60, no-cache" into {"max-age": "60", "no-cache": ""}.
+func parseCacheControl(values []string) map[string]string {
+	cc := map[string]string{}
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(val, `"`)
+		}
+	}
+	return cc
+}
+
+// freshness says how long a response stays fresh, and false if it must
+// not be stored at all. authenticated is set when the request carried
+// credentials.
+func freshness(h http.Header, defaultTTL time.Duration, authenticated bool, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if authenticated {
+		// A shared cache may only reuse the answer to an authenticated
+		// request if the upstream says so (RFC 9111 section 3.5).
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return 0, false
+		}
+		defaultTTL = 0
+	}
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false // the gateway is a shared cache
+	}
+	if h.Get("Set-Cookie") != "" || h.Get("Trailer") != "" {
+		return 0, false
+	}
+
+	ttl := defaultTTL
+	if v, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(v)
+	} else if exp := h.Get("Expires"); exp != "" {
+		ttl = 0 // an invalid Expires means "already expired"
+		if t, err := http.ParseTime(exp); err == nil {
+			date := now
+			if d, err := http.ParseTime(h.Get("Date")); err == nil {
+				date = d
+			}
+			ttl = t.Sub(date)
+		}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		ttl = 0 // may be stored, but must be revalidated every time
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+func headerSeconds(h http.Header, name string) time.Duration {
+	return parseSeconds(h.Get(name))
+}
+
+// varyNames returns the sorted, canonical header names in Vary, and false
+// for Vary: * (which can never be matched).
+func varyNames(h http.Header) ([]string, bool) {
+	seen := map[string]bool{}
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func varyKey(base, variant string, names []string, hdr http.Header) string {
+	if len(names) == 0 && variant == "" {
+		return base
+	}
+	var b strings.Builder
+	b.WriteString(base)
+	if variant != "" {
+		b.WriteString("\x00variant=")
+		b.WriteString(variant)
+	}
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(hdr.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeader is the request as the upstream sees it, for matching Vary:
+// the client's headers plus the identity headers the gateway adds.
+func varyHeader(r *http.Request, id *identity) http.Header {
+	h := r.Header.Clone()
+	setIdentityHeaders(h, id)
+	return h
+}
+
+// etagMatches implements the weak comparison If-None-Match uses.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cachedUpstream puts handler behind a route with caching enabled and
+// returns a function that sends a request through the cache as clientID.
+func cachedUpstream(t *testing.T, handler http.HandlerFunc) (do func(r *http.Request, clientID string) *httptest.ResponseRecorder, calls *atomic.Int64) {
+	t.Helper()
+	calls = &atomic.Int64{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "` + upstream.URL + `", "cache": {"max_entry_size": 1024}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newResponseCache(1 << 20)
+	return func(r *http.Request, clientID string) *httptest.ResponseRecorder {
+		m, _ := table.match(r)
+		id := &identity{method: authAPIKey, clientID: clientID}
+		w := httptest.NewRecorder()
+		c.serve(w, r, m.route.cache, "", id, func(w http.ResponseWriter, r *http.Request) {
+			serveProxy(w, r, &proxyState{match: m, up: m.route.pool.upstreams[0], id: id, reqID: "req"})
+		})
+		return w
+	}, calls
+}
+
+func TestCacheHonorsMaxAge(t *testing.T) {
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprint(w, `{"id":"42"}`)
+	})
+
+	first := do(httptest.NewRequest("GET", "/users/42", nil), "a")
+	second := do(httptest.NewRequest("GET", "/users/42", nil), "b")
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache = %q, %q; want MISS, HIT", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+	}
+	if second.Body.String() != `{"id":"42"}` || second.Header().Get("Age") == "" {
+		t.Fatalf("hit: body %q, headers %v", second.Body, second.Header())
+	}
+	if head := do(httptest.NewRequest("HEAD", "/users/42", nil), "a"); head.Header().Get("X-Cache") != "HIT" || head.Body.Len() != 0 {
+		t.Fatalf("HEAD: X-Cache %q, body %q", head.Header().Get("X-Cache"), head.Body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream called %d times, want 1", n)
+	}
+
+	// The client can insist on a fresh answer, or skip the cache altogether.
+	r := httptest.NewRequest("GET", "/users/42", nil)
+	r.Header.Set("Cache-Control", "no-store")
+	if w := do(r, "a"); w.Header().Get("X-Cache") != "BYPASS" || calls.Load() != 2 {
+		t.Fatalf("no-store: X-Cache %q, calls %d", w.Header().Get("X-Cache"), calls.Load())
+	}
+}
+
+func TestCacheDoesNotStorePrivateResponses(t *testing.T) {
+	for _, cc := range []string{"private, max-age=60", "no-store", ""} {
+		do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			if cc != "" {
+				w.Header().Set("Cache-Control", cc)
+			}
+		})
+		do(httptest.NewRequest("GET", "/users/42", nil), "a")
+		do(httptest.NewRequest("GET", "/users/42", nil), "a")
+		if n := calls.Load(); n != 2 {
+			t.Errorf("Cache-Control %q: upstream called %d times, want 2", cc, n)
+		}
+	}
+}
+
+func TestCacheNeedsExplicitPermissionForAuthenticatedRequests(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		cc            string
+		authenticated bool
+		wantTTL       time.Duration
+		wantStore     bool
+	}{
+		{"", false, 10 * time.Second, true}, // default_ttl
+		{"", true, 0, false},
+		{"max-age=60", true, 0, false},
+		{"public", true, 0, true}, // no default_ttl: stored only to be revalidated
+		{"public, max-age=60", true, time.Minute, true},
+		{"s-maxage=30", true, 30 * time.Second, true},
+		{"must-revalidate, max-age=60", true, time.Minute, true},
+		{"public, private", true, 0, false},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		if c.cc != "" {
+			h.Set("Cache-Control", c.cc)
+		}
+		ttl, store := freshness(h, 10*time.Second, c.authenticated, now)
+		if ttl != c.wantTTL || store != c.wantStore {
+			t.Errorf("Cache-Control %q, authenticated %v: ttl %v store %v, want %v %v", c.cc, c.authenticated, ttl, store, c.wantTTL, c.wantStore)
+		}
+	}
+
+	// Through the cache: a per-user answer without public or s-maxage is
+	// never served to another client.
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.Header.Get("X-Client-ID"))
+	})
+	do(httptest.NewRequest("GET", "/users/me", nil), "a")
+	if w := do(httptest.NewRequest("GET", "/users/me", nil), "b"); w.Body.String() != "b" {
+		t.Fatalf("client b got %q", w.Body)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("upstream called %d times, want 2", n)
+	}
+}
+
+func TestCacheRevalidatesWithETag(t *testing.T) {
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "public, no-cache")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "profile")
+	})
+
+	do(httptest.NewRequest("GET", "/users/42", nil), "a")
+	w := do(httptest.NewRequest("GET", "/users/42", nil), "a")
+	if w.Code != 200 || w.Body.String() != "profile" || w.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Fatalf("revalidated: status %d, body %q, X-Cache %q", w.Code, w.Body, w.Header().Get("X-Cache"))
+	}
+
+	// A client that already has v1 gets a 304 without a body.
+	r := httptest.NewRequest("GET", "/users/42", nil)
+	r.Header.Set("If-None-Match", `W/"v1"`)
+	w = do(r, "a")
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("conditional: status %d, body %q, headers %v", w.Code, w.Body, w.Header())
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("upstream called %d times, want 3", n)
+	}
+}
+
+func TestCacheHonorsVary(t *testing.T) {
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Vary", "X-Client-ID")
+		fmt.Fprint(w, r.Header.Get("X-Client-ID"))
+	})
+
+	for _, client := range []string{"a", "b", "a", "b"} {
+		if w := do(httptest.NewRequest("GET", "/users/me", nil), client); w.Body.String() != client {
+			t.Fatalf("client %s got %q", client, w.Body)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("upstream called %d times, want 2 (one per client)", n)
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	release := make(chan struct{})
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprint(w, "slow")
+	})
+
+	var wg sync.WaitGroup
+	var hits atomic.Int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := do(httptest.NewRequest("GET", "/users/42", nil), "a")
+			if w.Body.String() == "slow" {
+				hits.Add(1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let them all pile up
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 || hits.Load() != 20 {
+		t.Fatalf("upstream calls %d, good answers %d; want 1, 20", calls.Load(), hits.Load())
+	}
+}
+
+func TestCacheInvalidatesOnWrite(t *testing.T) {
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	})
+	do(httptest.NewRequest("GET", "/users/42", nil), "a")
+	do(httptest.NewRequest("PUT", "/users/42", strings.NewReader("{}")), "a")
+	if w := do(httptest.NewRequest("GET", "/users/42", nil), "a"); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("after PUT: X-Cache %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("upstream called %d times, want 3", n)
+	}
+}
+
+func TestCacheSkipsLargeBodies(t *testing.T) {
+	do, calls := cachedUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprint(w, strings.Repeat("x", 2048)) // max_entry_size is 1024
+	})
+	for i := 0; i < 2; i++ {
+		if w := do(httptest.NewRequest("GET", "/users/big", nil), "a"); w.Body.Len() != 2048 {
+			t.Fatalf("body length %d, want 2048", w.Body.Len())
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("upstream called %d times, want 2", n)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(3 * 400)
+	now := time.Now()
+	add := func(path string) {
+		c.put(&cacheEntry{base: path, status: 200, header: http.Header{}, body: make([]byte, 100), stored: now, ttl: time.Minute}, http.Header{})
+	}
+	add("/a")
+	add("/b")
+	add("/c")
+	c.lookup("/a") // /b is now the least recently used
+	add("/d")
+
+	for path, want := range map[string]bool{"/a": true, "/b": false, "/c": true, "/d": true} {
+		if got := c.lookup(path) != nil; got != want {
+			t.Errorf("%s cached = %v, want %v", path, got, want)
+		}
+	}
+	if c.size > c.maxBytes {
+		t.Fatalf("size %d over limit %d", c.size, c.maxBytes)
+	}
+}
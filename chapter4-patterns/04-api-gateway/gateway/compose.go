@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Composite (backend-for-frontend) routes ---
+//
+// A composite route has no upstream of its own. It fans out to several
+// paths on the gateway in parallel and merges the answers into one JSON
+// document, so a mobile screen needs one round trip instead of several:
+//
+//	{"prefix": "/mobile/home/{user}", "methods": ["GET"],
+//	 "compose": {"sections": {
+//	   "profile":  {"path": "/users/{user}/profile", "timeout": "500ms"},
+//	   "payments": {"path": "/payments/recent?user={user}", "timeout": "800ms"}
+//	 }}}
+//
+// Each section path goes through the same route table as any other request
+// (balancer, health checks, route auth rules, response cache) and carries
+// the composite request's X-Request-ID. {name} in a section path is
+// replaced with the composite route's path parameter of that name.
+//
+// The answer is 200 with every section that succeeded under "data" and a
+// per-section error under "errors" for the rest:
+//
+//	{"data": {"profile": {...}, "payments": null},
+//	 "errors": {"payments": {"status": 504, "error": "timeout"}}}
+//
+// Only when every section fails does the gateway answer 502.
+
+// composeConfig is the "compose" block of a route.
+type composeConfig struct {
+	Sections map[string]composeSection `json:"sections"`
+}
+
+type composeSection struct {
+	Path    string   `json:"path"`              // a path on this gateway
+	Timeout duration `json:"timeout,omitempty"` // default: the composite route's timeout
+}
+
+func (c *composeConfig) validate(pat pattern) error {
+	if len(c.Sections) == 0 {
+		return errors.New("compose: no sections")
+	}
+	params := map[string]bool{}
+	for _, seg := range pat.segments {
+		if isParam(seg) {
+			params[seg] = true
+		}
+	}
+	for name, s := range c.Sections {
+		if !strings.HasPrefix(s.Path, "/") {
+			return fmt.Errorf("compose: section %q: path must start with /", name)
+		}
+		if s.Timeout < 0 {
+			return fmt.Errorf("compose: section %q: negative timeout", name)
+		}
+		for rest := s.Path; ; {
+			i := strings.Index(rest, "{")
+			if i < 0 {
+				break
+			}
+			j := strings.Index(rest[i:], "}")
+			if j < 0 {
+				return fmt.Errorf("compose: section %q: unterminated parameter in %q", name, s.Path)
+			}
+			if !params[rest[i:i+j+1]] {
+				return fmt.Errorf("compose: section %q: %s is not a parameter of the route", name, rest[i:i+j+1])
+			}
+			rest = rest[i+j+1:]
+		}
+	}
+	return nil
+}
+
+// sectionError is what "errors" reports for a section that failed.
+type sectionError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+type composite struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors map[string]sectionError    `json:"errors,omitempty"`
+}
+
+// serveComposite answers a request on a composite route.
+func serveComposite(w http.ResponseWriter, r *http.Request, t *routeTable, m *routeMatch, id *identity, reqID, ip string) {
+	rt := m.route
+	names := make([]string, 0, len(rt.compose.Sections))
+	for name := range rt.compose.Sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := composite{Data: map[string]json.RawMessage{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string, s composeSection) {
+			defer wg.Done()
+			body, serr := fetchSection(r, t, m, s, id, reqID, ip)
+			mu.Lock()
+			defer mu.Unlock()
+			if serr != nil {
+				out.Data[name] = json.RawMessage("null")
+				if out.Errors == nil {
+					out.Errors = map[string]sectionError{}
+				}
+				out.Errors[name] = *serr
+				return
+			}
+			out.Data[name] = body
+		}(name, rt.compose.Sections[name])
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if len(out.Errors) == len(names) {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(out)
+}
+
+// expandSectionPath fills the route's parameters into a section path. Values
+// are escaped for the part they land in, so "1&admin=true" stays one query
+// value instead of adding parameters to the backend call.
+func expandSectionPath(path string, params map[string]string) string {
+	p, query, hasQuery := strings.Cut(path, "?")
+	for name, value := range params {
+		p = strings.ReplaceAll(p, "{"+name+"}", url.PathEscape(value))
+		query = strings.ReplaceAll(query, "{"+name+"}", url.QueryEscape(value))
+	}
+	if hasQuery {
+		return p + "?" + query
+	}
+	return p
+}
+
+// fetchSection routes one section path through the table and returns its
+// JSON body.
+func fetchSection(r *http.Request, t *routeTable, m *routeMatch, s composeSection, id *identity, reqID, ip string) (json.RawMessage, *sectionError) {
+	timeout := m.route.timeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	target := expandSectionPath(s.Path, m.params)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, &sectionError{Status: http.StatusBadGateway, Error: "bad_path"}
+	}
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.Header = r.Header.Clone()
+	req.Header.Del("If-None-Match") // the section bodies are always needed
+	req.Header.Set("X-Request-ID", reqID)
+
+	sm, _ := t.match(req)
+	if sm == nil || sm.route.compose != nil {
+		return nil, &sectionError{Status: http.StatusNotFound, Error: "not_found"}
+	}
+	if err := authorize(id, sm.route, req.URL.Path); err != nil {
+		return nil, &sectionError{Status: http.StatusForbidden, Error: "forbidden"}
+	}
+
+	sw := &sectionWriter{header: http.Header{}}
+	v := sm.route.variantFor(req, id)
+	forward := func(w http.ResponseWriter, req *http.Request) {
+		up := v.pool.pick(req, ip)
+		if up == nil {
+			http.Error(w, `{"error":"no_healthy_upstream"}`, http.StatusServiceUnavailable)
+			return
+		}
+		serveProxy(w, req, &proxyState{match: sm, variant: v.name, up: up, id: id, reqID: reqID})
+	}
+	if sm.route.cache != nil {
+		responses.serve(sw, req, sm.route.cache, v.name, id, forward)
+	} else {
+		forward(sw, req)
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, &sectionError{Status: http.StatusGatewayTimeout, Error: "timeout"}
+	case sw.status < 200 || sw.status > 299:
+		return nil, &sectionError{Status: sw.status, Error: "upstream_error"}
+	case !json.Valid(sw.body.Bytes()):
+		return nil, &sectionError{Status: http.StatusBadGateway, Error: "invalid_json"}
+	}
+	return json.RawMessage(sw.body.Bytes()), nil
+}
+
+// sectionWriter collects one section's response in memory.
+type sectionWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (sw *sectionWriter) Header() http.Header { return sw.header }
+
+func (sw *sectionWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+}
+
+func (sw *sectionWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.body.Write(p)
+}
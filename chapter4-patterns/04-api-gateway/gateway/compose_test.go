@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func composeTable(t *testing.T, users, payments http.HandlerFunc, extra string) *routeTable {
+	t.Helper()
+	u := httptest.NewServer(users)
+	p := httptest.NewServer(payments)
+	t.Cleanup(u.Close)
+	t.Cleanup(p.Close)
+
+	table, err := parseRoutes([]byte(`{"routes": [
+		{"prefix": "/users/", "upstream": "` + u.URL + `"},
+		{"prefix": "/payments/", "upstream": "` + p.URL + `"},
+		{"prefix": "/mobile/home/{user}", "compose": {"sections": {
+			"profile":  {"path": "/users/{user}/profile"},
+			"payments": {"path": "/payments/recent?user={user}", "timeout": "50ms"}` + extra + `
+		}}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func composeGet(table *routeTable, path string) (*httptest.ResponseRecorder, composite) {
+	r := httptest.NewRequest("GET", path, nil)
+	m, _ := table.match(r)
+	w := httptest.NewRecorder()
+	serveComposite(w, r, table, m, &identity{method: authAPIKey, clientID: "app"}, "req-7", "1.2.3.4")
+	var out composite
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w, out
+}
+
+func TestCompositeMergesSections(t *testing.T) {
+	table := composeTable(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"path":%q,"request_id":%q}`, r.URL.Path, r.Header.Get("X-Request-ID"))
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"user":%q,"client_id":%q}`, r.URL.Query().Get("user"), r.Header.Get("X-Client-ID"))
+		}, "")
+
+	w, out := composeGet(table, "/mobile/home/42")
+	if w.Code != http.StatusOK || len(out.Errors) != 0 {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	if got := string(out.Data["profile"]); got != `{"path":"/42/profile","request_id":"req-7"}` {
+		t.Errorf("profile = %s", got)
+	}
+	if got := string(out.Data["payments"]); got != `{"user":"42","client_id":"app"}` {
+		t.Errorf("payments = %s", got)
+	}
+}
+
+func TestCompositeReportsSectionErrors(t *testing.T) {
+	table := composeTable(t,
+		func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, `{"id":"42"}`) },
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond) // over the 50ms section timeout
+			fmt.Fprint(w, `{}`)
+		},
+		`, "missing": {"path": "/nowhere"}`)
+
+	start := time.Now()
+	w, out := composeGet(table, "/mobile/home/42")
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("took %s: the slow section should have been cut off", elapsed)
+	}
+	if w.Code != http.StatusOK || string(out.Data["profile"]) != `{"id":"42"}` {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	want := map[string]sectionError{
+		"payments": {Status: http.StatusGatewayTimeout, Error: "timeout"},
+		"missing":  {Status: http.StatusNotFound, Error: "not_found"},
+	}
+	for name, e := range want {
+		if out.Errors[name] != e || string(out.Data[name]) != "null" {
+			t.Errorf("%s: error %+v, data %s; want %+v, null", name, out.Errors[name], out.Data[name], e)
+		}
+	}
+}
+
+func TestCompositeAllSectionsFailing(t *testing.T) {
+	fail := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }
+	table := composeTable(t, fail, fail, "")
+	if w, _ := composeGet(table, "/mobile/home/42"); w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", w.Code)
+	}
+}
+
+func TestCompositeRouteValidation(t *testing.T) {
+	for _, routes := range []string{
+		`{"prefix": "/home/{user}", "upstream": "http://localhost:7001", "compose": {"sections": {"a": {"path": "/users/"}}}}`,
+		`{"prefix": "/home/{user}", "compose": {"sections": {}}}`,
+		`{"prefix": "/home/{user}", "compose": {"sections": {"a": {"path": "/users/{id}"}}}}`,
+		`{"prefix": "/home/{user}", "methods": ["POST"], "compose": {"sections": {"a": {"path": "/users/{user}"}}}}`,
+	} {
+		if _, err := parseRoutes([]byte(`{"routes": [` + routes + `]}`)); err == nil {
+			t.Errorf("accepted %s", routes)
+		}
+	}
+}
+
+func TestCompositeEscapesQueryParameters(t *testing.T) {
+	var query string
+	table := composeTable(t,
+		func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, `{}`) },
+		func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.RawQuery
+			fmt.Fprint(w, `{}`)
+		}, "")
+
+	if w, _ := composeGet(table, "/mobile/home/1%26admin=true"); w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	if query != "user=1%26admin%3Dtrue" {
+		t.Fatalf("payments saw query %q, want the whole value in user", query)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Idempotency keys ---
+//
+// Mobile clients retry POSTs when a response gets lost, and a retried
+// payment must not become a second charge. On routes with an "idempotency"
+// block, a POST may carry an Idempotency-Key header:
+//
+//	{"prefix": "/payments/", "upstream": "http://localhost:7002",
+//	 "idempotency": {"ttl": "24h", "required": true}}
+//
+// The first request with a key is forwarded as usual and its response
+// (status, headers and body) is kept for ttl. A later request with the same
+// key gets that response again, marked Idempotent-Replayed: true, without
+// reaching the upstream. Keys are scoped to the route and the caller, so two
+// clients can't see each other's responses.
+//
+// The same key with a different method, path or body is a client bug and
+// gets 409 idempotency_key_reused. A duplicate that arrives while the first
+// request is still running gets 409 request_in_progress; the client should
+// retry later.
+//
+// A 5xx from the upstream is not kept: the key is released so that a retry
+// can try again. The gateway's own 502 is different. When the route times
+// out, the connection drops mid-request or the client hangs up, the
+// upstream may already have taken the charge. The key is then held for ttl
+// as unsettled, and retries get 409 request_outcome_unknown instead of
+// running again. The same goes for a response larger than maxReplayBody,
+// which can't be replayed but did happen.
+//
+// Where records live is pluggable (idempotencyStore): in this process
+// (memoryIdempotencyStore) or in a directory (fileIdempotencyStore, see
+// idempotency_file.go), which survives restarts.
+
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKey     = 255
+	maxReplayBody         = 1 << 20
+	// How long a claim outlives the route timeout, in case the gateway dies
+	// before it can store the response.
+	idempotencyLeaseSlack = 30 * time.Second
+)
+
+// idempotencyConfig is the optional "idempotency" block of a route.
+type idempotencyConfig struct {
+	TTL      duration `json:"ttl,omitempty"`      // default: 24h
+	Required bool     `json:"required,omitempty"` // reject POSTs without a key
+}
+
+func (c *idempotencyConfig) validate() error {
+	if c.TTL < 0 {
+		return errors.New("idempotency: negative ttl")
+	}
+	if c.TTL == 0 {
+		c.TTL = duration(defaultIdempotencyTTL)
+	}
+	return nil
+}
+
+// savedResponse is what a replay sends back.
+type savedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// idempotencyRecord is one key's state in a store.
+type idempotencyRecord struct {
+	Fingerprint string         `json:"fingerprint"`         // hash of method, path and body
+	Response    *savedResponse `json:"response"`            // nil while the first request runs
+	Unsettled   bool           `json:"unsettled,omitempty"` // ran, but with no response to replay
+	Expires     time.Time      `json:"expires"`             // end of the claim, or of the ttl
+}
+
+var (
+	errKeyReused    = errors.New("idempotency key reused with a different request")
+	errKeyInFlight  = errors.New("request with this idempotency key in progress")
+	errKeyUnsettled = errors.New("outcome of the request with this idempotency key is unknown")
+)
+
+// idempotencyStore keeps records by key. begin is atomic: of several
+// concurrent calls for a new key, exactly one claims it.
+type idempotencyStore interface {
+	// begin claims key for a request with fingerprint fp until now+lease.
+	// It returns the saved response if the key has one, errKeyInFlight if
+	// someone else holds the claim and errKeyReused if fp doesn't match.
+	begin(key, fp string, lease time.Duration, now time.Time) (*savedResponse, error)
+	// finish stores the response for key until now+ttl. A nil resp marks
+	// the key unsettled: the request ran, but there is nothing to replay.
+	finish(key string, resp *savedResponse, ttl time.Duration, now time.Time) error
+	// release gives up the claim without storing anything.
+	release(key string) error
+}
+
+// check decides what begin returns for an existing record.
+func (rec *idempotencyRecord) check(fp string) (*savedResponse, error) {
+	switch {
+	case rec.Fingerprint != fp:
+		return nil, errKeyReused
+	case rec.Unsettled:
+		return nil, errKeyUnsettled
+	case rec.Response == nil:
+		return nil, errKeyInFlight
+	}
+	return rec.Response, nil
+}
+
+// memoryIdempotencyStore keeps records in this process.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]*idempotencyRecord
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[string]*idempotencyRecord{}}
+}
+
+func (s *memoryIdempotencyStore) begin(key, fp string, lease time.Duration, now time.Time) (*savedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok && now.Before(rec.Expires) {
+		return rec.check(fp)
+	}
+	s.records[key] = &idempotencyRecord{Fingerprint: fp, Expires: now.Add(lease)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) finish(key string, resp *savedResponse, ttl time.Duration, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok {
+		rec.Response, rec.Unsettled, rec.Expires = resp, resp == nil, now.Add(ttl)
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// evictExpired drops records whose ttl (or claim) has run out.
+func (s *memoryIdempotencyStore) evictExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, rec := range s.records {
+		if !now.Before(rec.Expires) {
+			delete(s.records, k)
+			n++
+		}
+	}
+	return n
+}
+
+// sweep runs evictExpired forever. Run it in its own goroutine.
+func (s *memoryIdempotencyStore) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.evictExpired(now)
+	}
+}
+
+// serveIdempotent forwards a POST through next, or replays the response
+// saved for its Idempotency-Key.
+func serveIdempotent(w http.ResponseWriter, r *http.Request, rt *route, id *identity, next http.HandlerFunc) {
+	cfg := rt.idempotency
+	key := r.Header.Get("Idempotency-Key")
+	switch {
+	case r.Method != http.MethodPost:
+		next(w, r)
+		return
+	case key == "" && cfg.Required:
+		http.Error(w, `{"error":"idempotency_key_required"}`, http.StatusBadRequest)
+		return
+	case key == "":
+		next(w, r)
+		return
+	case len(key) > maxIdempotencyKey:
+		http.Error(w, `{"error":"invalid_idempotency_key"}`, http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, `{"error":"body_too_large"}`, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, `{"error":"bad_request"}`, http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	storeKey := rt.prefix + "\x00" + id.clientID + "\x00" + key
+	saved, err := idempotency.begin(storeKey, fingerprint(r, body), rt.timeout+idempotencyLeaseSlack, time.Now())
+	switch {
+	case errors.Is(err, errKeyReused):
+		idempotencyTotal.inc(rt.prefix, "reused")
+		http.Error(w, `{"error":"idempotency_key_reused"}`, http.StatusConflict)
+		return
+	case errors.Is(err, errKeyInFlight):
+		idempotencyTotal.inc(rt.prefix, "in_flight")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, `{"error":"request_in_progress"}`, http.StatusConflict)
+		return
+	case errors.Is(err, errKeyUnsettled):
+		idempotencyTotal.inc(rt.prefix, "unsettled")
+		http.Error(w, `{"error":"request_outcome_unknown"}`, http.StatusConflict)
+		return
+	case err != nil:
+		// Forwarding without the store could charge twice; refuse instead.
+		log.Printf("[gateway] idempotency store unavailable: %v", err)
+		http.Error(w, `{"error":"idempotency_store_unavailable"}`, http.StatusServiceUnavailable)
+		return
+	case saved != nil:
+		idempotencyTotal.inc(rt.prefix, "replayed")
+		replay(w, saved)
+		return
+	}
+
+	// Only headers set from here on belong to the response; the rate limit
+	// headers and request ID are the current request's own.
+	before := w.Header().Clone()
+	rw := &replayWriter{ResponseWriter: w}
+	var unsettled atomic.Bool
+	next(rw, r.WithContext(context.WithValue(r.Context(), unsettledKey{}, &unsettled)))
+
+	if rw.status == 0 {
+		rw.status, rw.header = http.StatusOK, w.Header().Clone()
+	}
+	switch {
+	case unsettled.Load() || rw.overflow:
+		// Running the request again could charge twice; hold the key.
+		if err := idempotency.finish(storeKey, nil, time.Duration(cfg.TTL), time.Now()); err != nil {
+			log.Printf("[gateway] idempotency store: %v", err)
+		}
+		return
+	case rw.status >= 500:
+		// The upstream answered with an error of its own: nothing was done.
+		if err := idempotency.release(storeKey); err != nil {
+			log.Printf("[gateway] idempotency store: %v", err)
+		}
+		return
+	}
+	resp := &savedResponse{Status: rw.status, Header: http.Header{}, Body: rw.body.Bytes()}
+	for k, v := range rw.header {
+		if !reflect.DeepEqual(before[k], v) {
+			resp.Header[k] = v
+		}
+	}
+	if err := idempotency.finish(storeKey, resp, time.Duration(cfg.TTL), time.Now()); err != nil {
+		log.Printf("[gateway] idempotency store: %v", err)
+		return
+	}
+	idempotencyTotal.inc(rt.prefix, "stored")
+}
+
+// unsettledKey holds, in the context of a request with an Idempotency-Key,
+// the flag markUnsettled sets.
+type unsettledKey struct{}
+
+// markUnsettled records that the gateway gave up on a request the upstream
+// may already have acted on. Outside serveIdempotent it does nothing.
+func markUnsettled(ctx context.Context) {
+	if u, ok := ctx.Value(unsettledKey{}).(*atomic.Bool); ok {
+		u.Store(true)
+	}
+}
+
+// fingerprint identifies what a key was first used for.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replay(w http.ResponseWriter, saved *savedResponse) {
+	for k, v := range saved.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(saved.Status)
+	w.Write(saved.Body)
+}
+
+// replayWriter passes the response through and keeps a copy to replay.
+type replayWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header // as of WriteHeader
+	body     bytes.Buffer
+	overflow bool // body over maxReplayBody: not kept
+}
+
+func (rw *replayWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+		rw.header = rw.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *replayWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.overflow {
+		if rw.body.Len()+len(p) > maxReplayBody {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(p)
+		}
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *replayWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *replayWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Idempotency records on disk ---
+//
+// fileIdempotencyStore keeps one JSON file per key in a directory, so saved
+// responses survive a gateway restart. File names are the SHA-256 of the key
+// (keys are chosen by clients and may contain anything). Files are written
+// to a temporary name and renamed into place, so a crash never leaves a
+// half-written record behind.
+//
+// The claim in begin is guarded by a mutex, which makes it atomic within
+// one gateway process. Replicas need a store of their own each; pointing
+// several at one directory would let a duplicate slip through.
+
+type fileIdempotencyStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newFileIdempotencyStore(dir string) (*fileIdempotencyStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileIdempotencyStore{dir: dir}, nil
+}
+
+func (s *fileIdempotencyStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *fileIdempotencyStore) read(key string) (*idempotencyRecord, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, nil // a damaged record is as good as none
+	}
+	return &rec, nil
+}
+
+func (s *fileIdempotencyStore) write(key string, rec *idempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *fileIdempotencyStore) begin(key, fp string, lease time.Duration, now time.Time) (*savedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, err := s.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil && now.Before(rec.Expires) {
+		return rec.check(fp)
+	}
+	return nil, s.write(key, &idempotencyRecord{Fingerprint: fp, Expires: now.Add(lease)})
+}
+
+func (s *fileIdempotencyStore) finish(key string, resp *savedResponse, ttl time.Duration, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, err := s.read(key)
+	if err != nil || rec == nil {
+		return err
+	}
+	rec.Response, rec.Unsettled, rec.Expires = resp, resp == nil, now.Add(ttl)
+	return s.write(key, rec)
+}
+
+func (s *fileIdempotencyStore) release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// evictExpired deletes the files of records whose ttl (or claim) has run out.
+func (s *fileIdempotencyStore) evictExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var rec idempotencyRecord
+		if json.Unmarshal(data, &rec) != nil || !now.Before(rec.Expires) {
+			if os.Remove(path) == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// sweep runs evictExpired forever. Run it in its own goroutine.
+func (s *fileIdempotencyStore) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.evictExpired(now)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentUpstream puts handler behind a route with idempotency keys and
+// returns a function that POSTs body with key as clientID.
+func idempotentUpstream(t *testing.T, store idempotencyStore, handler http.HandlerFunc) (post func(key, body, clientID string) *httptest.ResponseRecorder, calls *atomic.Int64) {
+	t.Helper()
+	calls = &atomic.Int64{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/payments/", "upstream": "` + upstream.URL + `", "idempotency": {"ttl": "1h"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idempotency = store
+	return func(key, body, clientID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/payments/tx", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		m, _ := table.match(r)
+		id := &identity{method: authAPIKey, clientID: clientID}
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Request-ID", "req-"+key) // set by the gateway before forwarding
+		serveIdempotent(w, r, m.route, id, func(w http.ResponseWriter, r *http.Request) {
+			serveProxy(w, r, &proxyState{match: m, up: m.route.pool.upstreams[0], id: id, reqID: "req"})
+		})
+		return w
+	}, calls
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	for name, store := range map[string]idempotencyStore{"memory": newMemoryIdempotencyStore(), "file": mustFileStore(t)} {
+		t.Run(name, func(t *testing.T) {
+			var charges atomic.Int64
+			post, calls := idempotentUpstream(t, store, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Location", "/tx/1")
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, `{"charge":%d}`, charges.Add(1))
+			})
+
+			first := post("k-1", `{"amount":100}`, "a")
+			again := post("k-1", `{"amount":100}`, "a")
+			if first.Code != http.StatusCreated || again.Code != http.StatusCreated || again.Body.String() != `{"charge":1}` {
+				t.Fatalf("first %d %q, replay %d %q", first.Code, first.Body, again.Code, again.Body)
+			}
+			if again.Header().Get("Location") != "/tx/1" || again.Header().Get("Idempotent-Replayed") != "true" {
+				t.Fatalf("replay headers %v", again.Header())
+			}
+			if first.Header().Get("Idempotent-Replayed") != "" || again.Header().Get("X-Request-ID") != "req-k-1" {
+				t.Fatalf("first headers %v, replay headers %v", first.Header(), again.Header())
+			}
+
+			// Keys belong to one client; another client's k-1 is a new request.
+			if w := post("k-1", `{"amount":100}`, "b"); w.Body.String() != `{"charge":2}` {
+				t.Fatalf("other client got %q", w.Body)
+			}
+			// No key, no replay.
+			post("", `{"amount":100}`, "a")
+			post("", `{"amount":100}`, "a")
+			if n := calls.Load(); n != 4 {
+				t.Fatalf("upstream called %d times, want 4", n)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentBody(t *testing.T) {
+	post, calls := idempotentUpstream(t, newMemoryIdempotencyStore(), func(w http.ResponseWriter, r *http.Request) {})
+	post("k-1", `{"amount":100}`, "a")
+	if w := post("k-1", `{"amount":999}`, "a"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "idempotency_key_reused") {
+		t.Fatalf("status %d, body %q", w.Code, w.Body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream called %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyConcurrentDuplicate(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	post, calls := idempotentUpstream(t, newMemoryIdempotencyStore(), func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- post("k-1", `{}`, "a") }()
+	<-started
+	w := post("k-1", `{}`, "a")
+	close(release)
+	if first := <-done; first.Code != http.StatusOK {
+		t.Fatalf("first: status %d", first.Code)
+	}
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "request_in_progress") || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("duplicate: status %d, body %q, headers %v", w.Code, w.Body, w.Header())
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream called %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyDoesNotKeepServerErrors(t *testing.T) {
+	var failed atomic.Bool
+	post, calls := idempotentUpstream(t, newMemoryIdempotencyStore(), func(w http.ResponseWriter, r *http.Request) {
+		if !failed.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	if w := post("k-1", `{}`, "a"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first: status %d", w.Code)
+	}
+	if w := post("k-1", `{}`, "a"); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry: status %d, headers %v", w.Code, w.Header())
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("upstream called %d times, want 2", n)
+	}
+}
+
+func TestIdempotencyHoldsKeyWhenUpstreamTimesOut(t *testing.T) {
+	for name, store := range map[string]idempotencyStore{"memory": newMemoryIdempotencyStore(), "file": mustFileStore(t)} {
+		t.Run(name, func(t *testing.T) {
+			var charges atomic.Int64
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				charges.Add(1) // the charge is taken, but the answer is slow
+				time.Sleep(100 * time.Millisecond)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer upstream.Close()
+			table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/payments/", "upstream": "` + upstream.URL + `",
+				"timeout": "20ms", "idempotency": {"ttl": "1h"}}]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			idempotency = store
+
+			post := func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest("POST", "/payments/tx", strings.NewReader(`{"amount":100}`))
+				r.Header.Set("Idempotency-Key", "k-1")
+				m, _ := table.match(r)
+				id := &identity{method: authAPIKey, clientID: "a"}
+				w := httptest.NewRecorder()
+				serveIdempotent(w, r, m.route, id, func(w http.ResponseWriter, r *http.Request) {
+					serveProxy(w, r, &proxyState{match: m, up: m.route.pool.upstreams[0], id: id, reqID: "req"})
+				})
+				return w
+			}
+
+			if w := post(); w.Code != http.StatusBadGateway {
+				t.Fatalf("first: status %d, want the gateway's 502", w.Code)
+			}
+			if w := post(); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "request_outcome_unknown") {
+				t.Fatalf("retry: status %d, body %q", w.Code, w.Body)
+			}
+			if n := charges.Load(); n != 1 {
+				t.Fatalf("upstream charged %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestIdempotencyReleasesKeyWhenNothingWasSent(t *testing.T) {
+	post, calls := idempotentUpstream(t, newMemoryIdempotencyStore(), func(w http.ResponseWriter, r *http.Request) {})
+	// Pointing the route at a closed port: the dial fails, so the request
+	// never left the gateway and a retry may run it.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/payments/", "upstream": "` + closed.URL + `", "idempotency": {"ttl": "1h"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/payments/tx", strings.NewReader(`{}`))
+	r.Header.Set("Idempotency-Key", "k-1")
+	m, _ := table.match(r)
+	id := &identity{method: authAPIKey, clientID: "a"}
+	w := httptest.NewRecorder()
+	serveIdempotent(w, r, m.route, id, func(w http.ResponseWriter, r *http.Request) {
+		serveProxy(w, r, &proxyState{match: m, up: m.route.pool.upstreams[0], id: id, reqID: "req"})
+	})
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("first: status %d, want 502", w.Code)
+	}
+
+	if w := post("k-1", `{}`, "a"); w.Code != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("retry: status %d, upstream calls %d", w.Code, calls.Load())
+	}
+}
+
+func TestIdempotencyRecordsExpire(t *testing.T) {
+	now := time.Now()
+	for name, store := range map[string]interface {
+		idempotencyStore
+		evictExpired(time.Time) int
+	}{"memory": newMemoryIdempotencyStore(), "file": mustFileStore(t)} {
+		store.begin("k", "fp", time.Second, now)
+		store.finish("k", &savedResponse{Status: 201}, time.Minute, now)
+		if saved, err := store.begin("k", "fp", time.Second, now.Add(30*time.Second)); err != nil || saved == nil || saved.Status != 201 {
+			t.Fatalf("%s: within ttl: %v, %v", name, saved, err)
+		}
+		if n := store.evictExpired(now.Add(2 * time.Minute)); n != 1 {
+			t.Fatalf("%s: evicted %d records, want 1", name, n)
+		}
+		if saved, err := store.begin("k", "other", time.Second, now.Add(2*time.Minute)); err != nil || saved != nil {
+			t.Fatalf("%s: after ttl: %v, %v", name, saved, err)
+		}
+	}
+}
+
+func TestIdempotencyFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	s1, _ := newFileIdempotencyStore(dir)
+	s1.begin("k", "fp", time.Second, now)
+	s1.finish("k", &savedResponse{Status: 201, Header: http.Header{"Location": {"/tx/1"}}, Body: []byte("ok")}, time.Hour, now)
+
+	s2, _ := newFileIdempotencyStore(dir)
+	saved, err := s2.begin("k", "fp", time.Second, now)
+	if err != nil || saved == nil || string(saved.Body) != "ok" || saved.Header.Get("Location") != "/tx/1" {
+		t.Fatalf("after restart: %+v, %v", saved, err)
+	}
+}
+
+func TestGatewayIdempotencyRequiredKey(t *testing.T) {
+	secret := setupGateway(t)
+	resetMetrics(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/charges/", "upstream": "` + upstream.URL + `",
+		"idempotency": {"required": true}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.current.Store(table)
+
+	post := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/charges/", strings.NewReader(`{}`))
+		r.Header.Set("X-API-Key", secret)
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handleGateway(w, r)
+		return w
+	}
+	if w := post(""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "idempotency_key_required") {
+		t.Fatalf("no key: status %d, body %q", w.Code, w.Body)
+	}
+	post("k-1")
+	if w := post("k-1"); w.Header().Get("Idempotent-Replayed") != "true" || w.Header().Get("RateLimit-Remaining") != "2" {
+		t.Fatalf("replay headers %v", w.Header())
+	}
+	m := httptest.NewRecorder()
+	metricsHandler(m, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(m.Body.String(), `gateway_idempotency_requests_total{route="/charges/",result="replayed"} 1`) {
+		t.Fatal("replay not counted in gateway_idempotency_requests_total")
+	}
+}
+
+func mustFileStore(t *testing.T) *fileIdempotencyStore {
+	t.Helper()
+	s, err := newFileIdempotencyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- JWT bearer tokens ---
+//
+// Mobile clients send "Authorization: Bearer <jwt>" instead of X-API-Key.
+// Tokens are checked against keys from a local JWKS file:
+//   - HS256 tokens need a {"kty":"oct"} key (shared secret)
+//   - RS256 tokens need a {"kty":"RSA"} key (public key)
+// The alg in the token header must match the key type, so an RS256 public key
+// can never be abused as an HMAC secret.
+//
+// After the signature, exp / nbf (with a little clock skew), iss and aud are
+// checked against the gateway configuration.
+
+const jwtClockSkew = 30 * time.Second
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("bad token signature")
+	errTokenExpired   = errors.New("token expired")
+	errTokenNotYet    = errors.New("token not valid yet")
+	errTokenIssuer    = errors.New("unexpected token issuer")
+	errTokenAudience  = errors.New("unexpected token audience")
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	K   string `json:"k,omitempty"` // oct: base64url secret
+	N   string `json:"n,omitempty"` // RSA modulus
+	E   string `json:"e,omitempty"` // RSA exponent
+}
+
+// verifyKey is a parsed JWK: exactly one of hmacKey / rsaKey is set.
+type verifyKey struct {
+	kid     string
+	alg     string // "HS256" or "RS256"
+	hmacKey []byte
+	rsaKey  *rsa.PublicKey
+}
+
+type jwtVerifier struct {
+	keys     []verifyKey
+	issuer   string // empty = not checked
+	audience string // empty = not checked
+}
+
+// claims holds the registered claims we check plus the ones we forward.
+type claims struct {
+	Sub    string   `json:"sub"`
+	Iss    string   `json:"iss"`
+	Aud    audience `json:"aud"`
+	Exp    *int64   `json:"exp"`
+	Nbf    *int64   `json:"nbf"`
+	Scope  string   `json:"scope"` // OAuth style: "a b c"
+	Scp    []string `json:"scp"`   // array style
+	Tenant string   `json:"tenant"`
+	Tier   string   `json:"tier"`
+}
+
+func (c *claims) scopes() []string {
+	if len(c.Scp) > 0 {
+		return c.Scp
+	}
+	return strings.Fields(c.Scope)
+}
+
+// audience accepts both "aud":"x" and "aud":["x","y"].
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// loadJWKS reads a JWKS file ({"keys":[...]}) into a verifier.
+func loadJWKS(path, issuer, aud string) (*jwtVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	v := &jwtVerifier{issuer: issuer, audience: aud}
+	for i, k := range set.Keys {
+		vk, err := parseJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d (%q): %w", path, i, k.Kid, err)
+		}
+		v.keys = append(v.keys, vk)
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return v, nil
+}
+
+func parseJWK(k jwk) (verifyKey, error) {
+	switch k.Kty {
+	case "oct":
+		if k.Alg != "" && k.Alg != "HS256" {
+			return verifyKey{}, fmt.Errorf("unsupported alg %q for oct key", k.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) < 32 {
+			return verifyKey{}, errors.New("oct key must be base64url and at least 32 bytes")
+		}
+		return verifyKey{kid: k.Kid, alg: "HS256", hmacKey: secret}, nil
+
+	case "RSA":
+		if k.Alg != "" && k.Alg != "RS256" {
+			return verifyKey{}, fmt.Errorf("unsupported alg %q for RSA key", k.Alg)
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 {
+			return verifyKey{}, errors.New("RSA key needs base64url n and e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return verifyKey{}, errors.New("RSA key must be at least 2048 bits")
+		}
+		return verifyKey{kid: k.Kid, alg: "RS256", rsaKey: pub}, nil
+
+	default:
+		return verifyKey{}, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+}
+
+// verify checks the token signature and registered claims.
+func (v *jwtVerifier) verify(token string, now time.Time) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !v.checkSignature(header.Alg, header.Kid, signed, sig) {
+		return nil, errTokenSignature
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, errTokenMalformed
+	}
+	if c.Exp == nil || !now.Before(time.Unix(*c.Exp, 0).Add(jwtClockSkew)) {
+		return nil, errTokenExpired
+	}
+	if c.Nbf != nil && now.Add(jwtClockSkew).Before(time.Unix(*c.Nbf, 0)) {
+		return nil, errTokenNotYet
+	}
+	if v.issuer != "" && c.Iss != v.issuer {
+		return nil, errTokenIssuer
+	}
+	if v.audience != "" && !contains(c.Aud, v.audience) {
+		return nil, errTokenAudience
+	}
+	return &c, nil
+}
+
+// checkSignature tries every key with a matching alg (and kid, if the token
+// names one). Tokens with alg "none" or anything else never match.
+func (v *jwtVerifier) checkSignature(alg, kid string, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	for _, k := range v.keys {
+		if k.alg != alg || (kid != "" && k.kid != kid) {
+			continue
+		}
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, k.hmacKey)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+		case "RS256":
+			if rsa.VerifyPKCS1v15(k.rsaKey, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+func signToken(t *testing.T, header, payload map[string]interface{}, sign func([]byte) []byte) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	p, _ := json.Marshal(payload)
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(p)
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+func testVerifier(t *testing.T) (*jwtVerifier, []byte, *rsa.PrivateKey) {
+	t.Helper()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "k": b64.EncodeToString(secret)},
+		{"kty": "RSA", "kid": "rs", "n": b64.EncodeToString(priv.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(priv.E)).Bytes())},
+	}}
+	data, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := loadJWKS(path, "https://auth.finpay.local", "finpay-gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, secret, priv
+}
+
+func TestJWTVerify(t *testing.T) {
+	v, secret, priv := testVerifier(t)
+	now := time.Now()
+
+	hs := func(b []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+	rs := func(b []byte) []byte {
+		d := sha256.Sum256(b)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, d[:])
+		return sig
+	}
+	claims := func(mod func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "user-42", "iss": "https://auth.finpay.local", "aud": []string{"finpay-gateway"},
+			"exp": now.Add(time.Minute).Unix(), "scope": "payments:read payments:write", "tenant": "acme",
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	cases := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"hs256 ok", signToken(t, map[string]interface{}{"alg": "HS256", "kid": "hs"}, claims(nil), hs), nil},
+		{"rs256 ok", signToken(t, map[string]interface{}{"alg": "RS256", "kid": "rs"}, claims(nil), rs), nil},
+		{"rs256 no kid", signToken(t, map[string]interface{}{"alg": "RS256"}, claims(nil), rs), nil},
+		{"alg none", signToken(t, map[string]interface{}{"alg": "none"}, claims(nil), func([]byte) []byte { return nil }), errTokenSignature},
+		{"alg swapped", signToken(t, map[string]interface{}{"alg": "HS256", "kid": "rs"}, claims(nil), hs), errTokenSignature},
+		{"expired", signToken(t, map[string]interface{}{"alg": "HS256"}, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }), hs), errTokenExpired},
+		{"no exp", signToken(t, map[string]interface{}{"alg": "HS256"}, claims(func(c map[string]interface{}) { delete(c, "exp") }), hs), errTokenExpired},
+		{"not yet", signToken(t, map[string]interface{}{"alg": "HS256"}, claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() }), hs), errTokenNotYet},
+		{"issuer", signToken(t, map[string]interface{}{"alg": "HS256"}, claims(func(c map[string]interface{}) { c["iss"] = "evil" }), hs), errTokenIssuer},
+		{"audience", signToken(t, map[string]interface{}{"alg": "HS256"}, claims(func(c map[string]interface{}) { c["aud"] = "other" }), hs), errTokenAudience},
+		{"garbage", "a.b", errTokenMalformed},
+	}
+	for _, c := range cases {
+		got, err := v.verify(c.token, now)
+		if !errors.Is(err, c.wantErr) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.wantErr)
+			continue
+		}
+		if err == nil && (got.Sub != "user-42" || got.Tenant != "acme" || len(got.scopes()) != 2) {
+			t.Errorf("%s: claims = %+v", c.name, got)
+		}
+	}
+}
+
+func TestAuthorizeRouteRules(t *testing.T) {
+	rt := &route{auth: authConfig{Accept: []string{authJWT}, Scopes: []string{"payments:write"}, Tenants: []string{"acme"}}}
+
+	ok := &identity{method: authJWT, scopes: []string{"payments:read", "payments:write"}, tenant: "acme"}
+	if err := authorize(ok, rt, "/payments/tx"); err != nil {
+		t.Fatalf("valid caller rejected: %v", err)
+	}
+	for name, id := range map[string]*identity{
+		"api key":       {method: authAPIKey, key: &apiKey{}},
+		"missing scope": {method: authJWT, scopes: []string{"payments:read"}, tenant: "acme"},
+		"wrong tenant":  {method: authJWT, scopes: []string{"payments:write"}, tenant: "globex"},
+	} {
+		if err := authorize(id, rt, "/payments/tx"); !errors.Is(err, errForbidden) {
+			t.Errorf("%s: err = %v, want errForbidden", name, err)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- API key store ---
+//
+// Every client gets its own key. The gateway never stores the key itself,
+// only its SHA-256 hash, so a leaked keys.json cannot be replayed. Each key
+// is tied to:
+//   - a client ID (forwarded upstream as X-Client-ID)
+//   - the route prefixes it may call (empty = all routes)
+//   - an optional expiry
+//   - a rate-limit tier ("free", "standard", "premium")
+//
+// Keys are managed at runtime through the admin API (see below) and saved
+// back to the keys file after each change.
+
+var (
+	errUnknownKey = errors.New("unknown api key")
+	errExpiredKey = errors.New("api key expired")
+	errRevokedKey = errors.New("api key revoked")
+	errKeyStorage = errors.New("saving api keys failed")
+)
+
+type apiKey struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash,omitempty"` // hex SHA-256 of the secret
+	ClientID  string     `json:"client_id"`
+	Prefixes  []string   `json:"prefixes,omitempty"`
+	Tier      string     `json:"tier"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Revoked   bool       `json:"revoked,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// allows reports whether the key may call path.
+func (k *apiKey) allows(path string) bool {
+	if len(k.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range k.Prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+type keysFile struct {
+	Keys []*apiKey `json:"keys"`
+}
+
+type keyStore struct {
+	mu     sync.RWMutex
+	path   string // where changes are saved; empty = memory only
+	byHash map[string]*apiKey
+	byID   map[string]*apiKey
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newKeyStore loads keys from path. A missing file gives an empty store.
+func newKeyStore(path string) (*keyStore, error) {
+	s := &keyStore{path: path, byHash: map[string]*apiKey{}, byID: map[string]*apiKey{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f keysFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, k := range f.Keys {
+		if k.ID == "" || k.Hash == "" || k.ClientID == "" {
+			return nil, fmt.Errorf("%s: key %q needs id, hash and client_id", path, k.ID)
+		}
+		if _, dup := s.byID[k.ID]; dup {
+			return nil, fmt.Errorf("%s: duplicate key id %q", path, k.ID)
+		}
+		s.byHash[k.Hash] = k
+		s.byID[k.ID] = k
+	}
+	return s, nil
+}
+
+// authenticate looks up the key for a secret presented by a client.
+func (s *keyStore) authenticate(secret string, now time.Time) (*apiKey, error) {
+	if secret == "" {
+		return nil, errUnknownKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.byHash[hashKey(secret)]
+	switch {
+	case !ok:
+		return nil, errUnknownKey
+	case k.Revoked:
+		return nil, errRevokedKey
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return nil, errExpiredKey
+	}
+	return k, nil
+}
+
+type issueRequest struct {
+	ClientID string   `json:"client_id"`
+	Prefixes []string `json:"prefixes"`
+	Tier     string   `json:"tier"`
+	TTL      duration `json:"ttl"` // e.g. "720h"; empty = never expires
+}
+
+// issue creates a key and returns its record plus the one-time plaintext secret.
+func (s *keyStore) issue(req issueRequest, now time.Time) (*apiKey, string, error) {
+	k, secret, err := newAPIKey(req, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commitLocked(k); err != nil {
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+// newAPIKey validates req and builds a key for it, without storing it.
+func newAPIKey(req issueRequest, now time.Time) (*apiKey, string, error) {
+	if req.ClientID == "" {
+		return nil, "", errors.New("client_id is required")
+	}
+	if req.Tier == "" {
+		req.Tier = defaultTier
+	}
+	if _, ok := tierLimits[req.Tier]; !ok {
+		return nil, "", fmt.Errorf("unknown tier %q", req.Tier)
+	}
+
+	secret := "fp_" + randomHex(24)
+	k := &apiKey{
+		ID:        "k_" + randomHex(6),
+		Hash:      hashKey(secret),
+		ClientID:  req.ClientID,
+		Prefixes:  req.Prefixes,
+		Tier:      req.Tier,
+		CreatedAt: now.UTC(),
+	}
+	if req.TTL > 0 {
+		exp := now.Add(time.Duration(req.TTL)).UTC()
+		k.ExpiresAt = &exp
+	}
+	return k, secret, nil
+}
+
+// rotate issues a replacement for key id with the same client, prefixes and
+// tier. The old key keeps working for grace (zero = revoked immediately), so
+// clients can switch over without an outage. The whole swap happens under
+// the write lock, so a concurrent revoke either wins (and rotate fails) or
+// revokes the key only after it has been replaced.
+func (s *keyStore) rotate(id string, grace time.Duration, now time.Time) (*apiKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.byID[id]
+	if !ok {
+		return nil, "", errUnknownKey
+	}
+	if old.Revoked {
+		return nil, "", errRevokedKey
+	}
+
+	req := issueRequest{ClientID: old.ClientID, Prefixes: old.Prefixes, Tier: old.Tier}
+	if old.ExpiresAt != nil {
+		req.TTL = duration(old.ExpiresAt.Sub(old.CreatedAt))
+	}
+	k, secret, err := newAPIKey(req, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	retired := *old
+	if grace <= 0 {
+		retired.Revoked = true
+	} else {
+		exp := now.Add(grace).UTC()
+		if old.ExpiresAt == nil || exp.Before(*old.ExpiresAt) {
+			retired.ExpiresAt = &exp
+		}
+	}
+	if err := s.commitLocked(k, &retired); err != nil {
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+func (s *keyStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byID[id]
+	if !ok {
+		return errUnknownKey
+	}
+	revoked := *k
+	revoked.Revoked = true
+	return s.commitLocked(&revoked)
+}
+
+func (s *keyStore) list() []apiKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]apiKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		c := *k
+		c.Hash = "" // never hand hashes out
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// commitLocked adds or replaces keys (by ID). The new set is written to disk
+// first and only then swapped in, so a failed write leaves the store as it
+// was, in memory and on disk. Records are replaced rather than changed in
+// place, since authenticate hands them out. Caller holds s.mu.
+func (s *keyStore) commitLocked(keys ...*apiKey) error {
+	next := make(map[string]*apiKey, len(s.byID)+len(keys))
+	for id, k := range s.byID {
+		next[id] = k
+	}
+	for _, k := range keys {
+		next[k.ID] = k
+	}
+	if err := s.save(next); err != nil {
+		return fmt.Errorf("%w: %v", errKeyStorage, err)
+	}
+	for _, k := range keys {
+		s.byID[k.ID] = k
+		s.byHash[k.Hash] = k
+	}
+	return nil
+}
+
+// save writes keys to disk (write to a temp file, then rename, so a crash
+// never leaves a half-written keys file).
+func (s *keyStore) save(keys map[string]*apiKey) error {
+	if s.path == "" {
+		return nil
+	}
+	f := keysFile{Keys: make([]*apiKey, 0, len(keys))}
+	for _, k := range keys {
+		f.Keys = append(f.Keys, k)
+	}
+	sort.Slice(f.Keys, func(i, j int) bool { return f.Keys[i].ID < f.Keys[j].ID })
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// --- Admin API ---
+//
+//	GET    /admin/keys               list keys (no hashes)
+//	POST   /admin/keys               issue  {"client_id":"mobile","prefixes":["/users/"],"tier":"standard","ttl":"720h"}
+//	POST   /admin/keys/{id}/rotate   rotate {"grace":"1h"} (optional body)
+//	DELETE /admin/keys/{id}          revoke
+//
+// Every call needs X-Admin-Token matching GATEWAY_ADMIN_TOKEN. If that
+// variable is not set the admin API is disabled.
+
+func adminKeysHandler(store *keyStore, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if token == "" {
+			http.Error(w, `{"error":"admin_api_disabled"}`, http.StatusNotFound)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+		parts := strings.Split(rest, "/")
+		now := time.Now()
+
+		switch {
+		case rest == "" && r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": store.list()})
+
+		case rest == "" && r.Method == http.MethodPost:
+			var req issueRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, err)
+				return
+			}
+			k, secret, err := store.issue(req, now)
+			if err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, errKeyStorage) {
+					status = http.StatusInternalServerError
+				}
+				writeAdminError(w, status, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(issuedKey(k, secret))
+
+		case len(parts) == 2 && parts[1] == "rotate" && r.Method == http.MethodPost:
+			var body struct {
+				Grace duration `json:"grace"`
+			}
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					writeAdminError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			k, secret, err := store.rotate(parts[0], time.Duration(body.Grace), now)
+			if err != nil {
+				writeAdminError(w, adminStatus(err), err)
+				return
+			}
+			json.NewEncoder(w).Encode(issuedKey(k, secret))
+
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			if err := store.revoke(parts[0]); err != nil {
+				writeAdminError(w, adminStatus(err), err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id": parts[0], "status": "revoked"})
+
+		default:
+			http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+		}
+	}
+}
+
+// issuedKey is the only response that ever contains a plaintext secret.
+func issuedKey(k *apiKey, secret string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         k.ID,
+		"key":        secret,
+		"client_id":  k.ClientID,
+		"prefixes":   k.Prefixes,
+		"tier":       k.Tier,
+		"expires_at": k.ExpiresAt,
+	}
+}
+
+func adminStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownKey):
+		return http.StatusNotFound
+	case errors.Is(err, errRevokedKey):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
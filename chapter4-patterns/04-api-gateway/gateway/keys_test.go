@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyStoreLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := newKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	k, secret, err := store.issue(issueRequest{ClientID: "mobile", Prefixes: []string{"/payments/"}, Tier: "standard", TTL: duration(time.Hour)}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the hash reaches disk.
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), secret) || !strings.Contains(string(data), hashKey(secret)) {
+		t.Fatalf("keys file should hold the hash, not the secret:\n%s", data)
+	}
+
+	got, err := store.authenticate(secret, now)
+	if err != nil || got.ClientID != "mobile" {
+		t.Fatalf("authenticate = %v, %v", got, err)
+	}
+	if !got.allows("/payments/tx/1") || got.allows("/users/1") {
+		t.Fatal("prefix scoping not applied")
+	}
+	if _, err := store.authenticate(secret, now.Add(2*time.Hour)); !errors.Is(err, errExpiredKey) {
+		t.Fatalf("after ttl: err = %v, want errExpiredKey", err)
+	}
+
+	// Rotation with a grace period: both secrets work until the grace ends.
+	_, newSecret, err := store.rotate(k.ID, time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.authenticate(secret, now.Add(30*time.Second)); err != nil {
+		t.Fatalf("old secret inside grace: %v", err)
+	}
+	if _, err := store.authenticate(secret, now.Add(2*time.Minute)); !errors.Is(err, errExpiredKey) {
+		t.Fatalf("old secret after grace: err = %v", err)
+	}
+	if _, err := store.authenticate(newSecret, now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("new secret: %v", err)
+	}
+
+	// A reloaded store sees the same keys.
+	reloaded, err := newKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.authenticate(newSecret, now); err != nil {
+		t.Fatalf("reloaded store: %v", err)
+	}
+	if err := reloaded.revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.authenticate(secret, now); !errors.Is(err, errRevokedKey) {
+		t.Fatalf("revoked key: err = %v", err)
+	}
+}
+
+func TestKeyStoreRotateRacesRevoke(t *testing.T) {
+	store := &keyStore{byHash: map[string]*apiKey{}, byID: map[string]*apiKey{}}
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		k, _, err := store.issue(issueRequest{ClientID: "mobile", TTL: duration(time.Hour)}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var rotated *apiKey
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rotated, _, _ = store.rotate(k.ID, time.Minute, now)
+		}()
+		go func() {
+			defer wg.Done()
+			store.revoke(k.ID)
+		}()
+		wg.Wait()
+
+		// Either the revoke came first and nothing was rotated, or the
+		// rotation happened on a key that was still live.
+		if rotated != nil && rotated.Revoked {
+			t.Fatal("rotate produced a revoked key")
+		}
+	}
+}
+
+func TestKeyStoreFailedWritesChangeNothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := newKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	k, secret, err := store.issue(issueRequest{ClientID: "mobile"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+
+	// A directory in the way of the temp file makes every write fail.
+	if err := os.Mkdir(path+".tmp", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.issue(issueRequest{ClientID: "web"}, now); !errors.Is(err, errKeyStorage) {
+		t.Fatalf("issue: err = %v, want errKeyStorage", err)
+	}
+	if _, _, err := store.rotate(k.ID, 0, now); !errors.Is(err, errKeyStorage) {
+		t.Fatalf("rotate: err = %v, want errKeyStorage", err)
+	}
+	if err := store.revoke(k.ID); !errors.Is(err, errKeyStorage) {
+		t.Fatalf("revoke: err = %v, want errKeyStorage", err)
+	}
+	if n := len(store.list()); n != 1 {
+		t.Fatalf("%d keys after failed writes, want 1", n)
+	}
+	if _, err := store.authenticate(secret, now); err != nil {
+		t.Fatalf("the key stopped working after failed writes: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(saved) {
+		t.Fatal("the keys file changed")
+	}
+
+	h := adminKeysHandler(store, "admin-secret")
+	if code, _ := adminCall(t, h, "POST", "/admin/keys", `{"client_id":"web"}`); code != http.StatusInternalServerError {
+		t.Fatalf("issue: status %d, want 500", code)
+	}
+	if code, _ := adminCall(t, h, "DELETE", "/admin/keys/"+k.ID, ""); code != http.StatusInternalServerError {
+		t.Fatalf("revoke: status %d, want 500", code)
+	}
+}
+
+func adminCall(t *testing.T, h http.HandlerFunc, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body == "" {
+		r.ContentLength = 0
+	}
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	w := httptest.NewRecorder()
+	h(w, r)
+	var out map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s %s: invalid JSON %q", method, path, w.Body)
+	}
+	return w.Code, out
+}
+
+func TestAdminKeysHandler(t *testing.T) {
+	store, err := newKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := adminKeysHandler(store, "admin-secret")
+	now := time.Now()
+
+	// Issue
+	code, issued := adminCall(t, h, "POST", "/admin/keys", `{"client_id":"mobile","prefixes":["/users/"],"tier":"standard","ttl":"720h"}`)
+	if code != http.StatusCreated || issued["client_id"] != "mobile" || issued["tier"] != "standard" {
+		t.Fatalf("issue: %d %v", code, issued)
+	}
+	id, secret := issued["id"].(string), issued["key"].(string)
+	if _, err := store.authenticate(secret, now); err != nil {
+		t.Fatalf("issued key: %v", err)
+	}
+	if code, _ := adminCall(t, h, "POST", "/admin/keys", `{"client_id":"mobile","tier":"gold"}`); code != http.StatusBadRequest {
+		t.Fatalf("unknown tier: status %d, want 400", code)
+	}
+
+	// List never shows hashes or secrets
+	r := httptest.NewRequest("GET", "/admin/keys", nil)
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), secret) || strings.Contains(w.Body.String(), hashKey(secret)) {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+
+	// Rotate without a body revokes the old key at once
+	code, rotated := adminCall(t, h, "POST", "/admin/keys/"+id+"/rotate", "")
+	if code != http.StatusOK || rotated["id"] == id {
+		t.Fatalf("rotate: %d %v", code, rotated)
+	}
+	if _, err := store.authenticate(secret, now); !errors.Is(err, errRevokedKey) {
+		t.Fatalf("old key after rotate: err = %v", err)
+	}
+	if code, _ := adminCall(t, h, "POST", "/admin/keys/"+id+"/rotate", `{"grace":"1h"}`); code != http.StatusConflict {
+		t.Fatalf("rotating a revoked key: status %d, want 409", code)
+	}
+
+	// Revoke
+	newID, newSecret := rotated["id"].(string), rotated["key"].(string)
+	if code, out := adminCall(t, h, "DELETE", "/admin/keys/"+newID, ""); code != http.StatusOK || out["status"] != "revoked" {
+		t.Fatalf("revoke: %d %v", code, out)
+	}
+	if _, err := store.authenticate(newSecret, now); !errors.Is(err, errRevokedKey) {
+		t.Fatalf("revoked key: err = %v", err)
+	}
+	if code, _ := adminCall(t, h, "DELETE", "/admin/keys/k_missing", ""); code != http.StatusNotFound {
+		t.Fatalf("revoking an unknown key: status %d, want 404", code)
+	}
+}
+
+func TestAdminKeysHandlerNeedsToken(t *testing.T) {
+	store := &keyStore{byHash: map[string]*apiKey{}, byID: map[string]*apiKey{}}
+
+	w := httptest.NewRecorder()
+	adminKeysHandler(store, "")(w, httptest.NewRequest("GET", "/admin/keys", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("no admin token configured: status %d, want 404", w.Code)
+	}
+
+	r := httptest.NewRequest("POST", "/admin/keys", strings.NewReader(`{"client_id":"mobile"}`))
+	r.Header.Set("X-Admin-Token", "wrong")
+	w = httptest.NewRecorder()
+	adminKeysHandler(store, "admin-secret")(w, r)
+	if w.Code != http.StatusUnauthorized || len(store.byID) != 0 {
+		t.Fatalf("wrong admin token: status %d, %d keys", w.Code, len(store.byID))
+	}
+}
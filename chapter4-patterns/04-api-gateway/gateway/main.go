@@ -3,78 +3,108 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"net/netip"
+	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"patterns/internal/server"
 )
 
 // A simple API Gateway that:
-// 1) Validates an API key
-// 2) Applies rate limits
-// 3) Adds a request ID
-// 4) Routes requests to backend services
-// 5) Proxies the request and returns the response
-
-const validAPIKey = "demo-key-123"
-
-// Route table: path prefix -> backend service
-var backends = map[string]string{
-	"/users/":    "http://localhost:7001",
-	"/payments/": "http://localhost:7002",
-}
-
-// --- Rate limiting (per IP) ---
-type bucket struct {
-	tokens int
-	last   time.Time
-}
+// 1) Routes requests to backend services (route table comes from a file)
+// 2) Authenticates the caller (API key or bearer JWT) and applies route rules
+// 3) Applies token-bucket rate limits (by client, IP or route)
+// 4) Adds a request ID and validates the request where routes have an OpenAPI document
+// 5) Load-balances across healthy upstream instances
+// 6) Proxies the request and returns the response, caching GETs and replaying
+//    POSTs with a known Idempotency-Key where routes allow it
 
 var (
-	mu      sync.Mutex
-	buckets = map[string]*bucket{}
-	rate    = 5
-	per     = 10 * time.Second
+	// Route table, loaded from GATEWAY_ROUTES (default: routes.json)
+	routes *routeStore
+	// API keys, loaded from GATEWAY_KEYS (default: keys.json)
+	keys *keyStore
+	// Token buckets for rate limiting: memory (default) or Redis, see GATEWAY_RATE_STORE
+	rates rateStore
+	// What to do when the rate store is unreachable: fail open (default) or closed
+	rateFailOpen = true
+	// Cached responses for routes with a "cache" block, bounded by GATEWAY_CACHE_MB (default 64)
+	responses *responseCache
+	// Saved responses for Idempotency-Key replays: memory (default) or file, see GATEWAY_IDEMPOTENCY_STORE
+	idempotency idempotencyStore
+	// Proxies whose X-Forwarded-For is believed, from GATEWAY_TRUSTED_PROXIES (default: none)
+	trustedProxies []netip.Prefix
 )
 
-func allow(ip string) bool {
-	mu.Lock()
-	defer mu.Unlock()
+// --- Helpers ---
 
-	now := time.Now()
-	b, ok := buckets[ip]
-	if !ok {
-		b = &bucket{tokens: rate, last: now}
-		buckets[ip] = b
+// getClientIP is the address a request came from. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy, and then read
+// from the right: the first hop that isn't a trusted proxy is the client.
+// Anything left of it was written by the client, which can put any address
+// there (and get a fresh rate-limit bucket for each one).
+func getClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
 	}
-
-	// Reset tokens if enough time passed
-	if now.Sub(b.last) >= per {
-		b.tokens = rate
-		b.last = now
+	if !isTrustedProxy(ip) {
+		return ip
 	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip // every hop is a proxy: the left-most is as close as it gets
+}
 
-	if b.tokens > 0 {
-		b.tokens--
-		return true
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
 	}
 	return false
 }
 
-// --- Helpers ---
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return strings.Split(xff, ",")[0]
-	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+// parseTrustedProxies reads a comma-separated list of CIDRs or single
+// addresses, e.g. "10.0.0.0/8, 192.168.1.7".
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(f); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR or an IP address", f)
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
 	}
-	return host
+	return out, nil
 }
 
 func randomRequestID() string {
@@ -83,67 +113,194 @@ func randomRequestID() string {
 	return hex.EncodeToString(b[:])
 }
 
-func chooseBackend(path string) *url.URL {
-	for prefix, raw := range backends {
-		if strings.HasPrefix(path, prefix) {
-			u, _ := url.Parse(raw)
-			return u
+func main() {
+	path := os.Getenv("GATEWAY_ROUTES")
+	if path == "" {
+		path = "routes.json"
+	}
+
+	var err error
+	routes, err = newRouteStore(path)
+	if err != nil {
+		log.Fatalf("[gateway] loading routes: %v", err)
+	}
+	go routes.watch(2 * time.Second)
+	log.Printf("[gateway] loaded %d routes from %s", len(routes.table().routes), path)
+
+	switch store := os.Getenv("GATEWAY_RATE_STORE"); store {
+	case "", "memory":
+		mem := newMemoryRateStore()
+		go mem.sweep(time.Minute)
+		rates = mem
+	case "redis":
+		addr := os.Getenv("GATEWAY_REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
 		}
+		rates = newRedisRateStore(addr, os.Getenv("GATEWAY_REDIS_PASSWORD"))
+		log.Printf("[gateway] rate limits shared through redis at %s", addr)
+	default:
+		log.Fatalf("[gateway] unknown GATEWAY_RATE_STORE %q (want memory or redis)", store)
+	}
+	rateFailOpen = os.Getenv("GATEWAY_RATE_FAIL") != "closed"
+	if trustedProxies, err = parseTrustedProxies(os.Getenv("GATEWAY_TRUSTED_PROXIES")); err != nil {
+		log.Fatalf("[gateway] GATEWAY_TRUSTED_PROXIES: %v", err)
 	}
-	return nil
-}
 
-func main() {
+	cacheMB := 64
+	if v := os.Getenv("GATEWAY_CACHE_MB"); v != "" {
+		if cacheMB, err = strconv.Atoi(v); err != nil || cacheMB <= 0 {
+			log.Fatalf("[gateway] invalid GATEWAY_CACHE_MB %q", v)
+		}
+	}
+	responses = newResponseCache(cacheMB << 20)
+
+	switch store := os.Getenv("GATEWAY_IDEMPOTENCY_STORE"); store {
+	case "", "memory":
+		mem := newMemoryIdempotencyStore()
+		go mem.sweep(time.Minute)
+		idempotency = mem
+	case "file":
+		dir := os.Getenv("GATEWAY_IDEMPOTENCY_DIR")
+		if dir == "" {
+			dir = "idempotency"
+		}
+		fs, err := newFileIdempotencyStore(dir)
+		if err != nil {
+			log.Fatalf("[gateway] idempotency store: %v", err)
+		}
+		go fs.sweep(time.Minute)
+		idempotency = fs
+		log.Printf("[gateway] idempotency records kept in %s", dir)
+	default:
+		log.Fatalf("[gateway] unknown GATEWAY_IDEMPOTENCY_STORE %q (want memory or file)", store)
+	}
+
+	keysPath := os.Getenv("GATEWAY_KEYS")
+	if keysPath == "" {
+		keysPath = "keys.json"
+	}
+	keys, err = newKeyStore(keysPath)
+	if err != nil {
+		log.Fatalf("[gateway] loading keys: %v", err)
+	}
+
+	if jwksPath := os.Getenv("GATEWAY_JWKS"); jwksPath != "" {
+		jwtAuth, err = loadJWKS(jwksPath, os.Getenv("GATEWAY_JWT_ISSUER"), os.Getenv("GATEWAY_JWT_AUDIENCE"))
+		if err != nil {
+			log.Fatalf("[gateway] loading JWKS: %v", err)
+		}
+		log.Printf("[gateway] bearer JWTs enabled (%d keys from %s)", len(jwtAuth.keys), jwksPath)
+	}
+
+	http.HandleFunc("/admin/keys", adminKeysHandler(keys, os.Getenv("GATEWAY_ADMIN_TOKEN")))
+	http.HandleFunc("/admin/keys/", adminKeysHandler(keys, os.Getenv("GATEWAY_ADMIN_TOKEN")))
+	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/", handleGateway)
-	log.Println("[gateway] listening on :8000")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	server.Main("gateway", ":8000", nil) // GATEWAY_ADDR, timeouts and SIGTERM draining: see internal/server
 }
 
 func handleGateway(w http.ResponseWriter, r *http.Request) {
-	// 1) API key check
-	if r.Header.Get("X-API-Key") != validAPIKey {
+	// Every request ends with an access-log line and metrics (accesslog.go)
+	ip := getClientIP(r)
+	rec := newAccessRecord(r, ip)
+	sr := &statusRecorder{ResponseWriter: w}
+	defer rec.finish(sr)
+	w = sr
+
+	// 1) Find the route. The table is a snapshot: a reload that happens
+	// while this request is in flight does not affect it.
+	table := routes.table()
+	m, allowed := table.match(r)
+	if m == nil && len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if m == nil {
+		http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+		return
+	}
+	rt := m.route
+	rec.Route = rt.prefix
+
+	// 2) Authenticate (API key or bearer JWT), then apply the route's rules
+	id, err := authenticate(r, time.Now())
+	if err != nil {
+		authFailuresTotal.inc(rt.prefix, authFailureReason(err))
 		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
 		return
 	}
+	rec.setIdentity(id)
+	if err := authorize(id, rt, r.URL.Path); err != nil {
+		authFailuresTotal.inc(rt.prefix, authFailureReason(err))
+		http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+		return
+	}
 
-	// 2) Rate limit
-	ip := getClientIP(r)
-	if !allow(ip) {
+	// 3) Rate limit (token bucket per client, IP or route)
+	bucketKey, limit := bucketFor(rt, id, ip)
+	decision, err := rates.take(r.Context(), bucketKey, limit, time.Now())
+	switch {
+	case err != nil && rateFailOpen:
+		log.Printf("[gateway] rate store unavailable, allowing request: %v", err)
+	case err != nil:
+		log.Printf("[gateway] rate store unavailable, rejecting request: %v", err)
+		http.Error(w, `{"error":"rate_limiter_unavailable"}`, http.StatusServiceUnavailable)
+		return
+	default:
+		writeRateHeaders(w.Header(), decision)
+	}
+	if err == nil && !decision.allowed {
+		rateLimitedTotal.inc(rt.prefix, id.clientID)
 		http.Error(w, `{"error":"rate_limit_exceeded"}`, http.StatusTooManyRequests)
 		return
 	}
 
-	// 3) Add a request ID
+	// 4) Add a request ID
 	reqID := randomRequestID()
 	w.Header().Set("X-Request-ID", reqID)
 	r.Header.Set("X-Request-ID", reqID)
+	rec.RequestID = reqID
 
-	// 4) Find the backend
-	target := chooseBackend(r.URL.Path)
-	if target == nil {
-		http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+	// Check the body size and, if the route has an OpenAPI document, the
+	// parameters and body (validate.go)
+	if !checkRequest(w, r, m) {
 		return
 	}
 
-	// 5) Proxy the request
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	// Composite routes fan out to other routes instead (see compose.go)
+	if rt.compose != nil {
+		serveComposite(w, r, table, m, id, reqID, ip)
+		return
+	}
 
-	// Rewrite path: remove prefix before forwarding
-	origDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		origDirector(req)
-		req.Header.Set("X-Request-ID", reqID)
+	// 5) Pick the variant (stable or a canary), then an instance of it, and
+	// proxy the request through the route's long-lived proxy
+	v := rt.variantFor(r, id)
+	rec.Variant = v.name
+	forward := func(w http.ResponseWriter, r *http.Request) {
+		up := v.pool.pick(r, ip)
+		if up == nil {
+			http.Error(w, `{"error":"no_healthy_upstream"}`, http.StatusServiceUnavailable)
+			return
+		}
+		rec.Upstream = up.url.Host
+		serveProxy(w, r, &proxyState{match: m, variant: v.name, up: up, id: id, reqID: reqID})
+	}
 
-		for prefix := range backends {
-			if strings.HasPrefix(req.URL.Path, prefix) {
-				req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
-				if req.URL.Path == "" {
-					req.URL.Path = "/"
-				}
-				break
-			}
+	// 6) Answer from the response cache when the route has one
+	serve := forward
+	if rt.cache != nil {
+		serve = func(w http.ResponseWriter, r *http.Request) {
+			responses.serve(w, r, rt.cache, v.name, id, forward)
 		}
 	}
 
-	proxy.ServeHTTP(w, r)
-}
\ No newline at end of file
+	// 7) Replay POSTs whose Idempotency-Key has been seen (idempotency.go)
+	if rt.idempotency != nil {
+		serveIdempotent(w, r, rt, id, serve)
+		return
+	}
+	serve(w, r)
+}
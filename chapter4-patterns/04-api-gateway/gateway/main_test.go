@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupGateway points the gateway globals at a test upstream and returns an
+// API key that may call every route.
+func setupGateway(t *testing.T) (secret string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"path":%q,"client_id":%q}`, r.URL.Path, r.Header.Get("X-Client-ID"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "` + upstream.URL + `"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes = &routeStore{}
+	routes.current.Store(table)
+
+	keys = &keyStore{byHash: map[string]*apiKey{}, byID: map[string]*apiKey{}}
+	_, secret, err = keys.issue(issueRequest{ClientID: "test-client"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates = newMemoryRateStore()
+	rateFailOpen = true
+	idempotency = newMemoryIdempotencyStore()
+	accessLog.SetOutput(io.Discard)
+	return secret
+}
+
+func gatewayGet(secret, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("X-API-Key", secret)
+	w := httptest.NewRecorder()
+	handleGateway(w, r)
+	return w
+}
+
+func TestGatewayRateStoreFailureModes(t *testing.T) {
+	secret := setupGateway(t)
+
+	// Nothing listens on a closed listener's address.
+	srv := startFakeRedis(t, "")
+	srv.ln.Close()
+	rates = newRedisRateStore(srv.addr(), "")
+
+	rateFailOpen = true
+	if w := gatewayGet(secret, "/users/1"); w.Code != http.StatusOK {
+		t.Fatalf("fail open: status %d, want 200", w.Code)
+	}
+
+	rateFailOpen = false
+	if w := gatewayGet(secret, "/users/1"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("fail closed: status %d, want 503", w.Code)
+	}
+}
+
+func TestGatewayRateLimitHeaders(t *testing.T) {
+	secret := setupGateway(t)
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 6; i++ {
+		w = gatewayGet(secret, "/users/1")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("6th request on the free tier: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("RateLimit-Limit") != "5" || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("headers = %v", w.Header())
+	}
+
+	m := httptest.NewRecorder()
+	metricsHandler(m, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(m.Body.String(), `gateway_rate_limited_total{route="/users/",client="test-client"}`) {
+		t.Fatal("rejection not counted in gateway_rate_limited_total")
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+
+	for _, tc := range []struct {
+		trusted []netip.Prefix
+		remote  string
+		xff     []string
+		want    string
+	}{
+		// Without trusted proxies the header is ignored.
+		{nil, "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		// Not from a trusted proxy: the header is ignored too.
+		{proxies, "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		// The right-most hop that isn't a proxy is the client; what the
+		// client wrote further left doesn't matter.
+		{proxies, "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{proxies, "10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.7, 192.168.1.7"}, "198.51.100.7"},
+		// Only proxies: the left-most one.
+		{proxies, "10.0.0.2:5000", []string{"10.1.1.1, 192.168.1.7"}, "10.1.1.1"},
+		{proxies, "10.0.0.2:5000", nil, "10.0.0.2"},
+	} {
+		trustedProxies = tc.trusted
+		r := httptest.NewRequest("GET", "/users/1", nil)
+		r.RemoteAddr = tc.remote
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := getClientIP(r); got != tc.want {
+			t.Errorf("trusted %v, from %s, X-Forwarded-For %q: %s, want %s", tc.trusted, tc.remote, tc.xff, got, tc.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/8, proxy.local"); err == nil {
+		t.Error("parseTrustedProxies accepted a host name")
+	}
+}
+
+func TestGatewayRateLimitsIgnoreSpoofedForwardedFor(t *testing.T) {
+	secret := setupGateway(t)
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "http://127.0.0.1:1",
+		"rate_limit": {"key": "ip", "limit": 1, "per": "1m"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.current.Store(table)
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/users/1", nil)
+		r.Header.Set("X-API-Key", secret)
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("1.2.3.%d", i))
+		w = httptest.NewRecorder()
+		handleGateway(w, r)
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("a new X-Forwarded-For got a fresh bucket: status %d, want 429", w.Code)
+	}
+}
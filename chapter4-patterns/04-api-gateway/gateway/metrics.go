@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Prometheus metrics ---
+//
+// GET /metrics serves the Prometheus text format. The handful of counters
+// and histograms below are written by hand, so the gateway needs no client
+// library:
+//
+//	gateway_requests_total{route,method,code}              requests by status class (2xx, 4xx, ...)
+//	gateway_request_duration_seconds{route}                time spent in the gateway, end to end
+//	gateway_upstream_duration_seconds{route,upstream}      time to get an answer from one instance
+//	gateway_rate_limited_total{route,client}               requests rejected with 429
+//	gateway_auth_failures_total{route,reason}              401s and 403s, by reason
+//	gateway_cache_requests_total{route,result}             HIT / MISS / REVALIDATED / BYPASS
+//	gateway_variant_responses_total{route,variant,code}    upstream answers per traffic-split variant
+//	gateway_variant_duration_seconds{route,variant}        upstream latency per variant
+//	gateway_idempotency_requests_total{route,result}       stored / replayed / reused / in_flight / unsettled
+//
+// route is the matching route's prefix, or "unmatched". method is one of the
+// standard HTTP methods, or "OTHER".
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	requestsTotal     = newCounterVec("gateway_requests_total", "Requests handled by the gateway.", "route", "method", "code")
+	requestSeconds    = newHistogramVec("gateway_request_duration_seconds", "Time from receiving a request to finishing the response.", latencyBuckets, "route")
+	upstreamSeconds   = newHistogramVec("gateway_upstream_duration_seconds", "Time an upstream instance took to answer.", latencyBuckets, "route", "upstream")
+	rateLimitedTotal  = newCounterVec("gateway_rate_limited_total", "Requests rejected by the rate limiter.", "route", "client")
+	authFailuresTotal = newCounterVec("gateway_auth_failures_total", "Requests rejected with 401 or 403.", "route", "reason")
+	cacheTotal        = newCounterVec("gateway_cache_requests_total", "Requests on cached routes, by cache result.", "route", "result")
+	variantTotal      = newCounterVec("gateway_variant_responses_total", "Upstream answers on routes that split traffic, by variant.", "route", "variant", "code")
+	variantSeconds    = newHistogramVec("gateway_variant_duration_seconds", "Upstream latency on routes that split traffic, by variant.", latencyBuckets, "route", "variant")
+	idempotencyTotal  = newCounterVec("gateway_idempotency_requests_total", "POSTs with an Idempotency-Key, by outcome.", "route", "result")
+
+	allMetrics = []metric{requestsTotal, requestSeconds, upstreamSeconds, rateLimitedTotal, authFailuresTotal, cacheTotal, variantTotal, variantSeconds, idempotencyTotal}
+)
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// metricsHandler serves every metric in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range allMetrics {
+		m.writeTo(w)
+	}
+}
+
+// observeUpstream records one upstream answer (or a transport error, as 502).
+func observeUpstream(rt *route, st *proxyState, status int) {
+	elapsed := time.Since(st.start)
+	upstreamSeconds.observe(elapsed, rt.prefix, st.up.url.Host)
+	if st.variant != "" {
+		variantTotal.inc(rt.prefix, st.variant, strconv.Itoa(status/100)+"xx")
+		variantSeconds.observe(elapsed, rt.prefix, st.variant)
+	}
+}
+
+// authFailureReason turns an authenticate/authorize error into a label value.
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, errNoCredentials):
+		return "no_credentials"
+	case errors.Is(err, errUnknownKey):
+		return "unknown_key"
+	case errors.Is(err, errExpiredKey):
+		return "expired_key"
+	case errors.Is(err, errRevokedKey):
+		return "revoked_key"
+	case errors.Is(err, errJWTDisabled):
+		return "jwt_disabled"
+	case errors.Is(err, errTokenExpired):
+		return "token_expired"
+	case errors.Is(err, errForbidden):
+		return "forbidden"
+	default:
+		return "invalid_token"
+	}
+}
+
+// --- Counters ---
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := renderLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// --- Histograms ---
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	v := d.Seconds()
+	key := renderLabels(h.labels, labelValues)
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with le >= v
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		// key is "{a="x"}" (or ""): le goes inside the same braces
+		inner := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+		if inner != "" {
+			inner += ","
+		}
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, inner, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, inner, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// --- Text format helpers ---
+
+// renderLabels builds `{a="x",b="y"}` with values escaped as the format requires.
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(v))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
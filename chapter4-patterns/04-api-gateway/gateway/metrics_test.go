@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	c := newCounterVec("test_total", "A counter.", "route", "code")
+	c.inc("/users/", "2xx")
+	c.inc("/users/", "2xx")
+	c.inc(`/we"ird/`, "5xx")
+
+	h := newHistogramVec("test_seconds", "A histogram.", []float64{.1, 1}, "route")
+	h.observe(50*time.Millisecond, "/users/")
+	h.observe(500*time.Millisecond, "/users/")
+	h.observe(2*time.Second, "/users/")
+
+	var b bytes.Buffer
+	c.writeTo(&b)
+	h.writeTo(&b)
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{route="/users/",code="2xx"} 2
+test_total{route="/we\"ird/",code="5xx"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/users/",le="0.1"} 1
+test_seconds_bucket{route="/users/",le="1"} 2
+test_seconds_bucket{route="/users/",le="+Inf"} 3
+test_seconds_sum{route="/users/"} 2.55
+test_seconds_count{route="/users/"} 3
+`
+	if b.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+// resetMetrics empties the gateway's metrics now and when the test ends, so
+// that a test can assert exact values however many times it runs.
+func resetMetrics(t *testing.T) {
+	reset := func() {
+		for _, m := range allMetrics {
+			switch m := m.(type) {
+			case *counterVec:
+				m.mu.Lock()
+				m.values = map[string]float64{}
+				m.mu.Unlock()
+			case *histogramVec:
+				m.mu.Lock()
+				m.series = map[string]*histogram{}
+				m.mu.Unlock()
+			}
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestGatewayAccessLogAndMetrics(t *testing.T) {
+	secret := setupGateway(t)
+	resetMetrics(t)
+	var logs bytes.Buffer
+	accessLog.SetOutput(&logs)
+	defer accessLog.SetOutput(io.Discard)
+
+	gatewayGet(secret, "/users/42")
+	gatewayGet("not-a-key", "/users/42")
+	gatewayGet(secret, "/nowhere")
+	r := httptest.NewRequest("GET", "/users/42", nil)
+	r.Method = "X-MADE-UP-1234"
+	handleGateway(httptest.NewRecorder(), r)
+
+	var lines []accessRecord
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var rec accessRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		lines = append(lines, rec)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("got %d log lines, want 4:\n%s", len(lines), logs.String())
+	}
+	ok := lines[0]
+	if ok.Status != 200 || ok.Route != "/users/" || ok.ClientID != "test-client" || ok.AuthMethod != authAPIKey ||
+		ok.RequestID == "" || ok.Upstream == "" || ok.Path != "/users/42" || ok.Bytes == 0 {
+		t.Errorf("success line = %+v", ok)
+	}
+	if lines[1].Status != 401 || lines[1].ClientID != "" || lines[2].Status != 404 || lines[2].Route != "unmatched" {
+		t.Errorf("rejections = %+v, %+v", lines[1], lines[2])
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`gateway_requests_total{route="/users/",method="GET",code="2xx"}`,
+		`gateway_requests_total{route="unmatched",method="GET",code="4xx"}`,
+		`gateway_requests_total{route="/users/",method="OTHER",code="4xx"}`,
+		`gateway_auth_failures_total{route="/users/",reason="unknown_key"} 1`,
+		`gateway_upstream_duration_seconds_count{route="/users/",upstream="` + ok.Upstream + `"}`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if strings.Contains(w.Body.String(), "X-MADE-UP-1234") {
+		t.Error("a made-up method became a label value")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --- OpenAPI documents ---
+//
+// A route can point at an OpenAPI 3 document (JSON) describing what its
+// backend accepts:
+//
+//	{"prefix": "/payments/charges", "upstream": "http://localhost:7002", "strip_prefix": false,
+//	 "openapi": "openapi/payments.json", "max_body_bytes": 16384}
+//
+// Paths in the document are matched against the path the backend sees, so
+// with strip_prefix (the default) they don't include the route prefix.
+//
+// This file loads the document into a list of operations. validate.go
+// checks requests against them. The subset of OpenAPI understood is:
+// path/query/header parameters, application/json request bodies, $ref into
+// components/schemas and components/parameters, and these schema keywords:
+// type, format (date, date-time, uuid, email), nullable, enum, minLength,
+// maxLength, pattern, minimum, maximum, exclusiveMinimum/Maximum, minItems,
+// maxItems, items, properties, required, additionalProperties, allOf, anyOf
+// and oneOf.
+
+type openAPIDoc struct {
+	OpenAPI    string               `json:"openapi"`
+	Paths      map[string]*pathItem `json:"paths"`
+	Components struct {
+		Schemas    map[string]*schema    `json:"schemas"`
+		Parameters map[string]*parameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type pathItem struct {
+	Parameters []*parameter `json:"parameters"`
+	Get        *operation   `json:"get"`
+	Put        *operation   `json:"put"`
+	Post       *operation   `json:"post"`
+	Delete     *operation   `json:"delete"`
+	Patch      *operation   `json:"patch"`
+	Head       *operation   `json:"head"`
+	Options    *operation   `json:"options"`
+}
+
+func (p *pathItem) operations() map[string]*operation {
+	return map[string]*operation{
+		http.MethodGet: p.Get, http.MethodPut: p.Put, http.MethodPost: p.Post, http.MethodDelete: p.Delete,
+		http.MethodPatch: p.Patch, http.MethodHead: p.Head, http.MethodOptions: p.Options,
+	}
+}
+
+type operation struct {
+	Parameters  []*parameter `json:"parameters"`
+	RequestBody *requestBody `json:"requestBody"`
+}
+
+type parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"` // path, query or header
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool `json:"required"`
+	Content  map[string]struct {
+		Schema *schema `json:"schema"`
+	} `json:"content"`
+}
+
+type schema struct {
+	Ref              string             `json:"$ref"`
+	Type             string             `json:"type"`
+	Format           string             `json:"format"`
+	Nullable         bool               `json:"nullable"`
+	Enum             []interface{}      `json:"enum"`
+	MinLength        *int               `json:"minLength"`
+	MaxLength        *int               `json:"maxLength"`
+	Pattern          string             `json:"pattern"`
+	Minimum          *float64           `json:"minimum"`
+	Maximum          *float64           `json:"maximum"`
+	ExclusiveMinimum bool               `json:"exclusiveMinimum"`
+	ExclusiveMaximum bool               `json:"exclusiveMaximum"`
+	MinItems         *int               `json:"minItems"`
+	MaxItems         *int               `json:"maxItems"`
+	Items            *schema            `json:"items"`
+	Properties       map[string]*schema `json:"properties"`
+	Required         []string           `json:"required"`
+	AdditionalProps  json.RawMessage    `json:"additionalProperties"`
+	AllOf            []*schema          `json:"allOf"`
+	AnyOf            []*schema          `json:"anyOf"`
+	OneOf            []*schema          `json:"oneOf"`
+
+	// filled in by resolve
+	target       *schema // what $ref points at
+	re           *regexp.Regexp
+	noAdditional bool    // additionalProperties: false
+	additional   *schema // additionalProperties: {...}
+}
+
+// apiSpec is a loaded document, ready to check requests against.
+type apiSpec struct {
+	ops     []*apiOperation    // literal segments before {params}, see loadOpenAPI
+	schemas map[string]*schema // components/schemas, resolved
+}
+
+type apiOperation struct {
+	method   string
+	path     string   // as written in the document
+	segments []string // "charges", "{id}"
+	params   []*parameter
+	body     *requestBody
+	bodyJSON *schema // schema of the application/json body, if any
+}
+
+// loadOpenAPI reads and compiles a document.
+func loadOpenAPI(path string) (*apiSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc openAPIDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w (only JSON documents are supported)", path, err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("%s: openapi version %q, want 3.x", path, doc.OpenAPI)
+	}
+	r := &resolver{doc: &doc, seen: map[*schema]bool{}}
+
+	spec := &apiSpec{schemas: doc.Components.Schemas}
+	for name, s := range doc.Components.Schemas {
+		if err := r.schema(s); err != nil {
+			return nil, fmt.Errorf("%s: components/schemas/%s: %w", path, name, err)
+		}
+	}
+	for p, item := range doc.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("%s: path %q must start with /", path, p)
+		}
+		for method, op := range item.operations() {
+			if op == nil {
+				continue
+			}
+			o := &apiOperation{method: method, path: p, segments: splitPath(p), body: op.RequestBody}
+			// Operation parameters override path-level ones with the same name and location.
+			byKey := map[string]*parameter{}
+			for _, list := range [][]*parameter{item.Parameters, op.Parameters} {
+				for _, prm := range list {
+					prm, err := r.parameter(prm)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %s %s: %w", path, method, p, err)
+					}
+					byKey[prm.In+":"+strings.ToLower(prm.Name)] = prm
+				}
+			}
+			for _, prm := range byKey {
+				o.params = append(o.params, prm)
+			}
+			sort.Slice(o.params, func(i, j int) bool { return o.params[i].In+o.params[i].Name < o.params[j].In+o.params[j].Name })
+			if op.RequestBody != nil {
+				if c, ok := op.RequestBody.Content["application/json"]; ok && c.Schema != nil {
+					if err := r.schema(c.Schema); err != nil {
+						return nil, fmt.Errorf("%s: %s %s: %w", path, method, p, err)
+					}
+					o.bodyJSON = c.Schema
+				}
+			}
+			spec.ops = append(spec.ops, o)
+		}
+	}
+	// Literal segments win over {params}: /charges/refunds before /charges/{id}.
+	sort.SliceStable(spec.ops, func(i, j int) bool {
+		a, b := spec.ops[i], spec.ops[j]
+		for k := 0; k < len(a.segments) && k < len(b.segments); k++ {
+			if pa, pb := isParam(a.segments[k]), isParam(b.segments[k]); pa != pb {
+				return pb
+			}
+		}
+		return a.path < b.path
+	})
+	return spec, nil
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// find returns the operation for a request path. When the path exists but
+// not for this method, it returns the methods that are defined. HEAD is
+// checked as GET unless the document describes it.
+func (s *apiSpec) find(method, path string) (*apiOperation, map[string]string, []string) {
+	op, params, allowed := s.findExact(method, path)
+	if op == nil && method == http.MethodHead && contains(allowed, http.MethodGet) {
+		return s.findExact(http.MethodGet, path)
+	}
+	return op, params, allowed
+}
+
+func (s *apiSpec) findExact(method, path string) (*apiOperation, map[string]string, []string) {
+	segs := splitPath(path)
+	var allowed []string
+	for _, op := range s.ops {
+		params, ok := op.matchPath(segs)
+		if !ok {
+			continue
+		}
+		if op.method == method {
+			return op, params, nil
+		}
+		if !contains(allowed, op.method) {
+			allowed = append(allowed, op.method)
+		}
+	}
+	sort.Strings(allowed)
+	return nil, nil, allowed
+}
+
+func (op *apiOperation) matchPath(segs []string) (map[string]string, bool) {
+	if len(segs) != len(op.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, seg := range op.segments {
+		if isParam(seg) {
+			params[seg[1:len(seg)-1]] = segs[i]
+		} else if seg != segs[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// --- $ref resolution ---
+
+type resolver struct {
+	doc  *openAPIDoc
+	seen map[*schema]bool
+}
+
+func (r *resolver) parameter(p *parameter) (*parameter, error) {
+	if p.Ref != "" {
+		name, ok := strings.CutPrefix(p.Ref, "#/components/parameters/")
+		target := r.doc.Components.Parameters[name]
+		if !ok || target == nil {
+			return nil, fmt.Errorf("unresolved $ref %q", p.Ref)
+		}
+		p = target
+	}
+	switch p.In {
+	case "path", "query", "header":
+	case "cookie":
+		return nil, fmt.Errorf("parameter %q: cookie parameters are not supported", p.Name)
+	default:
+		return nil, fmt.Errorf("parameter %q: unknown location %q", p.Name, p.In)
+	}
+	if p.Schema == nil {
+		p.Schema = &schema{}
+	}
+	return p, r.schema(p.Schema)
+}
+
+// schema resolves $refs and compiles patterns, once per schema object.
+func (r *resolver) schema(s *schema) error {
+	if s == nil || r.seen[s] {
+		return nil
+	}
+	r.seen[s] = true
+
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/")
+		target := r.doc.Components.Schemas[name]
+		if !ok || target == nil {
+			return fmt.Errorf("unresolved $ref %q", s.Ref)
+		}
+		s.target = target
+		return r.schema(target)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", s.Pattern, err)
+		}
+		s.re = re
+	}
+	if len(s.AdditionalProps) > 0 {
+		var b bool
+		if err := json.Unmarshal(s.AdditionalProps, &b); err == nil {
+			s.noAdditional = !b
+		} else {
+			s.additional = &schema{}
+			if err := json.Unmarshal(s.AdditionalProps, s.additional); err != nil {
+				return fmt.Errorf("additionalProperties: %w", err)
+			}
+		}
+	}
+
+	children := append(append(append([]*schema{s.Items, s.additional}, s.AllOf...), s.AnyOf...), s.OneOf...)
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	for _, c := range children {
+		if err := r.schema(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolved follows $ref.
+func (s *schema) resolved() *schema {
+	for s.target != nil {
+		s = s.target
+	}
+	return s
+}
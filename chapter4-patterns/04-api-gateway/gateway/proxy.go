@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Reverse proxies ---
+//
+// Each route gets one httputil.ReverseProxy, built when the route table is
+// loaded, and every proxy shares one tuned http.Transport. Building a proxy
+// per request (as the first version of this gateway did) allocates a new
+// proxy, a new Director closure and new 32KB copy buffers every time, and
+// the default transport keeps only 2 idle connections per backend, so busy
+// routes keep opening fresh TCP connections.
+//
+// Everything that differs per request (chosen instance, identity, request ID)
+// travels in the request context as a *proxyState.
+
+// upstreamTransport is shared by all routes so idle connections are reused
+// across requests and across reloads of the route table.
+var upstreamTransport = &http.Transport{
+	Proxy: nil, // the gateway talks to backends directly
+	DialContext: (&net.Dialer{
+		Timeout:   2 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          1024,
+	MaxIdleConnsPerHost:   128,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   3 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// proxyBuffers recycles the buffers ReverseProxy copies bodies through.
+type proxyBuffers struct{ pool sync.Pool }
+
+func (b *proxyBuffers) Get() []byte {
+	if buf, ok := b.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, 32*1024)
+}
+
+func (b *proxyBuffers) Put(buf []byte) { b.pool.Put(&buf) }
+
+var sharedBuffers = &proxyBuffers{}
+
+// proxyState is the per-request input to a route's proxy.
+type proxyState struct {
+	match   *routeMatch
+	variant string // "" unless the route splits traffic
+	up      *upstream
+	id      *identity
+	reqID   string
+	start   time.Time // when the upstream request was sent
+	failed  bool      // set by ModifyResponse / ErrorHandler for the passive check
+}
+
+// statusClientClosedRequest is logged when the client hangs up before the
+// upstream answers (nginx's 499). Nobody is left to read it.
+const statusClientClosedRequest = 499
+
+type proxyStateKey struct{}
+
+func stateFrom(ctx context.Context) *proxyState {
+	return ctx.Value(proxyStateKey{}).(*proxyState)
+}
+
+// newRouteProxy builds the proxy for one route.
+func newRouteProxy(rt *route) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport:  upstreamTransport,
+		BufferPool: sharedBuffers,
+		Director: func(req *http.Request) {
+			st := stateFrom(req.Context())
+
+			// Rewrite path: remove the route prefix (if configured) before forwarding
+			if rt.stripPrefix {
+				req.URL.Path = st.match.upstreamPath(req.URL.Path)
+				req.URL.RawPath = ""
+			}
+			target := st.up.url
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			if target.Path != "" && target.Path != "/" {
+				req.URL.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+			}
+			if target.RawQuery != "" {
+				if req.URL.RawQuery == "" {
+					req.URL.RawQuery = target.RawQuery
+				} else {
+					req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+				}
+			}
+			if _, ok := req.Header["User-Agent"]; !ok {
+				req.Header.Set("User-Agent", "") // don't let Go add its own
+			}
+			req.Header.Set("X-Request-ID", st.reqID)
+
+			// Backends learn who is calling; they never see the credentials.
+			req.Header.Del("X-API-Key")
+			req.Header.Del("Authorization")
+			setIdentityHeaders(req.Header, st.id)
+		},
+		// Passive health check: 5xx answers and transport errors count as failures
+		ModifyResponse: func(resp *http.Response) error {
+			st := stateFrom(resp.Request.Context())
+			observeUpstream(rt, st, resp.StatusCode)
+			st.failed = resp.StatusCode >= 500
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			st := stateFrom(r.Context())
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				// max_body_bytes cut the client off; not the upstream's fault
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(r.Context().Err(), context.Canceled) {
+				// the client hung up; not the upstream's fault either
+				markUnsettled(r.Context())
+				w.WriteHeader(statusClientClosedRequest)
+				return
+			}
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || opErr.Op != "dial" {
+				// the request may have reached the upstream (see idempotency.go)
+				markUnsettled(r.Context())
+			}
+			observeUpstream(rt, st, http.StatusBadGateway)
+			st.failed = true
+			log.Printf("[gateway] proxy error (%s): %v", st.up.url, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// serveProxy sends r to the instance in st through the route's proxy,
+// within the route timeout.
+func serveProxy(w http.ResponseWriter, r *http.Request, st *proxyState) {
+	rt := st.match.route
+
+	ctx, cancel := context.WithTimeout(r.Context(), rt.timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, proxyStateKey{}, st)
+
+	st.start = time.Now()
+	p := st.up.pool
+	p.acquire(st.up)
+	defer func() { p.release(st.up, st.failed) }()
+
+	rt.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
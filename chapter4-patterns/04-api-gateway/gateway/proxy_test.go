@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+)
+
+func TestRouteProxyRewritesRequest(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer upstream.Close()
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "` + upstream.URL + `/api?v=2"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/users/42?x=1", nil)
+	r.Header.Set("X-API-Key", "secret")
+	r.Header.Set("Authorization", "Bearer secret")
+	m, _ := table.match(r)
+	id := &identity{method: authAPIKey, clientID: "c1"}
+
+	w := httptest.NewRecorder()
+	serveProxy(w, r, &proxyState{match: m, up: m.route.pool.upstreams[0], id: id, reqID: "req-1"})
+
+	if w.Code != http.StatusOK || got == nil {
+		t.Fatalf("status %d, upstream called: %v", w.Code, got != nil)
+	}
+	if got.URL.Path != "/api/42" || got.URL.RawQuery != "v=2&x=1" {
+		t.Errorf("upstream saw %s?%s, want /api/42?v=2&x=1", got.URL.Path, got.URL.RawQuery)
+	}
+	if got.Header.Get("X-Request-ID") != "req-1" || got.Header.Get("X-Client-ID") != "c1" {
+		t.Errorf("headers = %v", got.Header)
+	}
+	if got.Header.Get("X-API-Key") != "" || got.Header.Get("Authorization") != "" {
+		t.Errorf("credentials leaked upstream: %v", got.Header)
+	}
+}
+
+func TestRouteProxyMarksFailures(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "` + upstream.URL + `"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/users/1", nil)
+	m, _ := table.match(r)
+	st := &proxyState{match: m, up: m.route.pool.upstreams[0], id: &identity{}, reqID: "x"}
+	serveProxy(httptest.NewRecorder(), r, st)
+	if !st.failed {
+		t.Fatal("a 500 from the upstream should count as a failure")
+	}
+
+	// Nothing listening: transport error -> 502
+	upstream.Close()
+	st = &proxyState{match: m, up: m.route.pool.upstreams[0], id: &identity{}, reqID: "x"}
+	w := httptest.NewRecorder()
+	serveProxy(w, r, st)
+	if w.Code != http.StatusBadGateway || !st.failed {
+		t.Fatalf("status %d failed=%v, want 502 and failed", w.Code, st.failed)
+	}
+}
+
+func TestRouteProxyIgnoresClientDisconnects(t *testing.T) {
+	arrived := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "` + upstream.URL + `"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/users/1", nil).WithContext(ctx)
+	m, _ := table.match(r)
+	go func() {
+		<-arrived
+		cancel()
+	}()
+
+	st := &proxyState{match: m, up: m.route.pool.upstreams[0], id: &identity{}, reqID: "x"}
+	w := httptest.NewRecorder()
+	serveProxy(w, r, st)
+	if st.failed || w.Code == http.StatusBadGateway {
+		t.Fatalf("client hung up: status %d failed=%v, want no upstream failure", w.Code, st.failed)
+	}
+}
+
+// --- Benchmarks ---
+//
+//	go test -run '^$' -bench Proxy -benchmem
+//
+// BenchmarkProxyPerRequest is what handleGateway used to do: a new
+// ReverseProxy on the default transport for every request.
+
+func benchUpstream(b *testing.B) (*httptest.Server, *routeMatch) {
+	b.Helper()
+	body, _ := json.Marshal(map[string]string{"service": "users", "id": "42"})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	b.Cleanup(upstream.Close)
+
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "` + upstream.URL + `"}]}`))
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, _ := table.match(httptest.NewRequest("GET", "/users/42", nil))
+	return upstream, m
+}
+
+// discard is a minimal ResponseWriter so the recorder's allocations don't
+// drown out the proxy's.
+type discard struct{ h http.Header }
+
+func (d *discard) Header() http.Header         { return d.h }
+func (d *discard) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discard) WriteHeader(int)             {}
+
+func BenchmarkProxyPerRequest(b *testing.B) {
+	_, m := benchUpstream(b)
+	up := m.route.pool.upstreams[0]
+	id := &identity{method: authAPIKey, clientID: "bench"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := httptest.NewRequest("GET", "/users/42", nil)
+			proxy := httputil.NewSingleHostReverseProxy(up.url)
+			orig := proxy.Director
+			proxy.Director = func(req *http.Request) {
+				orig(req)
+				req.URL.Path = m.upstreamPath(req.URL.Path)
+				req.Header.Set("X-Request-ID", "bench")
+				setIdentityHeaders(req.Header, id)
+			}
+			proxy.ServeHTTP(&discard{h: http.Header{}}, r)
+		}
+	})
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+}
+
+func BenchmarkProxyShared(b *testing.B) {
+	_, m := benchUpstream(b)
+	up := m.route.pool.upstreams[0]
+	id := &identity{method: authAPIKey, clientID: "bench"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := httptest.NewRequest("GET", "/users/42", nil)
+			serveProxy(&discard{h: http.Header{}}, r, &proxyState{match: m, up: up, id: id, reqID: "bench"})
+		}
+	})
+	upstreamTransport.CloseIdleConnections()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Rate limiting (token bucket) ---
+//
+// Each bucket holds up to Limit tokens and refills continuously at
+// Limit/Per tokens per second. A request takes one token. Unlike a fixed
+// window, there is no moment where the whole allowance comes back at once,
+// so a client can never get 2x the limit by straddling a window edge.
+//
+// Buckets are keyed by client (API key client ID or JWT subject), by IP or
+// by route, chosen per route. A bucket that has been idle long enough to
+// refill completely is the same as a brand-new one, so the sweeper simply
+// deletes it; the map no longer grows forever.
+//
+// Where the buckets live is pluggable (rateStore): in this process
+// (memoryRateStore) or in Redis (redisRateStore, see ratelimit_redis.go) so
+// that every gateway replica draws from the same buckets.
+
+const (
+	rateKeyClient = "client"
+	rateKeyIP     = "ip"
+	rateKeyRoute  = "route"
+)
+
+type rateLimit struct {
+	Limit int      `json:"limit"` // bucket size (burst)
+	Per   duration `json:"per"`   // time to refill a whole bucket
+}
+
+func (l rateLimit) perSecond() float64 {
+	return float64(l.Limit) / time.Duration(l.Per).Seconds()
+}
+
+// Default limits by API key / JWT tier
+var tierLimits = map[string]rateLimit{
+	"free":     {Limit: 5, Per: duration(10 * time.Second)},
+	"standard": {Limit: 20, Per: duration(10 * time.Second)},
+	"premium":  {Limit: 100, Per: duration(10 * time.Second)},
+}
+
+const defaultTier = "free"
+
+// rateLimitConfig is the optional "rate_limit" block of a route.
+type rateLimitConfig struct {
+	Key   string   `json:"key,omitempty"`   // client (default), ip or route
+	Limit int      `json:"limit,omitempty"` // 0 = use the caller's tier
+	Per   duration `json:"per,omitempty"`
+}
+
+func (c *rateLimitConfig) validate() error {
+	switch c.Key {
+	case "", rateKeyClient, rateKeyIP, rateKeyRoute:
+	default:
+		return fmt.Errorf("rate_limit.key: unknown key %q", c.Key)
+	}
+	if c.Limit < 0 || (c.Limit > 0 && c.Per <= 0) {
+		return fmt.Errorf("rate_limit: need a positive limit and per")
+	}
+	if c.Key == rateKeyRoute && c.Limit == 0 {
+		return fmt.Errorf("rate_limit: key \"route\" needs its own limit")
+	}
+	return nil
+}
+
+// rateDecision is the outcome of taking a token.
+type rateDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	retryAfter time.Duration // only set when not allowed
+}
+
+// rateStore takes one token from a bucket, atomically.
+type rateStore interface {
+	take(ctx context.Context, key string, lim rateLimit, now time.Time) (rateDecision, error)
+}
+
+// retryAfter is how long until a bucket holding tokens (< 1) earns a whole one.
+func (l rateLimit) retryAfter(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / l.perSecond() * float64(time.Second))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	lim    rateLimit
+}
+
+// refill adds the tokens earned since the last visit.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.lim.Limit), b.tokens+elapsed*b.lim.perSecond())
+		b.last = now
+	}
+}
+
+// memoryRateStore keeps buckets in this process. Each replica has its own.
+type memoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (l *memoryRateStore) take(_ context.Context, key string, lim rateLimit, now time.Time) (rateDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok || b.lim != lim {
+		// New bucket, or the limit changed (route reload, key re-tiered).
+		b = &tokenBucket{tokens: float64(lim.Limit), last: now, lim: lim}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+
+	d := rateDecision{limit: lim.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+		d.remaining = int(b.tokens)
+		return d, nil
+	}
+	d.retryAfter = lim.retryAfter(b.tokens)
+	return d, nil
+}
+
+// evictIdle drops buckets that are full again, i.e. indistinguishable from new.
+func (l *memoryRateStore) evictIdle(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= time.Duration(b.lim.Per) {
+			delete(l.buckets, k)
+			n++
+		}
+	}
+	return n
+}
+
+// sweep runs evictIdle forever. Run it in its own goroutine.
+func (l *memoryRateStore) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		l.evictIdle(now)
+	}
+}
+
+// bucketFor picks the bucket key and limit for a request on a route.
+func bucketFor(rt *route, id *identity, ip string) (string, rateLimit) {
+	lim, ok := tierLimits[id.tier]
+	if !ok {
+		lim = tierLimits[defaultTier]
+	}
+	cfg := rt.rateLimit
+	scope := ""
+	if cfg.Limit > 0 {
+		lim = rateLimit{Limit: cfg.Limit, Per: cfg.Per}
+		scope = rt.prefix + "|" // a route with its own limit gets its own buckets
+	}
+
+	switch cfg.Key {
+	case rateKeyIP:
+		return scope + "ip:" + ip, lim
+	case rateKeyRoute:
+		return scope + "route", lim
+	default:
+		return scope + "client:" + id.clientID, lim
+	}
+}
+
+// writeRateHeaders sets RateLimit-Limit / RateLimit-Remaining, plus
+// Retry-After (whole seconds, rounded up) when the request was rejected.
+func writeRateHeaders(h http.Header, d rateDecision) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	if !d.allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.retryAfter.Seconds()))))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// --- Shared rate-limit buckets in Redis ---
+//
+// With several gateway pods, in-memory buckets make the real limit
+// replicas x limit. redisRateStore keeps every bucket in Redis instead and
+// runs the whole refill-and-take step as one Lua script, which Redis executes
+// atomically: two replicas can never both spend the last token.
+//
+// Each bucket is a hash {t: tokens, ts: last refill in ms} with a TTL of one
+// full refill, so Redis evicts idle buckets on its own.
+
+// tokenBucketScript mirrors memoryRateStore.take.
+//
+//	KEYS[1] bucket key
+//	ARGV[1] limit, ARGV[2] refill rate (tokens/ms), ARGV[3] now (ms), ARGV[4] ttl (ms)
+//
+// Returns {allowed (0/1), tokens left (as a string, to keep the fraction)}.
+const tokenBucketScript = `
+local limit = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 't', 'ts')
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+  tokens, ts = limit, now
+end
+if now > ts then
+  tokens = math.min(limit, tokens + (now - ts) * rate)
+  ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 't', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}
+`
+
+const redisKeyPrefix = "gateway:ratelimit:"
+
+type redisRateStore struct {
+	client *respClient
+}
+
+func newRedisRateStore(addr, password string) *redisRateStore {
+	// Rate-limit checks sit on the request path: keep the deadline short so
+	// a sick Redis turns into a fast fail-open / fail-closed decision.
+	return &redisRateStore{client: newRespClient(addr, password, 16, 200*time.Millisecond)}
+}
+
+func (s *redisRateStore) take(ctx context.Context, key string, lim rateLimit, now time.Time) (rateDecision, error) {
+	// The limit is part of the key so a changed limit starts a fresh bucket,
+	// the same way memoryRateStore does.
+	fullKey := fmt.Sprintf("%s%s|%d/%s", redisKeyPrefix, key, lim.Limit, time.Duration(lim.Per))
+	perMs := lim.perSecond() / 1000
+	ttl := time.Duration(lim.Per).Milliseconds()
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	reply, err := s.client.do(ctx, "EVAL", tokenBucketScript, "1", fullKey,
+		strconv.Itoa(lim.Limit),
+		strconv.FormatFloat(perMs, 'g', -1, 64),
+		strconv.FormatInt(now.UnixMilli(), 10),
+		strconv.FormatInt(ttl, 10),
+	)
+	if err != nil {
+		return rateDecision{}, err
+	}
+
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr) != 2 {
+		return rateDecision{}, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+	allowed, ok1 := arr[0].(int64)
+	tokStr, ok2 := arr[1].(string)
+	tokens, err := strconv.ParseFloat(tokStr, 64)
+	if !ok1 || !ok2 || err != nil {
+		return rateDecision{}, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+
+	d := rateDecision{allowed: allowed == 1, limit: lim.Limit, remaining: int(tokens)}
+	if !d.allowed {
+		d.retryAfter = lim.retryAfter(tokens)
+	}
+	return d, nil
+}
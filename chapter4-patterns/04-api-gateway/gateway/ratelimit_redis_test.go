@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in Redis server that speaks RESP. It understands
+// PING, AUTH and EVAL of tokenBucketScript (executed in Go, one command at a
+// time, which gives the same atomicity Redis gives a Lua script).
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	buckets map[string][2]float64 // key -> {tokens, ts}
+	calls   atomic.Int64
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, buckets: map[string][2]float64{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authed := f.password == ""
+	for {
+		cmd, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, _ := cmd.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		name, _ := args[0].(string)
+		switch {
+		case name == "AUTH" && len(args) == 2 && args[1] == f.password:
+			authed = true
+			w.WriteString("+OK\r\n")
+		case name == "AUTH":
+			w.WriteString("-WRONGPASS invalid password\r\n")
+		case !authed:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case name == "PING":
+			w.WriteString("+PONG\r\n")
+		case name == "EVAL" && len(args) == 8 && args[1] == tokenBucketScript:
+			f.calls.Add(1)
+			allowed, tokens := f.evalTokenBucket(args[3].(string), args[4].(string), args[5].(string), args[6].(string))
+			fmt.Fprintf(w, "*2\r\n:%d\r\n$%d\r\n%s\r\n", allowed, len(tokens), tokens)
+		default:
+			fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", name)
+		}
+		w.Flush()
+	}
+}
+
+func (f *fakeRedis) evalTokenBucket(key, limitS, rateS, nowS string) (int, string) {
+	limit, _ := strconv.ParseFloat(limitS, 64)
+	rate, _ := strconv.ParseFloat(rateS, 64)
+	now, _ := strconv.ParseFloat(nowS, 64)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.buckets[key]
+	if !ok {
+		b = [2]float64{limit, now}
+	}
+	if now > b[1] {
+		b[0] = math.Min(limit, b[0]+(now-b[1])*rate)
+		b[1] = now
+	}
+	allowed := 0
+	if b[0] >= 1 {
+		b[0]--
+		allowed = 1
+	}
+	f.buckets[key] = b
+	return allowed, strconv.FormatFloat(b[0], 'g', -1, 64)
+}
+
+func TestRedisRateStoreIsSharedAcrossReplicas(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	replicas := []*redisRateStore{
+		newRedisRateStore(srv.addr(), "s3cret"),
+		newRedisRateStore(srv.addr(), "s3cret"),
+		newRedisRateStore(srv.addr(), "s3cret"),
+	}
+	lim := rateLimit{Limit: 5, Per: duration(10 * time.Second)}
+	now := time.Now()
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(store *redisRateStore) {
+			defer wg.Done()
+			d, err := store.take(context.Background(), "client:mobile", lim, now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if d.allowed {
+				allowed.Add(1)
+			}
+		}(replicas[i%len(replicas)])
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != 5 {
+		t.Fatalf("%d requests allowed across 3 replicas, want exactly 5", got)
+	}
+
+	d, err := replicas[0].take(context.Background(), "client:mobile", lim, now)
+	if err != nil || d.allowed || d.retryAfter != 2*time.Second {
+		t.Fatalf("drained bucket: %+v, %v (want retryAfter 2s)", d, err)
+	}
+}
+
+func TestRedisRateStoreErrors(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	lim := rateLimit{Limit: 5, Per: duration(10 * time.Second)}
+
+	if _, err := newRedisRateStore(srv.addr(), "wrong").take(context.Background(), "k", lim, time.Now()); err == nil {
+		t.Fatal("expected an auth error")
+	}
+
+	srv.ln.Close()
+	if _, err := newRedisRateStore(srv.addr(), "s3cret").take(context.Background(), "k", lim, time.Now()); err == nil {
+		t.Fatal("expected a connection error once the server is gone")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketHasNoWindowEdgeBurst(t *testing.T) {
+	l := newMemoryRateStore()
+	lim := rateLimit{Limit: 5, Per: duration(10 * time.Second)}
+	start := time.Unix(1000, 0)
+	ctx := context.Background()
+
+	// Drain the bucket just before a fixed-window edge would have been...
+	for i := 0; i < 5; i++ {
+		if d, _ := l.take(ctx, "c", lim, start.Add(9900*time.Millisecond)); !d.allowed {
+			t.Fatalf("request %d rejected", i)
+		}
+	}
+	// ...and right after it: a fixed window would hand out 5 more here.
+	d, _ := l.take(ctx, "c", lim, start.Add(10100*time.Millisecond))
+	if d.allowed {
+		t.Fatal("bucket refilled in one step at the window edge")
+	}
+	if d.retryAfter <= 0 || d.retryAfter > 2*time.Second {
+		t.Fatalf("retryAfter = %v, want about 1.8s", d.retryAfter)
+	}
+
+	// One token every 2s comes back continuously.
+	if d, _ := l.take(ctx, "c", lim, start.Add(12*time.Second)); !d.allowed || d.remaining != 0 {
+		t.Fatalf("after 2s: %+v", d)
+	}
+}
+
+func TestLimiterEvictsIdleBuckets(t *testing.T) {
+	l := newMemoryRateStore()
+	lim := rateLimit{Limit: 5, Per: duration(10 * time.Second)}
+	now := time.Unix(1000, 0)
+	l.take(context.Background(), "busy", lim, now)
+	l.take(context.Background(), "idle", lim, now.Add(-time.Minute))
+
+	if n := l.evictIdle(now); n != 1 {
+		t.Fatalf("evicted %d buckets, want 1", n)
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Fatal("evicted a bucket that is still refilling")
+	}
+}
+
+func TestRateHeaders(t *testing.T) {
+	h := http.Header{}
+	writeRateHeaders(h, rateDecision{limit: 5, remaining: 0, retryAfter: 1200 * time.Millisecond})
+	if h.Get("RateLimit-Limit") != "5" || h.Get("RateLimit-Remaining") != "0" || h.Get("Retry-After") != "2" {
+		t.Fatalf("headers = %v", h)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// --- Minimal RESP (Redis protocol) client ---
+//
+// Just enough of the Redis wire protocol to send commands and read replies,
+// so the gateway needs no third-party driver. Replies come back as:
+//
+//	simple string / bulk string -> string
+//	integer                     -> int64
+//	array                       -> []interface{}
+//	nil bulk / nil array        -> nil
+//	error                       -> respError
+
+type respError string
+
+func (e respError) Error() string { return "redis: " + string(e) }
+
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+type respClient struct {
+	addr     string
+	password string
+	timeout  time.Duration // dial + per-command deadline when ctx has none
+	pool     chan *respConn
+}
+
+func newRespClient(addr, password string, poolSize int, timeout time.Duration) *respClient {
+	return &respClient{
+		addr:     addr,
+		password: password,
+		timeout:  timeout,
+		pool:     make(chan *respConn, poolSize),
+	}
+}
+
+// do sends one command and returns its reply. A connection that saw a
+// network or protocol error is closed rather than returned to the pool.
+func (c *respClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	rc, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	_ = rc.conn.SetDeadline(deadline)
+
+	reply, err := rc.roundTrip(args)
+	var redisErr respError
+	if err != nil && !errors.As(err, &redisErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return reply, err
+}
+
+func (c *respClient) get(ctx context.Context) (*respConn, error) {
+	select {
+	case rc := <-c.pool:
+		return rc, nil
+	default:
+	}
+
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if c.password != "" {
+		_ = conn.SetDeadline(time.Now().Add(c.timeout))
+		if _, err := rc.roundTrip([]string{"AUTH", c.password}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *respClient) put(rc *respConn) {
+	select {
+	case c.pool <- rc:
+	default:
+		rc.conn.Close() // pool is full
+	}
+}
+
+func (rc *respConn) roundTrip(args []string) (interface{}, error) {
+	writeCommand(rc.w, args)
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(rc.r)
+}
+
+// writeCommand encodes a command as an array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2) // payload + \r\n
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			v, err := readReply(r)
+			var redisErr respError
+			if errors.As(err, &redisErr) {
+				// keep reading: the rest of the array is still on the wire
+				v, err = redisErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// --- Router ---
+//
+// Routes are matched in a fixed precedence order that is computed once when
+// the table is built, so overlapping prefixes always resolve the same way:
+//
+//  1. Routes with a Host beat routes without one (exact host beats "*.example.com").
+//  2. Longer prefixes (more path segments) beat shorter ones.
+//  3. A literal segment beats a {param} segment at the same position.
+//  4. "/payments/" (must have something after) beats "/payments".
+//  5. Routes that list methods beat routes that accept any method.
+//
+// Prefixes match on whole path segments: "/pay" does not match "/payments".
+// A segment written as {name} matches any single non-empty segment and is
+// captured as a path parameter.
+
+// pattern is a parsed route prefix such as "/users/{id}/".
+type pattern struct {
+	segments []string // "users", "{id}"
+	trailing bool     // prefix ends with "/"
+}
+
+func parsePattern(prefix string) (pattern, error) {
+	p := pattern{trailing: strings.HasSuffix(prefix, "/") && prefix != "/"}
+	trimmed := strings.Trim(prefix, "/")
+	if trimmed == "" {
+		return p, nil
+	}
+	for _, seg := range strings.Split(trimmed, "/") {
+		if seg == "" {
+			return p, fmt.Errorf("empty segment in prefix %q", prefix)
+		}
+		if strings.ContainsAny(seg, "{}") && !isParam(seg) {
+			return p, fmt.Errorf("bad parameter segment %q in prefix %q", seg, prefix)
+		}
+		p.segments = append(p.segments, seg)
+	}
+	return p, nil
+}
+
+func isParam(seg string) bool {
+	return len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}' && !strings.ContainsAny(seg[1:len(seg)-1], "{}")
+}
+
+// matchPath reports whether path matches the pattern. It returns the part of
+// the path the pattern consumed (what strip_prefix removes) and any captured
+// path parameters.
+func (p pattern) matchPath(path string) (string, map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", nil, false
+	}
+	rest := path[1:]
+	parts := make([]string, 0, len(p.segments))
+	var params map[string]string
+
+	for i, seg := range p.segments {
+		part, more := rest, false
+		if j := strings.IndexByte(rest, '/'); j >= 0 {
+			part, rest, more = rest[:j], rest[j+1:], true
+		}
+		// The path ended before the pattern did ("/payments" vs "/payments/").
+		if !more && (i < len(p.segments)-1 || p.trailing) {
+			return "", nil, false
+		}
+		if isParam(seg) {
+			if part == "" {
+				return "", nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:len(seg)-1]] = part
+		} else if part != seg {
+			return "", nil, false
+		}
+		parts = append(parts, part)
+	}
+
+	consumed := "/" + strings.Join(parts, "/")
+	if p.trailing {
+		consumed += "/"
+	}
+	return consumed, params, true
+}
+
+// hostMatches compares the request host (port ignored) to a route host.
+// An empty route host matches everything; "*.example.com" matches any subdomain.
+func hostMatches(want, host string) bool {
+	if want == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(want, "*.") {
+		return strings.HasSuffix(host, want[1:])
+	}
+	return host == want
+}
+
+func (rt *route) allowsMethod(method string) bool {
+	return len(rt.methods) == 0 || contains(rt.methods, method)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortRoutes puts routes into precedence order (see the top of this file).
+// The original file position is the final tie-breaker, so the order is total.
+func sortRoutes(routes []*route) {
+	hostRank := func(rt *route) int {
+		switch {
+		case rt.host == "":
+			return 0
+		case strings.HasPrefix(rt.host, "*."):
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if ha, hb := hostRank(a), hostRank(b); ha != hb {
+			return ha > hb
+		}
+		if la, lb := len(a.pattern.segments), len(b.pattern.segments); la != lb {
+			return la > lb
+		}
+		for k := range a.pattern.segments {
+			pa, pb := isParam(a.pattern.segments[k]), isParam(b.pattern.segments[k])
+			if pa != pb {
+				return !pa
+			}
+		}
+		if a.pattern.trailing != b.pattern.trailing {
+			return a.pattern.trailing
+		}
+		if ma, mb := len(a.methods) > 0, len(b.methods) > 0; ma != mb {
+			return ma
+		}
+		return a.index < b.index
+	})
+}
+
+// routeMatch is the result of routing one request.
+type routeMatch struct {
+	route    *route
+	consumed string            // matched part of the path, e.g. "/users/42/"
+	params   map[string]string // path parameters, e.g. {"id": "42"}
+}
+
+// upstreamPath is the path to send upstream after optional prefix stripping.
+func (m *routeMatch) upstreamPath(path string) string {
+	if !m.route.stripPrefix {
+		return path
+	}
+	p := strings.TrimPrefix(path, m.consumed)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// match finds the route for r. When the path and host match a route but the
+// method does not, it returns nil plus the methods that would have worked,
+// so the caller can answer 405 instead of 404.
+func (t *routeTable) match(r *http.Request) (*routeMatch, []string) {
+	var allowed []string
+	for _, rt := range t.routes {
+		if !hostMatches(rt.host, r.Host) {
+			continue
+		}
+		consumed, params, ok := rt.pattern.matchPath(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if !rt.allowsMethod(r.Method) {
+			for _, m := range rt.methods {
+				if !contains(allowed, m) {
+					allowed = append(allowed, m)
+				}
+			}
+			continue
+		}
+		return &routeMatch{route: rt, consumed: consumed, params: params}, nil
+	}
+	return nil, allowed
+}
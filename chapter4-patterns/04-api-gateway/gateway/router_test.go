@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// overlapping is a route file where several prefixes compete for the same paths.
+var overlapping = []string{
+	`{"prefix": "/payments/", "upstream": "http://payments:7002"}`,
+	`{"prefix": "/payments/refunds/", "upstream": "http://refunds:7003"}`,
+	`{"prefix": "/payments/{id}/", "upstream": "http://by-id:7004"}`,
+	`{"prefix": "/payments/refunds/", "methods": ["POST"], "upstream": "http://refunds-write:7005"}`,
+	`{"prefix": "/payments/", "host": "admin.finpay.local", "upstream": "http://admin:7006"}`,
+	`{"prefix": "/", "upstream": "http://fallback:7000"}`,
+}
+
+func buildTable(t *testing.T, entries []string) *routeTable {
+	t.Helper()
+	data := `{"routes": [` + strings.Join(entries, ",") + `]}`
+	table, err := parseRoutes([]byte(data))
+	if err != nil {
+		t.Fatalf("parseRoutes: %v", err)
+	}
+	return table
+}
+
+func TestRouterOverlappingPrefixesAreDeterministic(t *testing.T) {
+	cases := []struct {
+		method, host, path string
+		wantHost, wantPath string
+	}{
+		{"GET", "gw", "/payments/abc", "payments:7002", "/abc"},
+		{"GET", "gw", "/payments/tx/abc", "by-id:7004", "/abc"},
+		{"GET", "gw", "/payments/refunds/r1", "refunds:7003", "/r1"},
+		{"POST", "gw", "/payments/refunds/r1", "refunds-write:7005", "/r1"},
+		{"GET", "gw", "/payments/42/status", "by-id:7004", "/status"},
+		{"GET", "admin.finpay.local:8000", "/payments/refunds/r1", "admin:7006", "/refunds/r1"},
+		{"GET", "gw", "/paymentsX", "fallback:7000", "/paymentsX"},
+		{"GET", "gw", "/payments", "fallback:7000", "/payments"},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		// Same routes, different file order: the result must not change.
+		entries := append([]string(nil), overlapping...)
+		rng.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+		table := buildTable(t, entries)
+
+		for _, c := range cases {
+			r := httptest.NewRequest(c.method, c.path, nil)
+			r.Host = c.host
+			m, _ := table.match(r)
+			if m == nil {
+				t.Fatalf("round %d: %s %s%s: no match", round, c.method, c.host, c.path)
+			}
+			if got := m.route.pool.upstreams[0].url.Host; got != c.wantHost {
+				t.Fatalf("round %d: %s %s%s: routed to %s, want %s", round, c.method, c.host, c.path, got, c.wantHost)
+			}
+			if got := m.upstreamPath(c.path); got != c.wantPath {
+				t.Fatalf("round %d: %s %s%s: upstream path %s, want %s", round, c.method, c.host, c.path, got, c.wantPath)
+			}
+		}
+	}
+}
+
+func TestRouterPathParams(t *testing.T) {
+	table := buildTable(t, []string{
+		`{"prefix": "/users/{id}/payments/{tx}", "upstream": "http://users:7001", "strip_prefix": false}`,
+	})
+
+	r := httptest.NewRequest("GET", "/users/U1/payments/T9", nil)
+	m, _ := table.match(r)
+	if m == nil {
+		t.Fatal("no match")
+	}
+	if m.params["id"] != "U1" || m.params["tx"] != "T9" {
+		t.Fatalf("params = %v", m.params)
+	}
+	if got := m.upstreamPath(r.URL.Path); got != "/users/U1/payments/T9" {
+		t.Fatalf("strip_prefix=false rewrote path to %s", got)
+	}
+
+	for _, path := range []string{"/users//payments/T9", "/users/U1/payments"} {
+		if m, _ := table.match(httptest.NewRequest("GET", path, nil)); m != nil {
+			t.Errorf("%s: unexpected match %s", path, m.route.prefix)
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	table := buildTable(t, []string{
+		`{"prefix": "/payments/", "methods": ["GET", "HEAD"], "upstream": "http://payments:7002"}`,
+		`{"prefix": "/payments/", "methods": ["POST"], "upstream": "http://payments-write:7002"}`,
+	})
+
+	m, allowed := table.match(httptest.NewRequest("DELETE", "/payments/tx/1", nil))
+	if m != nil {
+		t.Fatalf("DELETE matched %s", m.route.pool.upstreams[0].url)
+	}
+	if got := fmt.Sprint(allowed); got != "[GET HEAD POST]" {
+		t.Fatalf("allowed = %s", got)
+	}
+}
+
+func TestParseRoutesRejectsConflicts(t *testing.T) {
+	data := `{"routes": [
+		{"prefix": "/payments/", "methods": ["GET", "POST"], "upstream": "http://a:1"},
+		{"prefix": "/payments/", "methods": ["POST"], "upstream": "http://b:2"}
+	]}`
+	if _, err := parseRoutes([]byte(data)); err == nil {
+		t.Fatal("expected an error for two routes that both serve POST /payments/")
+	}
+}
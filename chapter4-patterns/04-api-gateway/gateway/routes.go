@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"patterns/internal/watch"
+)
+
+// --- Route table (loaded from a JSON file) ---
+//
+// The gateway no longer hard-codes its backends. Routes live in a file such as:
+//
+//	{
+//	  "routes": [
+//	    {"prefix": "/users/{id}/", "upstream": "http://localhost:7001", "methods": ["GET"]},
+//	    {"prefix": "/payments/",   "upstream": "http://localhost:7002", "timeout": "5s"}
+//	  ]
+//	}
+//
+// The file is re-read when it changes on disk or when the process gets SIGHUP.
+// Each reload builds a brand-new table and swaps it in atomically, so requests
+// that are already in flight finish with the table they started with.
+
+const defaultRouteTimeout = 10 * time.Second
+
+// routeConfig is one entry of the routes file.
+type routeConfig struct {
+	Prefix       string              `json:"prefix"`
+	Methods      []string            `json:"methods,omitempty"`   // empty: any method
+	Host         string              `json:"host,omitempty"`      // empty: any host
+	Upstream     string              `json:"upstream,omitempty"`  // a single instance, or
+	Upstreams    []string            `json:"upstreams,omitempty"` // several instances (see upstream.go)
+	Balancer     *balancerConfig     `json:"balancer,omitempty"`
+	HealthCheck  *healthCheckConfig  `json:"health_check,omitempty"`
+	PassiveCheck *passiveCheckConfig `json:"passive_check,omitempty"`
+	StripPrefix  *bool               `json:"strip_prefix,omitempty"`   // default: true
+	Timeout      duration            `json:"timeout,omitempty"`        // default: 10s
+	Auth         *authConfig         `json:"auth,omitempty"`           // default: API key or JWT
+	RateLimit    *rateLimitConfig    `json:"rate_limit,omitempty"`     // default: per client, by tier
+	Cache        *cacheConfig        `json:"cache,omitempty"`          // default: no caching
+	Compose      *composeConfig      `json:"compose,omitempty"`        // instead of an upstream, see compose.go
+	Variants     []variantConfig     `json:"variants,omitempty"`       // canary groups, see variants.go
+	Sticky       *bool               `json:"sticky,omitempty"`         // default: true
+	OpenAPI      string              `json:"openapi,omitempty"`        // document to validate requests against, see openapi.go
+	MaxBodyBytes int64               `json:"max_body_bytes,omitempty"` // default: no limit (1MB with openapi or idempotency)
+	Idempotency  *idempotencyConfig  `json:"idempotency,omitempty"`    // replay POSTs by Idempotency-Key, see idempotency.go
+}
+
+type routesFile struct {
+	Routes []routeConfig `json:"routes"`
+}
+
+// route is a validated routeConfig, ready to serve traffic.
+type route struct {
+	index       int // position in the file (final tie-breaker, see router.go)
+	prefix      string
+	pattern     pattern
+	methods     []string
+	host        string
+	pool        *pool      // the stable instances; nil for composite routes
+	variants    []*variant // stable first; just stable when no variants are configured
+	sticky      bool
+	proxy       *httputil.ReverseProxy // built once, see proxy.go
+	stripPrefix bool
+	timeout     time.Duration
+	auth        authConfig
+	rateLimit   rateLimitConfig
+	cache       *cacheConfig   // nil: responses are not cached
+	compose     *composeConfig // set for composite routes
+	api         *apiSpec       // nil: requests are not validated
+	maxBody     int64          // 0: no limit
+	idempotency *idempotencyConfig
+}
+
+// routeTable is an immutable snapshot of all routes, in match order.
+type routeTable struct {
+	routes []*route
+}
+
+// start begins health checking every pool in the table.
+func (t *routeTable) start() {
+	for _, rt := range t.routes {
+		for _, v := range rt.variants {
+			v.pool.start()
+		}
+	}
+}
+
+// close stops the table's health checkers once it has been replaced.
+func (t *routeTable) close() {
+	for _, rt := range t.routes {
+		for _, v := range rt.variants {
+			v.pool.close()
+		}
+	}
+}
+
+// duration lets the routes file say "5s" or "250ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func parseRoutes(data []byte) (*routeTable, error) {
+	var f routesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Routes) == 0 {
+		return nil, errors.New("no routes defined")
+	}
+
+	t := &routeTable{}
+	specs := map[string]*apiSpec{} // routes can share a document
+	for i, rc := range f.Routes {
+		if !strings.HasPrefix(rc.Prefix, "/") {
+			return nil, fmt.Errorf("route %d: prefix %q must start with /", i, rc.Prefix)
+		}
+		pat, err := parsePattern(rc.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+
+		urls := rc.Upstreams
+		if rc.Upstream != "" {
+			urls = append([]string{rc.Upstream}, urls...)
+		}
+		var p *pool
+		if rc.Compose != nil {
+			if len(urls) > 0 || len(rc.Variants) > 0 {
+				return nil, fmt.Errorf("route %d: a composite route has no upstream", i)
+			}
+			if err := rc.Compose.validate(pat); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			if len(rc.Methods) == 0 {
+				rc.Methods = []string{"GET"}
+			}
+			for _, m := range rc.Methods {
+				if m = strings.ToUpper(m); m != "GET" && m != "HEAD" {
+					return nil, fmt.Errorf("route %d: a composite route only serves GET and HEAD", i)
+				}
+			}
+		} else {
+			var bc balancerConfig
+			if rc.Balancer != nil {
+				bc = *rc.Balancer
+			}
+			var pc passiveCheckConfig
+			if rc.PassiveCheck != nil {
+				pc = *rc.PassiveCheck
+			}
+			if p, err = newPool(urls, bc, rc.HealthCheck, pc); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+
+		rt := &route{
+			index:       i,
+			prefix:      rc.Prefix,
+			pattern:     pat,
+			host:        strings.ToLower(rc.Host),
+			pool:        p,
+			stripPrefix: true,
+			timeout:     defaultRouteTimeout,
+		}
+		for _, m := range rc.Methods {
+			rt.methods = append(rt.methods, strings.ToUpper(m))
+		}
+		if rc.StripPrefix != nil {
+			rt.stripPrefix = *rc.StripPrefix
+		}
+		if rc.Timeout < 0 {
+			return nil, fmt.Errorf("route %d: negative timeout", i)
+		}
+		if rc.Timeout > 0 {
+			rt.timeout = time.Duration(rc.Timeout)
+		}
+		if rc.Auth != nil {
+			if err := rc.Auth.validate(); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			rt.auth = *rc.Auth
+		}
+		if rc.RateLimit != nil {
+			if err := rc.RateLimit.validate(); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			rt.rateLimit = *rc.RateLimit
+		}
+		if rc.Cache != nil {
+			if err := rc.Cache.validate(); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			rt.cache = rc.Cache
+		}
+		if rc.MaxBodyBytes < 0 {
+			return nil, fmt.Errorf("route %d: negative max_body_bytes", i)
+		}
+		rt.maxBody = rc.MaxBodyBytes
+		if rc.OpenAPI != "" {
+			if specs[rc.OpenAPI] == nil {
+				if specs[rc.OpenAPI], err = loadOpenAPI(rc.OpenAPI); err != nil {
+					return nil, fmt.Errorf("route %d: %w", i, err)
+				}
+			}
+			rt.api = specs[rc.OpenAPI]
+		}
+		if rc.Idempotency != nil {
+			if rc.Compose != nil {
+				return nil, fmt.Errorf("route %d: a composite route only serves GET and HEAD", i)
+			}
+			if err := rc.Idempotency.validate(); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			rt.idempotency = rc.Idempotency
+		}
+		if (rt.api != nil || rt.idempotency != nil) && rt.maxBody == 0 {
+			rt.maxBody = defaultMaxBufferedBody // these read the whole body into memory
+		}
+		if rc.Compose != nil {
+			rt.compose = rc.Compose
+		} else {
+			if rt.variants, err = buildVariants(p, rc.Variants); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			rt.sticky = rc.Sticky == nil || *rc.Sticky
+			rt.proxy = newRouteProxy(rt)
+		}
+		for _, other := range t.routes {
+			if conflicts(other, rt) {
+				return nil, fmt.Errorf("route %d: %q overlaps route %d with the same host and methods", i, rc.Prefix, other.index)
+			}
+		}
+		t.routes = append(t.routes, rt)
+	}
+	sortRoutes(t.routes)
+	return t, nil
+}
+
+// conflicts reports whether two routes would compete for exactly the same
+// requests, which would make one of them unreachable.
+func conflicts(a, b *route) bool {
+	if a.prefix != b.prefix || a.host != b.host {
+		return false
+	}
+	if len(a.methods) == 0 || len(b.methods) == 0 {
+		return len(a.methods) == len(b.methods)
+	}
+	for _, m := range a.methods {
+		if b.allowsMethod(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeStore owns the current routeTable and knows how to reload it.
+type routeStore struct {
+	file    *watch.File
+	current atomic.Pointer[routeTable]
+}
+
+func newRouteStore(path string) (*routeStore, error) {
+	s := &routeStore{file: watch.NewFile(path)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *routeStore) table() *routeTable {
+	return s.current.Load()
+}
+
+// reload reads the file and swaps in the new table. On error the old table
+// stays active, so a typo in the file never takes the gateway down.
+func (s *routeStore) reload() error {
+	data, err := s.file.Read()
+	if err != nil {
+		return err
+	}
+	t, err := parseRoutes(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.file.Path(), err)
+	}
+	t.start()
+	if old := s.current.Swap(t); old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// watch reloads the table on SIGHUP or when the file changes on disk.
+// It blocks, so run it in its own goroutine.
+func (s *routeStore) watch(interval time.Duration) {
+	s.file.Watch(interval, s.reloadAndLog)
+}
+
+func (s *routeStore) reloadAndLog(why string) {
+	if err := s.reload(); err != nil {
+		log.Printf("[gateway] route reload (%s) failed, keeping previous routes: %v", why, err)
+		return
+	}
+	log.Printf("[gateway] routes reloaded (%s): %d routes", why, len(s.table().routes))
+}
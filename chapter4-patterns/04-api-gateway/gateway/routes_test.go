@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseRoutes(t *testing.T) {
+	table, err := parseRoutes([]byte(`{"routes": [
+		{"prefix": "/users/{id}/", "upstream": "http://users:7001", "methods": ["get"], "strip_prefix": false},
+		{"prefix": "/payments/", "upstream": "http://payments:7002", "timeout": "250ms"}
+	]}`))
+	if err != nil {
+		t.Fatalf("parseRoutes: %v", err)
+	}
+	if len(table.routes) != 2 {
+		t.Fatalf("%d routes, want 2", len(table.routes))
+	}
+	for _, rt := range table.routes {
+		switch rt.prefix {
+		case "/users/{id}/":
+			if rt.stripPrefix || rt.timeout != defaultRouteTimeout || len(rt.methods) != 1 || rt.methods[0] != "GET" {
+				t.Errorf("users route = strip %v, timeout %v, methods %v", rt.stripPrefix, rt.timeout, rt.methods)
+			}
+		case "/payments/":
+			if !rt.stripPrefix || rt.timeout != 250*time.Millisecond || rt.methods != nil {
+				t.Errorf("payments route = strip %v, timeout %v, methods %v", rt.stripPrefix, rt.timeout, rt.methods)
+			}
+		default:
+			t.Errorf("unexpected route %q", rt.prefix)
+		}
+	}
+}
+
+func TestParseRoutesRejectsInvalidFiles(t *testing.T) {
+	cases := map[string]string{
+		"not json":         `{"routes": [`,
+		"no routes":        `{"routes": []}`,
+		"relative prefix":  `{"routes": [{"prefix": "users/", "upstream": "http://users:7001"}]}`,
+		"no upstream":      `{"routes": [{"prefix": "/users/"}]}`,
+		"bad duration":     `{"routes": [{"prefix": "/users/", "upstream": "http://users:7001", "timeout": 5}]}`,
+		"negative timeout": `{"routes": [{"prefix": "/users/", "upstream": "http://users:7001", "timeout": "-1s"}]}`,
+		"duplicate": `{"routes": [
+			{"prefix": "/users/", "upstream": "http://a:7001"},
+			{"prefix": "/users/", "upstream": "http://b:7001"}
+		]}`,
+	}
+	for name, data := range cases {
+		if _, err := parseRoutes([]byte(data)); err == nil {
+			t.Errorf("%s: parseRoutes accepted %s", name, data)
+		}
+	}
+}
+
+// writeRoutes writes a routes file with a single /users/ route to upstream.
+func writeRoutes(t *testing.T, path, upstream string) {
+	t.Helper()
+	data := `{"routes": [{"prefix": "/users/", "upstream": "` + upstream + `"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func upstreamOf(s *routeStore) string {
+	return s.table().routes[0].pool.upstreams[0].url.String()
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRouteStoreReloadsOnFileChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, "http://old:7001")
+	s, err := newRouteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.watch(10 * time.Millisecond)
+
+	writeRoutes(t, path, "http://new-users:7001")
+	waitFor(t, "the new routes", func() bool { return upstreamOf(s) == "http://new-users:7001" })
+
+	// A broken file keeps the previous table.
+	if err := os.WriteFile(path, []byte(`{"routes": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reload(); err == nil {
+		t.Fatal("reload accepted a broken file")
+	}
+	if got := upstreamOf(s); got != "http://new-users:7001" {
+		t.Fatalf("after a failed reload the upstream is %s", got)
+	}
+}
+
+func TestRouteStoreReloadsOnSIGHUP(t *testing.T) {
+	// Keep SIGHUP from terminating the test binary before watch has
+	// registered for it.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, "http://old:7001")
+	s, err := newRouteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.watch(time.Hour) // only a signal can trigger a reload
+
+	writeRoutes(t, path, "http://new-users:7001")
+	waitFor(t, "a SIGHUP reload", func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		return upstreamOf(s) == "http://new-users:7001"
+	})
+}
+
+func TestRouteReloadKeepsInFlightRequests(t *testing.T) {
+	secret := setupGateway(t)
+
+	arrived, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		w.Write([]byte("old"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer fast.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, slow.URL)
+	s, err := newRouteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes = s
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- gatewayGet(secret, "/users/1") }()
+	<-arrived
+
+	writeRoutes(t, path, fast.URL)
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if w := gatewayGet(secret, "/users/1"); w.Code != http.StatusOK || w.Body.String() != "new" {
+		t.Fatalf("after the reload: %d %q, want 200 \"new\"", w.Code, w.Body)
+	}
+
+	close(release)
+	w := <-done
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "old") {
+		t.Fatalf("in-flight request: %d %q, want 200 \"old\"", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Upstream pools and load balancing ---
+//
+// A route can point at several instances of the same service:
+//
+//	"upstreams": ["http://localhost:7001", "http://localhost:7011"],
+//	"balancer": {"strategy": "consistent_hash", "hash_header": "X-Account-ID"},
+//	"health_check": {"path": "/healthz", "interval": "5s"}
+//
+// Strategies:
+//   - round_robin (default): take turns
+//   - least_conn: the instance with the fewest requests in flight
+//   - consistent_hash: same header value -> same instance, and only ~1/N of
+//     keys move when an instance joins or leaves
+//
+// An instance only receives traffic while it is available:
+//   - active checks: a GET to health_check.path every interval; it goes down
+//     after unhealthy_threshold failures in a row and back up after
+//     healthy_threshold successes
+//   - passive checks: after passive_check.max_failures failed requests in a
+//     row (5xx or transport error) it is ejected for passive_check.eject_for
+
+const (
+	strategyRoundRobin     = "round_robin"
+	strategyLeastConn      = "least_conn"
+	strategyConsistentHash = "consistent_hash"
+
+	ringReplicas = 100 // virtual nodes per instance on the hash ring
+)
+
+type balancerConfig struct {
+	Strategy   string `json:"strategy,omitempty"`
+	HashHeader string `json:"hash_header,omitempty"` // consistent_hash only; falls back to client IP
+}
+
+type healthCheckConfig struct {
+	Path               string   `json:"path"`
+	Interval           duration `json:"interval,omitempty"`            // default 5s
+	Timeout            duration `json:"timeout,omitempty"`             // default 1s
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"` // default 2
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`   // default 1
+}
+
+type passiveCheckConfig struct {
+	MaxFailures int      `json:"max_failures,omitempty"` // default 3; -1 disables
+	EjectFor    duration `json:"eject_for,omitempty"`    // default 30s
+}
+
+// upstream is one instance of a backend service.
+type upstream struct {
+	url    *url.URL
+	pool   *pool        // the pool it belongs to
+	active atomic.Int64 // requests in flight
+
+	mu           sync.Mutex
+	healthy      bool // result of active checks
+	checkStreak  int  // consecutive active-check results that disagree with healthy
+	failStreak   int  // consecutive failed requests (passive)
+	ejectedUntil time.Time
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+type ringPoint struct {
+	hash uint32
+	up   *upstream
+}
+
+// pool is the set of instances behind one route.
+type pool struct {
+	upstreams  []*upstream
+	strategy   string
+	hashHeader string
+	ring       []ringPoint
+	next       atomic.Uint64 // round-robin cursor
+
+	health  *healthCheckConfig
+	passive passiveCheckConfig
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newPool(rawURLs []string, bc balancerConfig, hc *healthCheckConfig, pc passiveCheckConfig) (*pool, error) {
+	if len(rawURLs) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+	p := &pool{strategy: bc.Strategy, hashHeader: bc.HashHeader, health: hc, passive: pc, stop: make(chan struct{})}
+	if p.strategy == "" {
+		p.strategy = strategyRoundRobin
+	}
+	switch p.strategy {
+	case strategyRoundRobin, strategyLeastConn, strategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown balancer strategy %q", p.strategy)
+	}
+
+	seen := map[string]bool{}
+	for _, raw := range rawURLs {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q", raw)
+		}
+		if seen[u.String()] {
+			return nil, fmt.Errorf("duplicate upstream %q", raw)
+		}
+		seen[u.String()] = true
+		p.upstreams = append(p.upstreams, &upstream{url: u, pool: p, healthy: true})
+	}
+
+	if hc != nil {
+		if hc.Path == "" {
+			return nil, fmt.Errorf("health_check.path is required")
+		}
+		if hc.Interval <= 0 {
+			hc.Interval = duration(5 * time.Second)
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = duration(time.Second)
+		}
+		if hc.UnhealthyThreshold <= 0 {
+			hc.UnhealthyThreshold = 2
+		}
+		if hc.HealthyThreshold <= 0 {
+			hc.HealthyThreshold = 1
+		}
+	}
+	if p.passive.MaxFailures == 0 {
+		p.passive.MaxFailures = 3
+	}
+	if p.passive.EjectFor <= 0 {
+		p.passive.EjectFor = duration(30 * time.Second)
+	}
+
+	if p.strategy == strategyConsistentHash {
+		for _, u := range p.upstreams {
+			for i := 0; i < ringReplicas; i++ {
+				h := crc32.ChecksumIEEE([]byte(u.url.String() + "#" + strconv.Itoa(i)))
+				p.ring = append(p.ring, ringPoint{hash: h, up: u})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p, nil
+}
+
+// pick chooses an available instance, or nil if none is available.
+func (p *pool) pick(r *http.Request, clientIP string) *upstream {
+	now := time.Now()
+	n := len(p.upstreams)
+	turn := p.next.Add(1) - 1
+
+	switch p.strategy {
+	case strategyLeastConn:
+		var best *upstream
+		for i := 0; i < n; i++ {
+			u := p.upstreams[(int(turn%uint64(n))+i)%n] // rotate the start so ties spread out
+			if u.available(now) && (best == nil || u.active.Load() < best.active.Load()) {
+				best = u
+			}
+		}
+		return best
+
+	case strategyConsistentHash:
+		key := clientIP
+		if p.hashHeader != "" {
+			if v := r.Header.Get(p.hashHeader); v != "" {
+				key = v
+			}
+		}
+		h := crc32.ChecksumIEEE([]byte(key))
+		i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		// Walk clockwise past unavailable instances.
+		for j := 0; j < len(p.ring); j++ {
+			if u := p.ring[(i+j)%len(p.ring)].up; u.available(now) {
+				return u
+			}
+		}
+		return nil
+
+	default: // round robin over the instances that are available right now
+		live := make([]*upstream, 0, n)
+		for _, u := range p.upstreams {
+			if u.available(now) {
+				live = append(live, u)
+			}
+		}
+		if len(live) == 0 {
+			return nil
+		}
+		return live[turn%uint64(len(live))]
+	}
+}
+
+// acquire / release bracket a request to u. release feeds the passive check.
+func (p *pool) acquire(u *upstream) {
+	u.active.Add(1)
+}
+
+func (p *pool) release(u *upstream, failed bool) {
+	u.active.Add(-1)
+	if p.passive.MaxFailures < 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !failed {
+		u.failStreak = 0
+		return
+	}
+	u.failStreak++
+	if u.failStreak >= p.passive.MaxFailures {
+		u.failStreak = 0
+		u.ejectedUntil = time.Now().Add(time.Duration(p.passive.EjectFor))
+		log.Printf("[gateway] upstream %s ejected for %s after %d failures", u.url, time.Duration(p.passive.EjectFor), p.passive.MaxFailures)
+	}
+}
+
+// start launches the active health checkers (if configured).
+func (p *pool) start() {
+	if p.health == nil {
+		return
+	}
+	for _, u := range p.upstreams {
+		go p.checkLoop(u)
+	}
+}
+
+// close stops the health checkers. Requests already using the pool finish normally.
+func (p *pool) close() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+func (p *pool) checkLoop(u *upstream) {
+	ticker := time.NewTicker(time.Duration(p.health.Interval))
+	defer ticker.Stop()
+	for {
+		p.checkOnce(u)
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var healthClient = &http.Client{}
+
+func (p *pool) checkOnce(u *upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.health.Timeout))
+	defer cancel()
+
+	ok := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url.JoinPath(p.health.Path).String(), nil)
+	if err == nil {
+		if resp, err := healthClient.Do(req); err == nil {
+			resp.Body.Close()
+			ok = resp.StatusCode >= 200 && resp.StatusCode < 300
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok == u.healthy {
+		u.checkStreak = 0
+		return
+	}
+	u.checkStreak++
+	threshold := p.health.UnhealthyThreshold
+	if ok {
+		threshold = p.health.HealthyThreshold
+	}
+	if u.checkStreak >= threshold {
+		u.healthy, u.checkStreak = ok, 0
+		log.Printf("[gateway] upstream %s is now healthy=%v", u.url, ok)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPool(t *testing.T, strategy string, n int) *pool {
+	t.Helper()
+	var urls []string
+	for i := 0; i < n; i++ {
+		urls = append(urls, fmt.Sprintf("http://10.0.0.%d:7001", i+1))
+	}
+	p, err := newPool(urls, balancerConfig{Strategy: strategy, HashHeader: "X-Account-ID"}, nil, passiveCheckConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRoundRobinSkipsEjectedInstances(t *testing.T) {
+	p := testPool(t, strategyRoundRobin, 3)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Three failures in a row eject an instance.
+	bad := p.upstreams[1]
+	for i := 0; i < 3; i++ {
+		p.acquire(bad)
+		p.release(bad, true)
+	}
+
+	counts := map[*upstream]int{}
+	for i := 0; i < 300; i++ {
+		counts[p.pick(r, "1.2.3.4")]++
+	}
+	if counts[bad] != 0 || counts[p.upstreams[0]] != 150 || counts[p.upstreams[2]] != 150 {
+		t.Fatalf("distribution with one ejected instance: %d / %d / %d", counts[p.upstreams[0]], counts[bad], counts[p.upstreams[2]])
+	}
+}
+
+func TestLeastConnPicksIdlestInstance(t *testing.T) {
+	p := testPool(t, strategyLeastConn, 3)
+	r := httptest.NewRequest("GET", "/", nil)
+	p.acquire(p.upstreams[0])
+	p.acquire(p.upstreams[0])
+	p.acquire(p.upstreams[2])
+
+	for i := 0; i < 10; i++ {
+		if got := p.pick(r, ""); got != p.upstreams[1] {
+			t.Fatalf("picked %s, want the idle instance %s", got.url, p.upstreams[1].url)
+		}
+	}
+}
+
+func TestConsistentHashIsStable(t *testing.T) {
+	p := testPool(t, strategyConsistentHash, 4)
+
+	owner := map[string]*upstream{}
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Account-ID", fmt.Sprintf("acct-%d", i))
+		owner[r.Header.Get("X-Account-ID")] = p.pick(r, "")
+		if again := p.pick(r, ""); again != owner[r.Header.Get("X-Account-ID")] {
+			t.Fatal("same key picked two different instances")
+		}
+	}
+
+	// Take one instance out: only its keys may move.
+	gone := p.upstreams[3]
+	gone.healthy = false
+	moved := 0
+	for key, before := range owner {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Account-ID", key)
+		after := p.pick(r, "")
+		if after == gone {
+			t.Fatal("picked an unhealthy instance")
+		}
+		if before != gone && after != before {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Fatalf("%d keys owned by healthy instances moved", moved)
+	}
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	hc := &healthCheckConfig{Path: "/healthz", UnhealthyThreshold: 2, HealthyThreshold: 1}
+	p, err := newPool([]string{srv.URL}, balancerConfig{}, hc, passiveCheckConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := p.upstreams[0]
+
+	healthy.Store(false)
+	p.checkOnce(u)
+	if !u.available(time.Now()) {
+		t.Fatal("went down after a single failed check")
+	}
+	p.checkOnce(u)
+	if u.available(time.Now()) {
+		t.Fatal("still up after two failed checks")
+	}
+
+	healthy.Store(true)
+	p.checkOnce(u)
+	if !u.available(time.Now()) {
+		t.Fatal("did not come back after a good check")
+	}
+}
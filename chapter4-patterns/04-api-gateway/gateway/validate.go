@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Request validation ---
+//
+// Requests on a route with an OpenAPI document (see openapi.go) are checked
+// before they reach the backend. A path or method the document doesn't
+// describe gets 404 or 405. Bad parameters or bodies get a 400 listing
+// every problem found:
+//
+//	{"error": "invalid_request", "violations": [
+//	  {"in": "query", "field": "limit", "message": "must be at most 100"},
+//	  {"in": "body", "field": "/currency", "message": "must match ^[A-Z]{3}$"}]}
+//
+// "field" is the parameter name, or a JSON pointer into the body.
+//
+// max_body_bytes caps the request body on any route (413 body_too_large).
+// Validated bodies are read into memory, so routes with a document (or
+// idempotency keys) get a 1MB cap unless they set their own.
+
+const defaultMaxBufferedBody = 1 << 20
+
+type violation struct {
+	In      string `json:"in"` // path, query, header or body
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// checkRequest applies the route's body limit and OpenAPI document. When the
+// request must not go upstream it writes the answer and returns false.
+func checkRequest(w http.ResponseWriter, r *http.Request, m *routeMatch) bool {
+	rt := m.route
+	if rt.maxBody > 0 {
+		if r.ContentLength > rt.maxBody {
+			http.Error(w, `{"error":"body_too_large"}`, http.StatusRequestEntityTooLarge)
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, rt.maxBody)
+	}
+	if rt.api == nil {
+		return true
+	}
+
+	op, params, allowed := rt.api.find(r.Method, m.upstreamPath(r.URL.Path))
+	if op == nil && len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+		return false
+	}
+	if op == nil {
+		http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+		return false
+	}
+
+	vs := op.checkParams(r, params)
+	if op.body != nil {
+		data, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, `{"error":"body_too_large"}`, http.StatusRequestEntityTooLarge)
+			return false
+		case err != nil:
+			http.Error(w, `{"error":"bad_request"}`, http.StatusBadRequest)
+			return false
+		}
+		// The backend still gets the body.
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		r.ContentLength = int64(len(data))
+
+		switch {
+		case len(data) == 0:
+			if op.body.Required {
+				vs = append(vs, violation{In: "body", Message: "is required"})
+			}
+		case op.bodyJSON != nil:
+			if !isJSON(r.Header.Get("Content-Type")) {
+				http.Error(w, `{"error":"unsupported_media_type"}`, http.StatusUnsupportedMediaType)
+				return false
+			}
+			var v interface{}
+			if err := json.Unmarshal(data, &v); err != nil {
+				vs = append(vs, violation{In: "body", Message: "is not valid JSON: " + err.Error()})
+				break
+			}
+			vs = checkValue(op.bodyJSON, v, "body", "", vs)
+		}
+	}
+	if len(vs) == 0 {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error      string      `json:"error"`
+		Violations []violation `json:"violations"`
+	}{"invalid_request", vs})
+	return false
+}
+
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// checkParams checks the operation's path, query and header parameters.
+func (op *apiOperation) checkParams(r *http.Request, pathParams map[string]string) []violation {
+	var vs []violation
+	query := r.URL.Query()
+	for _, p := range op.params {
+		var raw []string
+		switch p.In {
+		case "path":
+			if v, ok := pathParams[p.Name]; ok {
+				raw = []string{v}
+			}
+		case "query":
+			raw = query[p.Name]
+		case "header":
+			raw = r.Header.Values(p.Name)
+		}
+		if len(raw) == 0 {
+			if p.Required || p.In == "path" {
+				vs = append(vs, violation{In: p.In, Field: p.Name, Message: "is required"})
+			}
+			continue
+		}
+		v, msg := coerce(p.Schema.resolved(), raw, p.In == "query")
+		if msg != "" {
+			vs = append(vs, violation{In: p.In, Field: p.Name, Message: msg})
+			continue
+		}
+		vs = checkValue(p.Schema, v, p.In, p.Name, vs)
+	}
+	return vs
+}
+
+// coerce turns a parameter's raw strings into the JSON value its schema
+// expects. Arrays come from repeated query parameters (?tag=a&tag=b) or
+// comma-separated values in paths and headers.
+func coerce(s *schema, raw []string, repeated bool) (interface{}, string) {
+	if s.Type != "array" {
+		return coerceOne(s, raw[0])
+	}
+	items := raw
+	if !repeated {
+		items = strings.Split(strings.Join(raw, ","), ",")
+	}
+	item := &schema{}
+	if s.Items != nil {
+		item = s.Items.resolved()
+	}
+	out := make([]interface{}, len(items))
+	for i, it := range items {
+		v, msg := coerceOne(item, strings.TrimSpace(it))
+		if msg != "" {
+			return nil, fmt.Sprintf("item %d %s", i, msg)
+		}
+		out[i] = v
+	}
+	return out, ""
+}
+
+func coerceOne(s *schema, raw string) (interface{}, string) {
+	switch s.Type {
+	case "integer", "number":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, "must be " + typeName(s.Type)
+		}
+		return f, ""
+	case "boolean":
+		switch raw {
+		case "true":
+			return true, ""
+		case "false":
+			return false, ""
+		}
+		return nil, "must be true or false"
+	}
+	return raw, ""
+}
+
+// checkValue validates v (as decoded by encoding/json) against s and appends
+// what is wrong to vs.
+func checkValue(s *schema, v interface{}, in, field string, vs []violation) []violation {
+	s = s.resolved()
+	add := func(format string, args ...interface{}) {
+		vs = append(vs, violation{In: in, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if v == nil {
+		if !s.Nullable && s.Type != "" {
+			add("must not be null")
+		}
+		return vs
+	}
+	for _, sub := range s.AllOf {
+		vs = checkValue(sub, v, in, field, vs)
+	}
+	if len(s.AnyOf) > 0 && matching(s.AnyOf, v) == 0 {
+		add("must match at least one of the allowed schemas")
+	}
+	if len(s.OneOf) > 0 && matching(s.OneOf, v) != 1 {
+		add("must match exactly one of the allowed schemas")
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		add("must be one of %s", enumList(s.Enum))
+	}
+
+	switch v := v.(type) {
+	case string:
+		if s.Type != "" && s.Type != "string" {
+			add("must be %s", typeName(s.Type))
+			break
+		}
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			add("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			add("must be at most %d characters", *s.MaxLength)
+		}
+		if s.re != nil && !s.re.MatchString(v) {
+			add("must match %s", s.Pattern)
+		}
+		if msg := checkFormat(s.Format, v); msg != "" {
+			add("%s", msg)
+		}
+
+	case float64:
+		if s.Type != "" && s.Type != "number" && s.Type != "integer" || s.Type == "integer" && v != math.Trunc(v) {
+			add("must be %s", typeName(s.Type))
+			break
+		}
+		if s.Minimum != nil && (v < *s.Minimum || s.ExclusiveMinimum && v == *s.Minimum) {
+			if s.ExclusiveMinimum {
+				add("must be greater than %s", formatFloat(*s.Minimum))
+			} else {
+				add("must be at least %s", formatFloat(*s.Minimum))
+			}
+		}
+		if s.Maximum != nil && (v > *s.Maximum || s.ExclusiveMaximum && v == *s.Maximum) {
+			if s.ExclusiveMaximum {
+				add("must be less than %s", formatFloat(*s.Maximum))
+			} else {
+				add("must be at most %s", formatFloat(*s.Maximum))
+			}
+		}
+
+	case bool:
+		if s.Type != "" && s.Type != "boolean" {
+			add("must be %s", typeName(s.Type))
+		}
+
+	case []interface{}:
+		if s.Type != "" && s.Type != "array" {
+			add("must be %s", typeName(s.Type))
+			break
+		}
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			add("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			add("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				vs = checkValue(s.Items, item, in, pointer(field, strconv.Itoa(i)), vs)
+			}
+		}
+
+	case map[string]interface{}:
+		if s.Type != "" && s.Type != "object" {
+			add("must be %s", typeName(s.Type))
+			break
+		}
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				vs = append(vs, violation{In: in, Field: pointer(field, name), Message: "is required"})
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch prop, ok := s.Properties[k]; {
+			case ok:
+				vs = checkValue(prop, v[k], in, pointer(field, k), vs)
+			case s.noAdditional:
+				vs = append(vs, violation{In: in, Field: pointer(field, k), Message: "is not allowed"})
+			case s.additional != nil:
+				vs = checkValue(s.additional, v[k], in, pointer(field, k), vs)
+			}
+		}
+	}
+	return vs
+}
+
+// matching counts the schemas v satisfies.
+func matching(schemas []*schema, v interface{}) int {
+	n := 0
+	for _, s := range schemas {
+		if len(checkValue(s, v, "", "", nil)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	b, _ := json.Marshal(enum)
+	return string(b)
+}
+
+var (
+	uuidRE  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	emailRE = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+// checkFormat knows a few common string formats; others are not checked.
+func checkFormat(format, v string) string {
+	switch format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return "must be an RFC 3339 date-time"
+		}
+	case "date":
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			return "must be a date (YYYY-MM-DD)"
+		}
+	case "uuid":
+		if !uuidRE.MatchString(v) {
+			return "must be a UUID"
+		}
+	case "email":
+		if !emailRE.MatchString(v) {
+			return "must be an email address"
+		}
+	}
+	return ""
+}
+
+func typeName(t string) string {
+	switch t {
+	case "integer", "array", "object":
+		return "an " + t
+	}
+	return "a " + t
+}
+
+// pointer appends one reference token to a JSON pointer (RFC 6901).
+func pointer(base, token string) string {
+	return base + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
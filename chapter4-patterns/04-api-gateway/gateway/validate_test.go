@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// checkOn runs checkRequest for r on the first route of routesJSON.
+func checkOn(t *testing.T, routesJSON string, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	table, err := parseRoutes([]byte(routesJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := table.match(r)
+	w := httptest.NewRecorder()
+	if checkRequest(w, r, m) {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w
+}
+
+type violationsBody struct {
+	Error      string      `json:"error"`
+	Violations []violation `json:"violations"`
+}
+
+func TestValidateAgainstOpenAPI(t *testing.T) {
+	const routesJSON = `{"routes": [{"prefix": "/payments/", "upstream": "http://10.0.0.1:7002", "openapi": "openapi/payments.json"}]}`
+	const charge = `{"amount": 1250, "currency": "EUR", "merchant_id": "m-1", "user_id": "u-1"}`
+
+	cases := []struct {
+		method, path, contentType, body string
+		want                            int
+		violations                      []string // "in field: message"
+	}{
+		{"GET", "/payments/tx/abc", "", "", 200, nil},
+		{"HEAD", "/payments/tx/abc", "", "", 200, nil},
+		{"GET", "/payments/tx/a.b", "", "", 400, []string{"path id: must match ^[A-Za-z0-9_-]{1,64}$"}},
+		{"GET", "/payments/tx?limit=500", "", "", 400, []string{"query limit: must be at most 100"}},
+		{"GET", "/payments/tx?limit=ten", "", "", 400, []string{"query limit: must be an integer"}},
+		{"GET", "/payments/recent", "", "", 400, []string{"query user: is required"}},
+		{"GET", "/payments/refunds", "", "", 404, nil},
+		{"DELETE", "/payments/tx/abc", "", "", 405, nil},
+		{"POST", "/payments/tx", "application/json", charge, 200, nil},
+		{"POST", "/payments/tx", "application/json; charset=utf-8", charge, 200, nil},
+		{"POST", "/payments/tx", "text/plain", charge, 415, nil},
+		{"POST", "/payments/tx", "application/json", "", 400, []string{"body : is required"}},
+		{"POST", "/payments/tx", "application/json", `{"amount": 1`, 400, []string{"body : is not valid JSON: unexpected end of JSON input"}},
+		{"POST", "/payments/tx", "application/json",
+			`{"amount": 12.5, "currency": "eur", "user_id": "u-1", "tip": 1, "metadata": {"order": 7}}`, 400, []string{
+				"body /merchant_id: is required",
+				"body /amount: must be an integer",
+				"body /currency: must match ^[A-Z]{3}$",
+				"body /metadata/order: must be a string",
+				"body /tip: is not allowed",
+			}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		w := checkOn(t, routesJSON, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s %s: status %d, want %d (%s)", c.method, c.path, c.body, w.Code, c.want, w.Body)
+			continue
+		}
+		if c.violations == nil {
+			continue
+		}
+		var got violationsBody
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Error != "invalid_request" {
+			t.Errorf("%s %s: body %s", c.method, c.path, w.Body)
+			continue
+		}
+		var msgs []string
+		for _, v := range got.Violations {
+			msgs = append(msgs, v.In+" "+v.Field+": "+v.Message)
+		}
+		if strings.Join(msgs, "\n") != strings.Join(c.violations, "\n") {
+			t.Errorf("%s %s: violations\n%s\nwant\n%s", c.method, c.path, strings.Join(msgs, "\n"), strings.Join(c.violations, "\n"))
+		}
+	}
+}
+
+func TestValidateSchemaKeywords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.json")
+	os.WriteFile(path, []byte(`{"openapi": "3.0.3", "paths": {}, "components": {"schemas": {
+		"Pet": {"oneOf": [{"$ref": "#/components/schemas/Cat"}, {"$ref": "#/components/schemas/Dog"}]},
+		"Cat": {"type": "object", "required": ["meows"], "properties": {"meows": {"type": "boolean"}}},
+		"Dog": {"type": "object", "required": ["barks"], "properties": {"barks": {"type": "boolean"}}},
+		"Id": {"allOf": [{"type": "string", "format": "uuid"}, {"minLength": 36}]},
+		"Size": {"type": "string", "enum": ["S", "M", "L"], "nullable": true},
+		"Tags": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string"}},
+		"Price": {"type": "number", "minimum": 0, "exclusiveMinimum": true},
+		"When": {"anyOf": [{"type": "string", "format": "date"}, {"type": "string", "format": "date-time"}]}
+	}}}`), 0o644)
+	spec, err := loadOpenAPI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		schema string
+		value  string
+		ok     bool
+	}{
+		{"Pet", `{"meows": true}`, true},
+		{"Pet", `{"meows": true, "barks": true}`, false}, // both match
+		{"Pet", `{}`, false},
+		{"Id", `"0b6b0c5e-33a4-4f0e-9a43-6cd1d2a3e4f5"`, true},
+		{"Id", `"not-a-uuid"`, false},
+		{"Size", `"M"`, true},
+		{"Size", `null`, true},
+		{"Size", `"XL"`, false},
+		{"Tags", `["a"]`, true},
+		{"Tags", `[]`, false},
+		{"Tags", `["a", 2]`, false},
+		{"Price", `0.01`, true},
+		{"Price", `0`, false},
+		{"Price", `"1"`, false},
+		{"When", `"2024-02-29"`, true},
+		{"When", `"2024-02-29T10:00:00Z"`, true},
+		{"When", `"yesterday"`, false},
+	}
+	for _, c := range cases {
+		var v interface{}
+		if err := json.Unmarshal([]byte(c.value), &v); err != nil {
+			t.Fatal(err)
+		}
+		vs := checkValue(spec.schemas[c.schema], v, "body", "", nil)
+		if (len(vs) == 0) != c.ok {
+			t.Errorf("%s %s: violations %v, want ok=%v", c.schema, c.value, vs, c.ok)
+		}
+	}
+}
+
+func TestOpenAPILoadErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"openapi": "2.0", "paths": {}}`,
+		`{"openapi": "3.0.0", "paths": {"/a": {"get": {"parameters": [{"$ref": "#/components/parameters/nope"}]}}}}`,
+		`{"openapi": "3.0.0", "paths": {"/a": {"get": {"parameters": [{"name": "c", "in": "cookie"}]}}}}`,
+		`{"openapi": "3.0.0", "paths": {"/a": {"post": {"requestBody": {"content": {"application/json": {"schema": {"pattern": "("}}}}}}}}`,
+		`openapi: 3.0.0`,
+	} {
+		path := filepath.Join(t.TempDir(), "api.json")
+		os.WriteFile(path, []byte(doc), 0o644)
+		if _, err := loadOpenAPI(path); err == nil {
+			t.Errorf("accepted %s", doc)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	var reached atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer upstream.Close()
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/upload/", "upstream": "` + upstream.URL + `", "max_body_bytes": 10}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body io.Reader) int {
+		r := httptest.NewRequest("POST", "/upload/x", body)
+		m, _ := table.match(r)
+		w := httptest.NewRecorder()
+		if checkRequest(w, r, m) {
+			serveProxy(w, r, &proxyState{match: m, up: m.route.pool.upstreams[0], id: &identity{}, reqID: "req"})
+		}
+		return w.Code
+	}
+
+	if code := send(strings.NewReader("0123456789")); code != http.StatusOK {
+		t.Fatalf("10 bytes: status %d, want 200", code)
+	}
+	// A known length over the limit never leaves the gateway.
+	if code := send(strings.NewReader("0123456789x")); code != http.StatusRequestEntityTooLarge || reached.Load() != 1 {
+		t.Fatalf("11 bytes: status %d, upstream calls %d", code, reached.Load())
+	}
+	// A streamed body is cut off once it passes the limit.
+	if code := send(io.MultiReader(strings.NewReader(strings.Repeat("x", 100)))); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("streamed: status %d, want 413", code)
+	}
+}
+
+func TestGatewayValidatesBeforeProxying(t *testing.T) {
+	secret := setupGateway(t)
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+	}))
+	defer upstream.Close()
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/payments/", "upstream": "` + upstream.URL + `", "openapi": "openapi/payments.json"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.current.Store(table)
+
+	post := func(body string) int {
+		r := httptest.NewRequest("POST", "/payments/tx", strings.NewReader(body))
+		r.Header.Set("X-API-Key", secret)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handleGateway(w, r)
+		return w.Code
+	}
+	if code := post(`{"amount": 0, "currency": "EUR", "merchant_id": "m", "user_id": "u"}`); code != http.StatusBadRequest {
+		t.Fatalf("invalid charge: status %d, want 400", code)
+	}
+	good := `{"amount": 1, "currency": "EUR", "merchant_id": "m", "user_id": "u"}`
+	if code := post(good); code != http.StatusOK {
+		t.Fatalf("valid charge: status %d, want 200", code)
+	}
+	if len(bodies) != 1 || bodies[0] != good {
+		t.Fatalf("upstream got %q, want just the valid body", bodies)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// --- Traffic splitting (canary releases) ---
+//
+// A route's own upstream(s) are its "stable" group. Variants add other
+// groups of instances, each with a share of the traffic and/or match rules:
+//
+//	{"prefix": "/payments/", "upstream": "http://localhost:7002",
+//	 "variants": [
+//	   {"name": "canary", "upstreams": ["http://localhost:7012"], "weight": 10,
+//	    "match": {"headers": {"X-Canary": "true"}}}
+//	 ]}
+//
+// For each request:
+//  1. the first variant whose match rules all hold gets it (headers,
+//     cookies, the caller's tenant or client ID);
+//  2. otherwise weight is the percentage of the remaining traffic a variant
+//     gets, and stable keeps the rest. The draw is sticky by default: it
+//     hashes the caller's client ID, so one client stays on one version
+//     until the weights change. "sticky": false draws per request.
+//
+// A variant with weight 0 and match rules only ever sees matching traffic,
+// e.g. a build released to one tenant. Every variant has its own pool, so
+// balancer, health_check and passive_check apply to it as to the route.
+
+const stableVariant = "stable"
+
+type variantConfig struct {
+	Name         string              `json:"name"`
+	Upstream     string              `json:"upstream,omitempty"`
+	Upstreams    []string            `json:"upstreams,omitempty"`
+	Weight       int                 `json:"weight,omitempty"` // percent of traffic, 0-100
+	Match        *variantMatch       `json:"match,omitempty"`
+	Balancer     *balancerConfig     `json:"balancer,omitempty"`
+	HealthCheck  *healthCheckConfig  `json:"health_check,omitempty"`
+	PassiveCheck *passiveCheckConfig `json:"passive_check,omitempty"`
+}
+
+// variantMatch sends a request to a variant when every condition given holds.
+type variantMatch struct {
+	Headers map[string]string `json:"headers,omitempty"` // header -> value (case-insensitive)
+	Cookies map[string]string `json:"cookies,omitempty"` // cookie -> value
+	Tenants []string          `json:"tenants,omitempty"` // the caller's tenant is one of these
+	Clients []string          `json:"clients,omitempty"` // the caller's client ID is one of these
+}
+
+func (m *variantMatch) empty() bool {
+	return len(m.Headers) == 0 && len(m.Cookies) == 0 && len(m.Tenants) == 0 && len(m.Clients) == 0
+}
+
+func (m *variantMatch) matches(r *http.Request, id *identity) bool {
+	for name, want := range m.Headers {
+		if !strings.EqualFold(r.Header.Get(name), want) {
+			return false
+		}
+	}
+	for name, want := range m.Cookies {
+		c, err := r.Cookie(name)
+		if err != nil || c.Value != want {
+			return false
+		}
+	}
+	if len(m.Tenants) > 0 && !contains(m.Tenants, id.tenant) {
+		return false
+	}
+	if len(m.Clients) > 0 && !contains(m.Clients, id.clientID) {
+		return false
+	}
+	return true
+}
+
+// variant is one group of instances behind a route.
+type variant struct {
+	name   string // "" when the route has no variants
+	weight int
+	match  *variantMatch
+	pool   *pool
+}
+
+// buildVariants turns the "variants" block into pools. stable is the
+// route's own pool; it comes first and takes whatever weight is left.
+func buildVariants(stable *pool, configs []variantConfig) ([]*variant, error) {
+	if len(configs) == 0 {
+		return []*variant{{pool: stable}}, nil
+	}
+	out := []*variant{{name: stableVariant, pool: stable}}
+	seen := map[string]bool{stableVariant: true}
+	total := 0
+	for _, vc := range configs {
+		if vc.Name == "" || seen[vc.Name] {
+			return nil, fmt.Errorf("variants: missing or duplicate name %q", vc.Name)
+		}
+		seen[vc.Name] = true
+		if vc.Weight < 0 || vc.Weight > 100 {
+			return nil, fmt.Errorf("variants: %s: weight must be between 0 and 100", vc.Name)
+		}
+		if vc.Match != nil && vc.Match.empty() {
+			return nil, fmt.Errorf("variants: %s: match has no conditions", vc.Name)
+		}
+		if vc.Weight == 0 && vc.Match == nil {
+			return nil, fmt.Errorf("variants: %s: needs a weight or match rules", vc.Name)
+		}
+		total += vc.Weight
+
+		urls := vc.Upstreams
+		if vc.Upstream != "" {
+			urls = append([]string{vc.Upstream}, urls...)
+		}
+		var bc balancerConfig
+		if vc.Balancer != nil {
+			bc = *vc.Balancer
+		}
+		var pc passiveCheckConfig
+		if vc.PassiveCheck != nil {
+			pc = *vc.PassiveCheck
+		}
+		p, err := newPool(urls, bc, vc.HealthCheck, pc)
+		if err != nil {
+			return nil, fmt.Errorf("variants: %s: %w", vc.Name, err)
+		}
+		out = append(out, &variant{name: vc.Name, weight: vc.Weight, match: vc.Match, pool: p})
+	}
+	if total > 100 {
+		return nil, errors.New("variants: weights add up to more than 100")
+	}
+	out[0].weight = 100 - total
+	return out, nil
+}
+
+// variantFor picks the group of instances that serves this request.
+func (rt *route) variantFor(r *http.Request, id *identity) *variant {
+	if len(rt.variants) == 1 {
+		return rt.variants[0]
+	}
+	for _, v := range rt.variants[1:] {
+		if v.match != nil && v.match.matches(r, id) {
+			return v
+		}
+	}
+
+	var n int
+	if rt.sticky && id.clientID != "" {
+		n = int(crc32.ChecksumIEEE([]byte(rt.prefix+"|"+id.clientID)) % 100)
+	} else {
+		n = rand.Intn(100)
+	}
+	// Stable keeps the top of the range, so raising the weight of a single
+	// canary only moves clients from stable to it, never back.
+	for _, v := range rt.variants[1:] {
+		if n < v.weight {
+			return v
+		}
+		n -= v.weight
+	}
+	return rt.variants[0]
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func variantRoute(t *testing.T, variants string) *route {
+	t.Helper()
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/payments/", "upstream": "http://10.0.0.1:7002",
+		"variants": ` + variants + `}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table.routes[0]
+}
+
+func TestVariantMatchRules(t *testing.T) {
+	rt := variantRoute(t, `[
+		{"name": "canary", "upstream": "http://10.0.0.2:7002", "weight": 0, "match": {"headers": {"X-Canary": "true"}}},
+		{"name": "acme", "upstream": "http://10.0.0.3:7002", "match": {"tenants": ["acme"], "cookies": {"beta": "1"}}}
+	]`)
+
+	cases := []struct {
+		header, cookie, tenant string
+		want                   string
+	}{
+		{"", "", "", "stable"},
+		{"TRUE", "", "", "canary"},
+		{"", "beta=1", "acme", "acme"},
+		{"", "beta=1", "other", "stable"}, // every condition must hold
+		{"", "", "acme", "stable"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/payments/1", nil)
+		if c.header != "" {
+			r.Header.Set("X-Canary", c.header)
+		}
+		if c.cookie != "" {
+			r.Header.Set("Cookie", c.cookie)
+		}
+		if got := rt.variantFor(r, &identity{clientID: "c", tenant: c.tenant}).name; got != c.want {
+			t.Errorf("%+v: got %s", c, got)
+		}
+	}
+}
+
+func TestVariantWeightsAreStickyPerClient(t *testing.T) {
+	rt := variantRoute(t, `[{"name": "canary", "upstream": "http://10.0.0.2:7002", "weight": 10}]`)
+	r := httptest.NewRequest("GET", "/payments/1", nil)
+
+	canary := 0
+	for i := 0; i < 2000; i++ {
+		id := &identity{clientID: fmt.Sprintf("client-%d", i)}
+		first := rt.variantFor(r, id)
+		for j := 0; j < 5; j++ {
+			if rt.variantFor(r, id) != first {
+				t.Fatalf("client %s moved between variants", id.clientID)
+			}
+		}
+		if first.name == "canary" {
+			canary++
+		}
+	}
+	if canary < 140 || canary > 260 {
+		t.Fatalf("%d of 2000 clients on the canary, want about 10%%", canary)
+	}
+}
+
+func TestVariantValidation(t *testing.T) {
+	for _, variants := range []string{
+		`[{"name": "a", "upstream": "http://10.0.0.2:7002", "weight": 60}, {"name": "b", "upstream": "http://10.0.0.3:7002", "weight": 50}]`,
+		`[{"name": "a", "upstream": "http://10.0.0.2:7002"}]`,
+		`[{"name": "a", "upstream": "http://10.0.0.2:7002", "match": {}}]`,
+		`[{"name": "stable", "upstream": "http://10.0.0.2:7002", "weight": 5}]`,
+		`[{"name": "a", "weight": 5}]`,
+	} {
+		if _, err := parseRoutes([]byte(`{"routes": [{"prefix": "/p/", "upstream": "http://10.0.0.1:7002", "variants": ` + variants + `}]}`)); err == nil {
+			t.Errorf("accepted %s", variants)
+		}
+	}
+}
+
+func TestGatewayVariantMetrics(t *testing.T) {
+	secret := setupGateway(t)
+	resetMetrics(t)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer canary.Close()
+	table, err := parseRoutes([]byte(`{"routes": [{"prefix": "/users/", "upstream": "http://127.0.0.1:1",
+		"variants": [{"name": "canary", "upstream": "` + canary.URL + `", "match": {"clients": ["test-client"]}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.current.Store(table)
+
+	if w := gatewayGet(secret, "/users/1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want the canary's 500", w.Code)
+	}
+	m := httptest.NewRecorder()
+	metricsHandler(m, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(m.Body.String(), `gateway_variant_responses_total{route="/users/",variant="canary",code="5xx"} 1`) {
+		t.Fatal("canary error not counted in gateway_variant_responses_total")
+	}
+}
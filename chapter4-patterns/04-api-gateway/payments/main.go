@@ -4,15 +4,28 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 )
 
-// A mock Payments service that just echoes the path and request ID.
+// A mock Payments service that just echoes its instance, version, the path, request ID and calling client.
 func main() {
+	// PORT lets you start several instances behind the gateway
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "7002"
+	}
+	// VERSION tells builds apart when one runs as a canary
+	version := os.Getenv("VERSION")
+	if version == "" {
+		version = "v1"
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		reqID := r.Header.Get("X-Request-ID")
-		fmt.Fprintf(w, `{"service":"payments","path":"%s","request_id":"%s"}`, r.URL.Path, reqID)
+		clientID := r.Header.Get("X-Client-ID") // set by the gateway after auth
+		fmt.Fprintf(w, `{"service":"payments","instance":"%s","version":"%s","path":"%s","request_id":"%s","client_id":"%s"}`, port, version, r.URL.Path, reqID, clientID)
 	})
 
-	log.Println("[payments] listening on :7002")
-	log.Fatal(http.ListenAndServe(":7002", nil))
-}
\ No newline at end of file
+	log.Printf("[payments] listening on :%s", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
@@ -1,18 +1,51 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 )
 
-// A mock Users service that just echoes the path and request ID.
+// A mock Users service that just echoes its instance, the path, request ID and calling client.
 func main() {
+	// PORT lets you start several instances behind the gateway
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "7001"
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutSuffix(r.URL.Path, "/profile"); ok && r.Method == http.MethodGet {
+			serveProfile(w, r, strings.Trim(id, "/"))
+			return
+		}
 		reqID := r.Header.Get("X-Request-ID")
-		fmt.Fprintf(w, `{"service":"users","path":"%s","request_id":"%s"}`, r.URL.Path, reqID)
+		clientID := r.Header.Get("X-Client-ID") // set by the gateway after auth
+		fmt.Fprintf(w, `{"service":"users","instance":"%s","path":"%s","request_id":"%s","client_id":"%s"}`, port, r.URL.Path, reqID, clientID)
 	})
 
-	log.Println("[users] listening on :7001")
-	log.Fatal(http.ListenAndServe(":7001", nil))
-}
\ No newline at end of file
+	log.Printf("[users] listening on :%s", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+
+// serveProfile answers GET /{id}/profile with a body that only depends on
+// the id, so the gateway may cache it (see "cache" in routes.json).
+func serveProfile(w http.ResponseWriter, r *http.Request, id string) {
+	log.Printf("[users] profile lookup for %s", id)
+	body := fmt.Sprintf(`{"id":"%s","name":"User %s","plan":"standard"}`, id, id)
+	sum := sha256.Sum256([]byte(body))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, body)
+}
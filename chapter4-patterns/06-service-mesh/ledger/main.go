@@ -3,15 +3,21 @@ package main
 import (
 	"encoding/json"
 	"log"
-	"math/rand"
 	"net/http"
+	"sync"
 	"time"
+
+	"patterns/internal/fault"
+	"patterns/internal/server"
 )
 
 /*
 ledger exposes POST /ledger/debit
-- Verifies "mTLS-like" headers (simulating identity from the mesh)
-- Randomly delays or errors to demonstrate mesh retries
+- Listens on 127.0.0.1:7002: only its inbound sidecar (meshproxy, :15006)
+  reaches it, and that sidecar decides who may call what (policy.json)
+- Randomly delays or errors to demonstrate mesh retries (internal/fault)
+- Posts a debit once per Idempotency-Key: a retry of a debit that was
+  already posted (e.g. the first try was only slow) gets the first result
 - Returns a simple JSON result on success
 */
 
@@ -29,46 +35,84 @@ type LedgerResult struct {
 	Currency string  `json:"currency"`
 }
 
+// Unless LEDGER_FAULTS says otherwise: ~20% of debits take 500ms (slower
+// than the mesh's per-try timeout, so it retries) and ~10% fail with a 5xx
+var defaultFaults = fault.Config{Endpoints: map[string]fault.Profile{
+	"/ledger/debit": {
+		Latency:   fault.Latency{Rate: 0.2, Delay: fault.Duration(500 * time.Millisecond)},
+		ErrorRate: 0.1, ErrorStatus: http.StatusInternalServerError, ErrorBody: `{"error":"temporary_storage_error"}`,
+		Exclusive: true, // slow or failing, never both
+	},
+}}
+
+// How long an Idempotency-Key is remembered
+const idempotencyTTL = 24 * time.Hour
+
+type postedDebit struct {
+	req    PayRequest
+	result LedgerResult
+	at     time.Time
+}
+
+var (
+	postedMu  sync.Mutex
+	posted    = map[string]postedDebit{} // by Idempotency-Key
+	lastSweep time.Time
+)
+
 func main() {
-	rand.Seed(time.Now().UnixNano())
+	faults, err := fault.FromEnv("ledger", defaultFaults)
+	if err != nil {
+		log.Fatalf("[ledger] %v", err)
+	}
 
 	http.HandleFunc("/ledger/debit", handleDebit)
+	http.Handle("/admin/faults", faults.AdminHandler())
 
-	log.Println("[ledger] listening on :7002")
-	log.Fatal(http.ListenAndServe(":7002", nil))
+	server.Main("ledger", "127.0.0.1:7002", faults.Handler(http.DefaultServeMux))
 }
 
 func handleDebit(w http.ResponseWriter, r *http.Request) {
-	// Simulate mTLS verification via headers (demo only)
-	if r.Header.Get("X-Mesh-mTLS") != "true" ||
-		r.Header.Get("X-Service-Identity") != "payments" {
-		http.Error(w, `{"error":"unauthenticated_mesh"}`, http.StatusUnauthorized)
+	var in PayRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	// Random slowness / failure to show retries
-	n := rand.Intn(100)
-	switch {
-	case n < 20:
-		time.Sleep(500 * time.Millisecond) // slower than mesh per-try timeout (forces retry)
-	case n >= 20 && n < 30:
-		http.Error(w, `{"error":"temporary_storage_error"}`, http.StatusInternalServerError)
-		return
-	}
+	key := r.Header.Get("Idempotency-Key")
+	w.Header().Set("Content-Type", "application/json")
 
-	var in PayRequest
-	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
+	postedMu.Lock()
+	defer postedMu.Unlock()
+	now := time.Now()
+	if p, ok := posted[key]; ok && key != "" && now.Sub(p.at) < idempotencyTTL {
+		if p.req != in {
+			http.Error(w, `{"error":"idempotency_key_reused"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		log.Printf("[ledger] replaying debit %s for Idempotency-Key %s", p.result.TxID, key)
+		w.Header().Set("Idempotent-Replayed", "true")
+		json.NewEncoder(w).Encode(p.result)
 		return
 	}
 
 	out := LedgerResult{
 		Status:   "posted",
-		TxID:     time.Now().Format("20060102150405.000"),
+		TxID:     now.Format("20060102150405.000"),
 		Amount:   in.Amount,
 		Currency: in.Currency,
 	}
+	if key != "" {
+		posted[key] = postedDebit{req: in, result: out, at: now}
+		if now.Sub(lastSweep) > time.Minute {
+			for k, p := range posted {
+				if now.Sub(p.at) >= idempotencyTTL {
+					delete(posted, k)
+				}
+			}
+			lastSweep = now
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
-}
\ No newline at end of file
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"patterns/internal/mtls"
+	"patterns/internal/server"
+)
+
+/*
+meshca listens on 127.0.0.1:15000 (the mesh's certificate authority)
+- Keeps its root key and certificate in MESHCA_DIR (default ./data),
+  created on first start
+- POST /sign {"id":"spiffe://mesh.local/ns/default/sa/payments","csr":"<PEM>"}
+  -> {"cert":"<PEM>","bundle":"<PEM>","expires_at":"..."}
+- GET /bundle -> the root certificate, which every sidecar trusts
+- Certificates live MESHCA_CERT_TTL (default 10m); sidecars renew them
+  at two thirds of that
+- MESHCA_TOKEN, when set, must be sent in X-CA-Token. Without it, anything
+  that can reach the CA gets certificates for any identity: keep it on
+  loopback (a real mesh attests the workload, e.g. by its service account
+  token, before signing)
+*/
+
+func main() {
+	dir := "data"
+	if v := os.Getenv("MESHCA_DIR"); v != "" {
+		dir = v
+	}
+	ttl := 10 * time.Minute
+	if v := os.Getenv("MESHCA_CERT_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("[meshca] MESHCA_CERT_TTL: invalid duration %q", v)
+		}
+		ttl = d
+	}
+	token := os.Getenv("MESHCA_TOKEN")
+
+	ca, err := mtls.LoadOrCreateCA(dir)
+	if err != nil {
+		log.Fatalf("[meshca] %v", err)
+	}
+	if token == "" {
+		log.Println("[meshca] MESHCA_TOKEN is not set: anyone who can reach the CA gets certificates")
+	}
+	log.Printf("[meshca] root in %s, issuing certificates for %s", dir, ttl)
+
+	http.Handle("/", ca.Handler(token, ttl))
+
+	server.Main("meshca", "127.0.0.1:15000", nil)
+}
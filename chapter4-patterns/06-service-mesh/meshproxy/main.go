@@ -1,110 +1,295 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"patterns/internal/mtls"
+	"patterns/internal/server"
 )
 
 /*
-meshproxy listens on :15001
-- Forwards requests to the real Ledger (http://localhost:7002)
+meshproxy is the mesh sidecar; MESHPROXY_MODE says which side it is on.
+
+outbound (default), beside payments, listens on :15001
+- Forwards requests to the ledger's inbound sidecar (https://localhost:15006)
+  over mutual TLS: it presents the payments certificate, and only talks to
+  a server whose certificate says it is the ledger
 - Adds trace id if missing (X-Request-ID)
-- Adds "mTLS-like" identity headers:
-    X-Mesh-mTLS: true
-    X-Service-Identity: payments
-- Applies per-try timeout and retry logic (2 retries on 5xx/timeout)
+- Applies per-try timeouts and retries idempotent requests, with backoff
+  and a retry budget (retry.go)
+- Streams the response back as it arrives, headers and trailers included;
+  the mesh's own errors are JSON (stream.go)
 - Emits tiny metrics to stdout
+
+inbound, in front of the ledger, listens on :15006 (TLS)
+- Terminates mutual TLS; a caller without a valid certificate gets 401
+- Forwards to the ledger (http://localhost:7002) with the caller's verified
+  identity in X-Service-Identity, replacing whatever the caller sent
+
+Both get their certificate from meshca (MESHPROXY_CA_URL, default
+http://127.0.0.1:15000, and MESHPROXY_CA_TOKEN) for MESHPROXY_SERVICE
+(default payments outbound, ledger inbound), and renew it before it
+expires. MESHPROXY_UPSTREAM changes where requests go, and outbound,
+MESHPROXY_UPSTREAM_SERVICE the identity the upstream must prove (ledger).
+Requests are checked against the authorization policy (policy.go) first.
 */
 
-const (
-	upstreamURL   = "http://localhost:7002" // ledger base
-	perTryTimeout = 300 * time.Millisecond
-	maxRetries    = 2
-)
+// Default per-try timeout, for routes that don't set one
+const perTryTimeout = 300 * time.Millisecond
 
 var (
-	totalReq   int
-	totalRetry int
+	totalReq   atomic.Int64
+	totalRetry atomic.Int64
+
+	policies *policyEngine
+
+	// outbound
+	self        string // this sidecar's identity
+	upstreamURL string
+	upstreamID  string
+	upstream    http.RoundTripper // not a Client: redirects go back to the caller
+	retries     *retryConfig
+	budget      *retryBudget
 )
 
 func main() {
+	mode := getenv("MESHPROXY_MODE", "outbound")
+	if mode != "outbound" && mode != "inbound" {
+		log.Fatalf("[meshproxy] MESHPROXY_MODE: want outbound or inbound, got %q", mode)
+	}
+	service := getenv("MESHPROXY_SERVICE", map[string]string{"outbound": "payments", "inbound": "ledger"}[mode])
+	caURL := getenv("MESHPROXY_CA_URL", "http://127.0.0.1:15000")
+
+	ctx := context.Background()
+	me := mtls.ServiceID(service)
+	id, err := mtls.NewIdentity(ctx, mtls.Config{
+		ID:      me,
+		Issuer:  &mtls.Client{URL: caURL, Token: os.Getenv("MESHPROXY_CA_TOKEN"), ID: me},
+		OnRenew: logRenewal,
+	})
+	if err != nil {
+		log.Fatalf("[meshproxy] no certificate from the CA at %s (is meshca running?): %v", caURL, err)
+	}
+	go id.Rotate(ctx)
+	log.Printf("[meshproxy] %s sidecar for %s, certificate valid until %s", mode, me, id.Certificate().Leaf.NotAfter.Format(time.RFC3339))
+
+	policyPath := getenv("MESHPROXY_POLICY", "policy.json")
+	if policies, err = newPolicyEngine(policyPath); err != nil {
+		log.Fatalf("[meshproxy] policy: %v", err)
+	}
+	go policies.watch(2 * time.Second)
+	p := policies.current.Load()
+	log.Printf("[meshproxy] policy from %s: %d rules, %s mode", policyPath, len(p.Rules), p.Mode)
+
+	if mode == "inbound" {
+		runInbound(id)
+		return
+	}
+
+	self = me
+	upstreamURL = getenv("MESHPROXY_UPSTREAM", "https://localhost:15006")
+	upstreamID = mtls.ServiceID(getenv("MESHPROXY_UPSTREAM_SERVICE", "ledger"))
+	if !strings.HasPrefix(upstreamURL, "https://") {
+		log.Printf("[meshproxy] warning: %s is not https, requests go out without mTLS", upstreamURL)
+	}
+	retriesPath := getenv("MESHPROXY_RETRIES", "retries.json")
+	if retries, err = loadRetryConfig(retriesPath); err != nil {
+		log.Fatalf("[meshproxy] retries: %v", err)
+	}
+	budget = newRetryBudget(retries.Budget)
+	upstream = &http.Transport{TLSClientConfig: id.ClientTLS(upstreamID), MaxIdleConnsPerHost: 16, IdleConnTimeout: 90 * time.Second}
 	http.HandleFunc("/", handleProxy)
 
-	log.Println("[meshproxy] listening on :15001 (forwarding to", upstreamURL, ")")
-	log.Fatal(http.ListenAndServe(":15001", nil))
+	log.Printf("[meshproxy] forwarding to %s (%s)", upstreamURL, upstreamID)
+	server.Main("meshproxy", ":15001", nil)
+}
+
+// runInbound terminates mTLS in front of the local service.
+func runInbound(id *mtls.Identity) {
+	target, err := url.Parse(getenv("MESHPROXY_UPSTREAM", "http://localhost:7002"))
+	if err != nil {
+		log.Fatalf("[meshproxy] MESHPROXY_UPSTREAM: %v", err)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			peer, _ := mtls.PeerID(pr.In.TLS) // checked by handleInbound
+			pr.Out.Header.Set("X-Service-Identity", peer)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[meshproxy] %s %s: %v", r.Method, r.URL.Path, err)
+			proxyError(w, http.StatusBadGateway, "upstream_unreachable")
+		},
+	}
+	http.Handle("/", handleInbound(id.ID(), proxy))
+
+	cfg, err := server.FromEnv("meshproxy", ":15006")
+	if err != nil {
+		log.Fatalf("[meshproxy] %v", err)
+	}
+	cfg.TLS = id.ServerTLS()
+	log.Printf("[meshproxy] accepting mTLS for %s", target)
+	if err := server.Run(cfg, nil); err != nil {
+		log.Fatalf("[meshproxy] %v", err)
+	}
+}
+
+// handleInbound lets through callers with a verified certificate that the
+// policy allows to call this service.
+func handleInbound(self string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := mtls.PeerID(r.TLS)
+		if !ok {
+			proxyError(w, http.StatusUnauthorized, "client_certificate_required")
+			return
+		}
+		if !policies.authorize(w, r, peer, self) {
+			return
+		}
+		log.Printf("[meshproxy] %s %s from %s", r.Method, r.URL.Path, peer)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func logRenewal(id string, notAfter time.Time, err error) {
+	if err != nil {
+		log.Printf("[meshproxy] certificate renewal for %s failed, retrying in %s: %v", id, mtls.RetryDelay, err)
+		return
+	}
+	log.Printf("[meshproxy] certificate for %s renewed, valid until %s", id, notAfter.Format(time.RFC3339))
 }
 
 func handleProxy(w http.ResponseWriter, r *http.Request) {
-	totalReq++
+	n := totalReq.Add(1)
+
+	if !policies.authorize(w, r, self, upstreamID) {
+		return
+	}
 
 	traceID := r.Header.Get("X-Request-ID")
 	if traceID == "" {
 		traceID = randomID()
 	}
+	w.Header().Set("X-Request-ID", traceID)
 
-	// Copy body (it may be read multiple times across retries)
-	inBody, _ := io.ReadAll(r.Body)
-	_ = r.Body.Close()
+	route := retries.route(r.Method, r.URL.Path)
+	idempotent := route.idempotent(r)
+	budget.deposit()
 
-	// Build upstream URL (keep the same path)
-	target := upstreamURL + r.URL.Path
+	// Held in memory only if it may be sent again
+	body, err := newRequestBody(r, route.MaxRetries > 0, retries.MaxRetryBody)
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, "unreadable_request_body")
+		return
+	}
 
-	var lastStatus int
-	var lastBody []byte
-	var err error
+	// Build upstream URL (keep the same path and query)
+	target := upstreamURL + r.URL.RequestURI()
 
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		if attempt > 0 {
-			totalRetry++
-			log.Printf("[meshproxy] retry %d for %s (trace=%s)", attempt, target, traceID)
+	for attempt := 0; ; attempt++ {
+		resp, cancel, err := try(r, target, traceID, body, time.Duration(route.PerTryTimeout))
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
 		}
 
-		req, _ := http.NewRequest(r.Method, target, bytes.NewReader(inBody))
-		req.Header = cloneHeaders(r.Header)
-
-		// Mesh adds identity + tracing headers
-		req.Header.Set("X-Request-ID", traceID)
-		req.Header.Set("X-Mesh-mTLS", "true")
-		req.Header.Set("X-Service-Identity", "payments")
-
-		client := &http.Client{Timeout: perTryTimeout}
-		resp, e := client.Do(req)
-		if e != nil {
-			err = e
-			continue // try again
+		retry := route.retriable(status, err) && attempt < route.MaxRetries && r.Context().Err() == nil
+		switch {
+		case !retry:
+		case !body.replayable():
+			log.Printf("[meshproxy] not retrying %s %s: request body over %d bytes (trace=%s)", r.Method, target, retries.MaxRetryBody, traceID)
+			retry = false
+		case !idempotent && !notSent(err):
+			log.Printf("[meshproxy] not retrying %s %s: not idempotent (no %s) (trace=%s)", r.Method, target, route.IdempotencyHeader, traceID)
+			retry = false
+		case !budget.withdraw():
+			log.Printf("[meshproxy] not retrying %s %s: retry budget exhausted (trace=%s)", r.Method, target, traceID)
+			retry = false
 		}
 
-		lastStatus = resp.StatusCode
-		lastBody, _ = io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		// Retry on 5xx; otherwise break
-		if lastStatus >= 500 {
-			continue
+		if !retry {
+			if err != nil {
+				cancel()
+				log.Printf("[meshproxy] %s %s failed: %v (trace=%s)", r.Method, target, err, traceID)
+				if errors.Is(err, errTryTimeout) {
+					proxyError(w, http.StatusGatewayTimeout, "upstream_timeout")
+				} else {
+					proxyError(w, http.StatusBadGateway, "upstream_unreachable")
+				}
+				return
+			}
+			err = copyResponse(w, resp)
+			resp.Body.Close()
+			cancel()
+			if err != nil {
+				log.Printf("[meshproxy] %s %s: response cut short: %v (trace=%s)", r.Method, target, err, traceID)
+			}
+			// Tiny metrics line
+			log.Printf("[meshproxy] req=%d retries=%d status=%d trace=%s", n, totalRetry.Load(), status, traceID)
+			return
 		}
 
-		err = nil
-		break
+		if resp != nil {
+			// Drained, so that the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		cancel()
+		wait := route.backoff(attempt)
+		totalRetry.Add(1)
+		log.Printf("[meshproxy] retry %d for %s in %s (trace=%s)", attempt+1, target, wait, traceID)
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+		}
 	}
+}
+
+var errTryTimeout = errors.New("per-try timeout")
 
+// try sends one try upstream. The per-try timeout runs until the response
+// headers arrive; the body then streams for as long as it takes. cancel
+// must be called once the response is done with.
+func try(r *http.Request, target, traceID string, body *requestBody, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	ctx, cancelCause := context.WithCancelCause(r.Context())
+	cancel := func() { cancelCause(context.Canceled) }
+	timer := time.AfterFunc(timeout, func() { cancelCause(errTryTimeout) })
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, target, body.reader())
 	if err != nil {
-		http.Error(w, `{"error":"upstream_timeout_or_unreachable"}`, http.StatusBadGateway)
-		return
+		return nil, cancel, err
 	}
+	req.ContentLength = body.length
+	req.Header = outboundHeaders(r)
 
-	// Pass back upstream response
-	w.Header().Set("X-Request-ID", traceID)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(lastStatus)
-	w.Write(lastBody)
+	// Mesh adds tracing headers; identity is the client certificate
+	req.Header.Set("X-Request-ID", traceID)
 
-	// Tiny metrics line
-	log.Printf("[meshproxy] req=%d retries=%d status=%d trace=%s", totalReq, totalRetry, lastStatus, traceID)
+	resp, err := upstream.RoundTrip(req)
+	if !timer.Stop() && context.Cause(ctx) == errTryTimeout {
+		// Timed out, even if the headers made it just in time: the body
+		// can't be read anymore
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, cancel, errTryTimeout
+	}
+	if err != nil {
+		return nil, cancel, err
+	}
+	return resp, cancel, nil
 }
 
 func randomID() string {
@@ -113,12 +298,9 @@ func randomID() string {
 	return hex.EncodeToString(b[:])
 }
 
-func cloneHeaders(h http.Header) http.Header {
-	out := http.Header{}
-	for k, vv := range h {
-		for _, v := range vv {
-			out.Add(k, v)
-		}
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	return out
-}
\ No newline at end of file
+	return def
+}
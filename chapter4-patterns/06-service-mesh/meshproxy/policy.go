@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"patterns/internal/mtls"
+	"patterns/internal/watch"
+)
+
+/*
+Authorization policies:
+
+- Rules from MESHPROXY_POLICY (default policy.json) say which source
+  identity may call which destination identity, method and path
+- Checked before anything is sent upstream: outbound with this sidecar as
+  the source, inbound with the caller's verified identity as the source
+- A matching deny rule wins; otherwise a matching allow rule allows;
+  otherwise the request is denied ("default_deny")
+- "mode": "audit" is a dry run: requests that would be denied are logged
+  and let through. "enforce" (the default) answers them 403
+- The file is reloaded when it changes (or on SIGHUP); a broken file is
+  logged and the previous policy stays in force
+*/
+
+type policyRule struct {
+	Name         string   `json:"name"`
+	Action       string   `json:"action"`                 // allow or deny
+	Sources      []string `json:"sources,omitempty"`      // SPIFFE IDs, or service names; empty: any
+	Destinations []string `json:"destinations,omitempty"` // same
+	Methods      []string `json:"methods,omitempty"`      // empty: any
+	Paths        []string `json:"paths,omitempty"`        // exact, or a prefix ending in "*"; empty: any
+}
+
+type policy struct {
+	Mode  string       `json:"mode"` // enforce or audit
+	Rules []policyRule `json:"rules"`
+}
+
+func parsePolicy(data []byte) (*policy, error) {
+	var p policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields() // a misspelt field would silently match more
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	switch p.Mode {
+	case "":
+		p.Mode = "enforce"
+	case "enforce", "audit":
+	default:
+		return nil, fmt.Errorf("unknown mode %q (want enforce or audit)", p.Mode)
+	}
+	seen := map[string]bool{}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		switch {
+		case r.Name == "":
+			return nil, fmt.Errorf("rule %d: no name", i)
+		case seen[r.Name]:
+			return nil, fmt.Errorf("rule %q: duplicate name", r.Name)
+		case r.Action != "allow" && r.Action != "deny":
+			return nil, fmt.Errorf("rule %q: unknown action %q (want allow or deny)", r.Name, r.Action)
+		}
+		seen[r.Name] = true
+		for _, ids := range [][]string{r.Sources, r.Destinations} {
+			for j, id := range ids {
+				if !strings.Contains(id, "://") {
+					id = mtls.ServiceID(id)
+				}
+				if _, err := mtls.ParseID(id); err != nil {
+					return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+				}
+				ids[j] = id
+			}
+		}
+		for _, path := range r.Paths {
+			if !validPathPattern(path) {
+				return nil, fmt.Errorf("rule %q: path %q: want /exact or /prefix*", r.Name, path)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func (r *policyRule) matches(source, destination, method, path string) bool {
+	return listed(r.Sources, source) &&
+		listed(r.Destinations, destination) &&
+		(len(r.Methods) == 0 || containsFold(r.Methods, method)) &&
+		pathListed(r.Paths, path)
+}
+
+// listed reports whether v is in list; an empty list allows anything.
+func listed(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPathPattern reports whether p is a path, or a path prefix followed
+// by "*".
+func validPathPattern(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.Contains(strings.TrimSuffix(p, "*"), "*")
+}
+
+func pathListed(patterns []string, path string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); (ok && strings.HasPrefix(path, prefix)) || p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate returns whether the request is allowed, and by which rule
+// ("default_deny" when none matched).
+func (p *policy) evaluate(source, destination, method, path string) (allowed bool, rule string) {
+	for _, r := range p.Rules {
+		if !r.matches(source, destination, method, path) {
+			continue
+		}
+		if r.Action == "deny" {
+			return false, r.Name
+		}
+		if rule == "" {
+			rule = r.Name // keep looking: a later deny still wins
+		}
+	}
+	if rule != "" {
+		return true, rule
+	}
+	return false, "default_deny"
+}
+
+// policyEngine holds the current policy.
+type policyEngine struct {
+	file    *watch.File
+	current atomic.Pointer[policy]
+}
+
+func newPolicyEngine(path string) (*policyEngine, error) {
+	e := &policyEngine{file: watch.NewFile(path)}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// authorize checks a request against the policy. When it is denied (and the
+// policy is enforced) it answers 403 and returns false.
+func (e *policyEngine) authorize(w http.ResponseWriter, r *http.Request, source, destination string) bool {
+	p := e.current.Load()
+	allowed, rule := p.evaluate(source, destination, r.Method, r.URL.Path)
+	if allowed {
+		return true
+	}
+	if p.Mode == "audit" {
+		log.Printf("[meshproxy] policy audit: would deny %s %s from %s to %s (%s)", r.Method, r.URL.Path, source, destination, rule)
+		return true
+	}
+	log.Printf("[meshproxy] policy: denied %s %s from %s to %s (%s)", r.Method, r.URL.Path, source, destination, rule)
+	proxyError(w, http.StatusForbidden, "denied_by_policy")
+	return false
+}
+
+func (e *policyEngine) reload() error {
+	data, err := e.file.Read()
+	if err != nil {
+		return err
+	}
+	p, err := parsePolicy(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.file.Path(), err)
+	}
+	e.current.Store(p)
+	return nil
+}
+
+// watch reloads the policy on SIGHUP or when the file changes on disk.
+// It blocks, so run it in its own goroutine.
+func (e *policyEngine) watch(interval time.Duration) {
+	e.file.Watch(interval, e.reloadAndLog)
+}
+
+func (e *policyEngine) reloadAndLog(why string) {
+	if err := e.reload(); err != nil {
+		log.Printf("[meshproxy] policy reload (%s) failed, keeping previous policy: %v", why, err)
+		return
+	}
+	p := e.current.Load()
+	log.Printf("[meshproxy] policy reloaded (%s): %d rules, %s mode", why, len(p.Rules), p.Mode)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"patterns/internal/mtls"
+)
+
+func mustPolicies(t *testing.T, data string) *policyEngine {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newPolicyEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	e := mustPolicies(t, `{"rules": [
+		{"name": "no_admin", "action": "deny", "paths": ["/ledger/admin*"]},
+		{"name": "payments_debit", "action": "allow", "sources": ["payments"], "destinations": ["ledger"], "methods": ["post"], "paths": ["/ledger/debit"]},
+		{"name": "reports_read", "action": "allow", "sources": ["spiffe://mesh.local/ns/default/sa/reports"], "methods": ["GET"], "paths": ["/ledger/*"]}]}`)
+	payments, reports, ledger := mtls.ServiceID("payments"), mtls.ServiceID("reports"), mtls.ServiceID("ledger")
+	for _, tc := range []struct {
+		source, destination, method, path string
+		allowed                           bool
+		rule                              string
+	}{
+		{payments, ledger, "POST", "/ledger/debit", true, "payments_debit"},
+		{payments, ledger, "GET", "/ledger/debit", false, "default_deny"},
+		{payments, ledger, "POST", "/ledger/debit/x", false, "default_deny"},
+		{payments, mtls.ServiceID("risk"), "POST", "/ledger/debit", false, "default_deny"},
+		{reports, ledger, "POST", "/ledger/debit", false, "default_deny"},
+		{reports, ledger, "GET", "/ledger/balance", true, "reports_read"},
+		{reports, ledger, "GET", "/ledger/admin/users", false, "no_admin"},
+	} {
+		allowed, rule := e.current.Load().evaluate(tc.source, tc.destination, tc.method, tc.path)
+		if allowed != tc.allowed || rule != tc.rule {
+			t.Errorf("%s %s %s -> %s: got %v (%s), want %v (%s)", tc.method, tc.path, tc.source, tc.destination, allowed, rule, tc.allowed, tc.rule)
+		}
+	}
+}
+
+func TestPolicyModes(t *testing.T) {
+	req := httptest.NewRequest("DELETE", "/ledger/debit", nil)
+	for mode, want := range map[string]bool{"enforce": false, "audit": true} {
+		e := mustPolicies(t, `{"mode": "`+mode+`", "rules": [{"name": "debit", "action": "allow", "methods": ["POST"]}]}`)
+		w := httptest.NewRecorder()
+		if got := e.authorize(w, req, mtls.ServiceID("payments"), mtls.ServiceID("ledger")); got != want {
+			t.Errorf("%s: authorized %v", mode, got)
+		}
+		if !want && w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d", mode, w.Code)
+		}
+	}
+}
+
+func TestPolicyRejects(t *testing.T) {
+	for _, data := range []string{
+		`{"mode": "dry"}`,
+		`{"rules": [{"name": "a", "action": "permit"}]}`,
+		`{"rules": [{"name": "a", "action": "allow"}, {"name": "a", "action": "deny"}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "sources": ["spiffe://other.domain/sa/x"]}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "paths": ["/a*/b"]}]}`,
+		`{"rules": [{"name": "a", "action": "allow", "source": ["payments"]}]}`,
+	} {
+		if _, err := parsePolicy([]byte(data)); err == nil {
+			t.Errorf("accepted %s", data)
+		}
+	}
+}
+
+func TestPolicyReloadKeepsPreviousOnError(t *testing.T) {
+	e := mustPolicies(t, `{"rules": [{"name": "a", "action": "allow"}]}`)
+	if err := os.WriteFile(e.file.Path(), []byte(`{"rules": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.reload(); err == nil {
+		t.Fatal("reloaded a broken file")
+	}
+	if allowed, _ := e.current.Load().evaluate("x", "y", "GET", "/"); !allowed {
+		t.Error("lost the previous policy")
+	}
+}
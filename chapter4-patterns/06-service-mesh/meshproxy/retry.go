@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Retry policies (outbound):
+
+- Routes from MESHPROXY_RETRIES (default retries.json) say how requests are
+  retried. The first route whose path and methods match applies; a request
+  no route matches is tried once
+- Only idempotent requests are retried: GET, HEAD, OPTIONS, PUT, DELETE, or
+  any request carrying the route's idempotency header (default
+  Idempotency-Key). A connection that couldn't be opened is retried
+  whatever the method: nothing was sent
+- A try fails on a status in retry_on (default 502, 503, 504), on its
+  per-try timeout, or on a connection error
+- The wait before retry n (from 0) is random between 0 and
+  min(max_backoff, base_backoff * 2^n): exponential backoff, full jitter
+- Retries come out of one budget for the upstream cluster, whatever the
+  route: every request adds ratio (default 0.2) of a retry, so that retries
+  stay under 20% of requests, on top of a burst (default 10). When the
+  upstream is down, that keeps the sidecars from multiplying its load
+*/
+
+// duration is a time.Duration written as a string in JSON ("300ms").
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type retryRoute struct {
+	Path              string   `json:"path"`                         // exact, or a prefix ending in "*"
+	Methods           []string `json:"methods,omitempty"`            // empty: any
+	MaxRetries        int      `json:"max_retries"`                  // 0: tried once
+	RetryOn           []int    `json:"retry_on,omitempty"`           // statuses worth another try
+	IdempotencyHeader string   `json:"idempotency_header,omitempty"` // makes any method retriable
+	PerTryTimeout     duration `json:"per_try_timeout,omitempty"`
+	BaseBackoff       duration `json:"base_backoff,omitempty"`
+	MaxBackoff        duration `json:"max_backoff,omitempty"`
+}
+
+type retryBudgetConfig struct {
+	Ratio float64 `json:"ratio"` // retries per request
+	Burst float64 `json:"burst"` // retries available before any request
+}
+
+type retryConfig struct {
+	Budget       retryBudgetConfig `json:"budget"`
+	MaxRetryBody int64             `json:"max_retry_body"` // bytes of request body held for retries
+	Routes       []retryRoute      `json:"routes"`
+}
+
+// noRetries applies to requests no route matches.
+var noRetries = retryRoute{Path: "/*", PerTryTimeout: duration(perTryTimeout)}
+
+func parseRetryConfig(data []byte) (*retryConfig, error) {
+	c := retryConfig{Budget: retryBudgetConfig{Ratio: 0.2, Burst: 10}, MaxRetryBody: 64 << 10}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	if c.Budget.Ratio < 0 || c.Budget.Ratio > 1 || c.Budget.Burst < 0 {
+		return nil, fmt.Errorf("budget: want a ratio in [0, 1] and a burst >= 0")
+	}
+	if c.MaxRetryBody < 0 {
+		return nil, fmt.Errorf("max_retry_body %d is negative", c.MaxRetryBody)
+	}
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		if r.IdempotencyHeader == "" {
+			r.IdempotencyHeader = "Idempotency-Key"
+		}
+		if len(r.RetryOn) == 0 {
+			r.RetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+		}
+		if r.PerTryTimeout == 0 {
+			r.PerTryTimeout = duration(perTryTimeout)
+		}
+		if r.BaseBackoff == 0 {
+			r.BaseBackoff = duration(25 * time.Millisecond)
+		}
+		if r.MaxBackoff == 0 {
+			r.MaxBackoff = duration(250 * time.Millisecond)
+		}
+		switch {
+		case !validPathPattern(r.Path):
+			return nil, fmt.Errorf("route %d: path %q: want /exact or /prefix*", i, r.Path)
+		case r.MaxRetries < 0 || r.MaxRetries > 10:
+			return nil, fmt.Errorf("route %s: max_retries %d is not in 0-10", r.Path, r.MaxRetries)
+		case r.PerTryTimeout < 0 || r.BaseBackoff < 0 || r.MaxBackoff < r.BaseBackoff:
+			return nil, fmt.Errorf("route %s: want positive timeouts and base_backoff <= max_backoff", r.Path)
+		}
+		for _, s := range r.RetryOn {
+			if s < 100 || s > 599 {
+				return nil, fmt.Errorf("route %s: %d is not an HTTP status", r.Path, s)
+			}
+		}
+	}
+	return &c, nil
+}
+
+func loadRetryConfig(path string) (*retryConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseRetryConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// route is the policy for a request.
+func (c *retryConfig) route(method, path string) *retryRoute {
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		if pathListed([]string{r.Path}, path) && (len(r.Methods) == 0 || containsFold(r.Methods, method)) {
+			return r
+		}
+	}
+	return &noRetries
+}
+
+// idempotent reports whether sending r twice does no more than sending it
+// once.
+func (rt *retryRoute) idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get(rt.IdempotencyHeader) != ""
+}
+
+// retriable reports whether a try's outcome is worth another try.
+func (rt *retryRoute) retriable(status int, err error) bool {
+	if err != nil {
+		return true // timeout or connection error
+	}
+	for _, s := range rt.RetryOn {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is the wait before retry n (from 0), with full jitter.
+func (rt *retryRoute) backoff(n int) time.Duration {
+	ceiling := math.Min(float64(rt.MaxBackoff), float64(rt.BaseBackoff)*math.Pow(2, float64(n)))
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// notSent reports whether err means the request never left: the
+// connection couldn't be opened.
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// retryBudget is a token bucket: every request deposits ratio, every retry
+// withdraws 1, so retries stay under ratio of the requests.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	max    float64
+}
+
+func newRetryBudget(c retryBudgetConfig) *retryBudget {
+	return &retryBudget{tokens: c.Burst, ratio: c.Ratio, max: math.Max(c.Burst, 1)}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
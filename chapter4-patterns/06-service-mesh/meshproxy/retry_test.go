@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mustRetries(t *testing.T, data string) *retryConfig {
+	t.Helper()
+	c, err := parseRetryConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetryRoutes(t *testing.T) {
+	c := mustRetries(t, `{"routes": [
+		{"path": "/ledger/debit", "methods": ["POST"], "max_retries": 2, "retry_on": [500, 503]},
+		{"path": "/ledger/*", "max_retries": 1}]}`)
+	debit := c.route("POST", "/ledger/debit")
+	if debit.MaxRetries != 2 || debit.IdempotencyHeader != "Idempotency-Key" || time.Duration(debit.PerTryTimeout) != perTryTimeout {
+		t.Fatalf("debit route %+v", debit)
+	}
+	if r := c.route("GET", "/ledger/debit"); r.MaxRetries != 1 {
+		t.Errorf("GET debit: %+v", r)
+	}
+	if r := c.route("GET", "/other"); r != &noRetries {
+		t.Errorf("unmatched: %+v", r)
+	}
+
+	if !debit.retriable(500, nil) || debit.retriable(502, nil) || !debit.retriable(0, http.ErrHandlerTimeout) {
+		t.Error("retriable")
+	}
+	post := httptest.NewRequest("POST", "/ledger/debit", nil)
+	if debit.idempotent(post) {
+		t.Error("POST without a key is idempotent")
+	}
+	post.Header.Set("Idempotency-Key", "k1")
+	if !debit.idempotent(post) || !debit.idempotent(httptest.NewRequest("PUT", "/x", nil)) {
+		t.Error("not idempotent")
+	}
+}
+
+func TestBackoffFullJitter(t *testing.T) {
+	r := retryRoute{BaseBackoff: duration(10 * time.Millisecond), MaxBackoff: duration(50 * time.Millisecond)}
+	for n, ceiling := range []time.Duration{10, 20, 40, 50, 50} {
+		ceiling *= time.Millisecond
+		var max time.Duration
+		for i := 0; i < 500; i++ {
+			d := r.backoff(n)
+			if d < 0 || d > ceiling {
+				t.Fatalf("retry %d: waited %s, ceiling %s", n, d, ceiling)
+			}
+			if d > max {
+				max = d
+			}
+		}
+		if max < ceiling/2 {
+			t.Errorf("retry %d: longest wait %s of %s: not jittered over the whole range", n, max, ceiling)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(retryBudgetConfig{Ratio: 0.2, Burst: 2})
+	retries := 0
+	for i := 0; i < 100; i++ {
+		b.deposit()
+		for b.withdraw() {
+			retries++
+		}
+	}
+	if retries < 21 || retries > 22 { // the burst, then 1 in 5
+		t.Errorf("%d retries for 100 requests", retries)
+	}
+}
+
+func TestRetryConfigRejects(t *testing.T) {
+	for _, data := range []string{
+		`{"budget": {"ratio": 2}}`,
+		`{"max_retry_body": -1}`,
+		`{"routes": [{"path": "ledger"}]}`,
+		`{"routes": [{"path": "/a", "max_retries": -1}]}`,
+		`{"routes": [{"path": "/a", "retry_on": [42]}]}`,
+		`{"routes": [{"path": "/a", "base_backoff": "1s", "max_backoff": "10ms"}]}`,
+		`{"routes": [{"path": "/a", "retries": 2}]}`,
+	} {
+		if _, err := parseRetryConfig([]byte(data)); err == nil {
+			t.Errorf("accepted %s", data)
+		}
+	}
+}
+
+// proxyTo points the outbound proxy at a test upstream, with every request
+// allowed.
+func proxyTo(t *testing.T, h http.HandlerFunc, retryConfig string) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	upstreamURL, upstream = srv.URL, srv.Client().Transport
+	policies = mustPolicies(t, `{"rules": [{"name": "all", "action": "allow"}]}`)
+	retries = mustRetries(t, retryConfig)
+	budget = newRetryBudget(retries.Budget)
+}
+
+func TestProxyRetries(t *testing.T) {
+	var tries atomic.Int32
+	proxyTo(t, func(w http.ResponseWriter, r *http.Request) {
+		if tries.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"posted"}`))
+	}, `{"routes": [{"path": "/*", "max_retries": 2, "base_backoff": "1ms", "max_backoff": "2ms"}]}`)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		tries.Store(0)
+		req := httptest.NewRequest("POST", "/ledger/debit", strings.NewReader(`{}`))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handleProxy(w, req)
+		return w
+	}
+
+	if w := send(""); w.Code != http.StatusServiceUnavailable || tries.Load() != 1 {
+		t.Errorf("POST without a key: status %d after %d tries, want 503 after 1", w.Code, tries.Load())
+	}
+	if w := send("k1"); w.Code != http.StatusOK || tries.Load() != 3 {
+		t.Errorf("POST with a key: status %d after %d tries, want 200 after 3", w.Code, tries.Load())
+	}
+}
+
+func TestProxyRetryBudget(t *testing.T) {
+	var tries atomic.Int32
+	proxyTo(t, func(w http.ResponseWriter, r *http.Request) {
+		tries.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, `{"budget": {"ratio": 0.2, "burst": 0},
+		"routes": [{"path": "/*", "max_retries": 3, "base_backoff": "1ms", "max_backoff": "1ms"}]}`)
+
+	for i := 0; i < 50; i++ {
+		handleProxy(httptest.NewRecorder(), httptest.NewRequest("GET", "/ledger/balance", nil))
+	}
+	// Without a budget, a dead upstream would get 4 tries per request.
+	if retried := tries.Load() - 50; retried < 9 || retried > 10 {
+		t.Errorf("%d retries for 50 requests, want 20%%", retried)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+Streaming (outbound):
+
+- The response of the try that is kept is streamed to the caller as it
+  arrives: status, headers, body and trailers, Content-Type included.
+  Responses of unknown length (chunked, e.g. server-sent events) are
+  flushed after every read
+- Hop-by-hop headers (Connection and the headers it names, Keep-Alive,
+  Transfer-Encoding, ...) are per connection: they are dropped both ways,
+  except "TE: trailers"
+- A request body is held in memory only when the request may be retried
+  and it is at most max_retry_body bytes (retries.json, default 64KiB);
+  otherwise it is streamed upstream once, and the request isn't retried
+*/
+
+// Hop-by-hop headers, RFC 9110 7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the headers meant for one connection only.
+func removeHopByHop(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// outboundHeaders are the headers of r to send upstream.
+func outboundHeaders(r *http.Request) http.Header {
+	h := r.Header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	// "TE: trailers" says the caller can take trailers (gRPC needs it)
+	trailers := false
+	for _, v := range h.Values("Te") {
+		for _, te := range strings.Split(v, ",") {
+			trailers = trailers || strings.EqualFold(strings.TrimSpace(te), "trailers")
+		}
+	}
+	removeHopByHop(h)
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	return h
+}
+
+// requestBody is the body to send on each try.
+type requestBody struct {
+	buffered []byte
+	stream   io.Reader // not buffered: the body can be sent once only
+	length   int64     // for the upstream request's ContentLength (-1: unknown)
+}
+
+// newRequestBody buffers r's body if retriable and it fits in limit bytes.
+// A body of unknown length is read up to the limit to find out.
+func newRequestBody(r *http.Request, retriable bool, limit int64) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return &requestBody{}, nil
+	}
+	if !retriable || r.ContentLength > limit {
+		return &requestBody{stream: r.Body, length: r.ContentLength}, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) > limit {
+		return &requestBody{stream: io.MultiReader(bytes.NewReader(head), r.Body), length: r.ContentLength}, nil
+	}
+	return &requestBody{buffered: head, length: int64(len(head))}, nil
+}
+
+// replayable reports whether the body can be sent again.
+func (b *requestBody) replayable() bool { return b.stream == nil }
+
+// reader returns the body for the next try. Unless the body is
+// replayable, there is only one.
+func (b *requestBody) reader() io.Reader {
+	if b.stream != nil {
+		return b.stream
+	}
+	if b.buffered == nil {
+		return nil
+	}
+	return bytes.NewReader(b.buffered)
+}
+
+// copyResponse streams resp to w, hop-by-hop headers left out, trailers
+// included. The status line is already sent when it returns an error.
+func copyResponse(w http.ResponseWriter, resp *http.Response) error {
+	removeHopByHop(resp.Header)
+	h := w.Header()
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	announced := len(resp.Trailer)
+	for k := range resp.Trailer {
+		h.Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	if resp.ContentLength != -1 {
+		flusher = nil // known length: let the server buffer the writes
+	}
+	if err := copyBody(w, resp.Body, flusher); err != nil {
+		return err
+	}
+
+	for k, vv := range resp.Trailer {
+		if len(resp.Trailer) != announced {
+			// Trailers the upstream didn't announce can only be sent with
+			// the TrailerPrefix.
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	return nil
+}
+
+func copyBody(w io.Writer, body io.Reader, flusher http.Flusher) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return fmt.Errorf("writing to the caller: %w", werr)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading from upstream: %w", err)
+		}
+	}
+}
+
+// proxyError answers an error of the mesh itself, as JSON.
+func proxyError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "{\"error\":%q}\n", code)
+}
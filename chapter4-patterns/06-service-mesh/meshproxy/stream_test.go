@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyKeepsResponse(t *testing.T) {
+	proxyTo(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "account=a1" || r.Header.Get("X-Custom") != "yes" || r.Header.Get("X-Hop") != "" || r.Header.Get("Te") != "trailers" {
+			t.Errorf("upstream got %s with %v", r.URL, r.Header)
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "dropped")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, "id,amount\n")
+		w.Header().Set("X-Checksum", "c0ffee")
+	}, `{}`)
+
+	req := httptest.NewRequest("GET", "/ledger/export?account=a1", nil)
+	req.Header.Set("X-Custom", "yes")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	req.Header.Set("Te", "trailers, deflate")
+	w := httptest.NewRecorder()
+	handleProxy(w, req)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusPartialContent || w.Body.String() != "id,amount\n" {
+		t.Fatalf("status %d, body %q", res.StatusCode, w.Body)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if got := res.Header.Values("Set-Cookie"); len(got) != 2 || res.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("headers %v", res.Header)
+	}
+	if res.Header.Get("X-Internal") != "" || res.Header.Get("Connection") != "" {
+		t.Errorf("hop-by-hop headers passed on: %v", res.Header)
+	}
+	if res.Header.Get("X-Request-ID") == "" {
+		t.Error("no X-Request-ID")
+	}
+	if got := res.Trailer.Get("X-Checksum"); got != "c0ffee" {
+		t.Errorf("trailer X-Checksum %q", got)
+	}
+}
+
+// flushRecorder records when the body was flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (f *flushRecorder) Flush() {
+	f.ResponseRecorder.Flush()
+	f.flushed <- f.Body.String()
+}
+
+func TestProxyStreamsResponse(t *testing.T) {
+	next := make(chan struct{})
+	proxyTo(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "data: 2\n\n")
+	}, `{}`)
+
+	w := &flushRecorder{httptest.NewRecorder(), make(chan string, 4)}
+	done := make(chan struct{})
+	go func() {
+		handleProxy(w, httptest.NewRequest("GET", "/ledger/events", nil))
+		close(done)
+	}()
+	select {
+	case got := <-w.flushed:
+		if got != "data: 1\n\n" {
+			t.Errorf("first flush %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event not passed on before the upstream finished")
+	}
+	close(next)
+	<-done
+	if w.Body.String() != "data: 1\n\ndata: 2\n\n" || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("body %q, Content-Type %q", w.Body, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestProxyRetriesOnlySmallBodies(t *testing.T) {
+	var tries atomic.Int32
+	proxyTo(t, func(w http.ResponseWriter, r *http.Request) {
+		tries.Add(1)
+		if b, _ := io.ReadAll(r.Body); len(b) == 0 {
+			t.Errorf("try %d without a body", tries.Load())
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, `{"max_retry_body": 16, "routes": [{"path": "/*", "max_retries": 2, "base_backoff": "1ms", "max_backoff": "1ms"}]}`)
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		length int64
+		tries  int32
+	}{
+		{"small", `{"amount":1}`, 12, 3},
+		{"small, unknown length", `{"amount":1}`, -1, 3},
+		{"large", strings.Repeat("x", 17), 17, 1},
+		{"large, unknown length", strings.Repeat("x", 40), -1, 1},
+	} {
+		tries.Store(0)
+		req := httptest.NewRequest("PUT", "/ledger/import", io.NopCloser(strings.NewReader(tc.body)))
+		req.ContentLength = tc.length
+		w := httptest.NewRecorder()
+		handleProxy(w, req)
+		if w.Code != http.StatusServiceUnavailable || tries.Load() != tc.tries {
+			t.Errorf("%s: status %d after %d tries, want 503 after %d", tc.name, w.Code, tries.Load(), tc.tries)
+		}
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	proxyTo(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}, `{"routes": [{"path": "/*", "per_try_timeout": "10ms"}]}`)
+	w := httptest.NewRecorder()
+	handleProxy(w, httptest.NewRequest("GET", "/ledger/balance", nil))
+	if w.Code != http.StatusGatewayTimeout || w.Header().Get("Content-Type") != "application/json" || !strings.Contains(w.Body.String(), "upstream_timeout") {
+		t.Errorf("slow upstream: %d %q", w.Code, w.Body)
+	}
+
+	upstreamURL = "http://127.0.0.1:1"
+	w = httptest.NewRecorder()
+	handleProxy(w, httptest.NewRequest("GET", "/ledger/balance", nil))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "upstream_unreachable") {
+		t.Errorf("no upstream: %d %q", w.Code, w.Body)
+	}
+}
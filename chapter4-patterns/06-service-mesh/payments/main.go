@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"log"
 	"net/http"
 	"time"
+
+	"patterns/internal/server"
 )
 
 /*
@@ -13,6 +16,8 @@ payments exposes POST /pay
 - Parses a simple payment request
 - Calls the local mesh proxy (http://localhost:15001/ledger/debit)
 - Does not implement retries/TLS/tracing (the mesh does that)
+- Sends an Idempotency-Key (the client's, or a new one), so that the mesh
+  may retry the debit and the ledger posts it only once
 */
 
 type PayRequest struct {
@@ -32,8 +37,7 @@ type LedgerResult struct {
 func main() {
 	http.HandleFunc("/pay", handlePay)
 
-	log.Println("[payments] listening on :9000")
-	log.Fatal(http.ListenAndServe(":9000", nil))
+	server.Main("payments", ":9000", nil)
 }
 
 func handlePay(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +51,11 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 	body, _ := json.Marshal(req)
 	httpReq, _ := http.NewRequest("POST", "http://localhost:15001/ledger/debit", bytes.NewReader(body))
 	httpReq.Header.Set("Content-Type", "application/json")
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = randomKey()
+	}
+	httpReq.Header.Set("Idempotency-Key", key)
 
 	// Small client timeout; mesh will do its own per-try timeout & retries.
 	client := &http.Client{Timeout: 2 * time.Second}
@@ -64,4 +73,10 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 	_, _ = buf.ReadFrom(resp.Body)
 	_, _ = w.Write(buf.Bytes())
-}
\ No newline at end of file
+}
+
+func randomKey() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"patterns/internal/watch"
+)
+
+/*
+	Fallback rules (degraded mode):
+
+- While Risk is unavailable, payments are decided by rules from
+  PAYMENTS_FALLBACK_RULES (default fallback.json)
+- Rules are tried in order; the first that matches decides, and its name
+  is the decision's reason. No match -> hold ("no_fallback_rule")
+- A payment whose amount isn't positive is declined ("invalid_amount")
+  before any rule is tried; it would otherwise lower the daily total
+- So is one without a user ID ("missing_user_id"): anonymous payments
+  would all share one daily total
+- A rule can match on merchant, currency, user tier, the payment amount
+  and the user's daily total: what was already approved in fallback mode
+  today (UTC), plus this payment
+- The tier comes from the file's user_tiers, never from the request, so a
+  caller can't claim a higher one; users not listed are "standard"
+- The file is reloaded when it changes (or on SIGHUP); a broken file is
+  logged and the previous rules stay in force
+*/
+
+type fallbackRule struct {
+	Name       string   `json:"name"`
+	Merchants  []string `json:"merchants,omitempty"`  // merchant IDs; empty: any
+	Currencies []string `json:"currencies,omitempty"` // ISO codes; empty: any
+	Tiers      []string `json:"tiers,omitempty"`      // user tiers; empty: any
+	MaxAmount  float64  `json:"max_amount,omitempty"` // payment amount at most this; 0: no limit
+	MaxDaily   float64  `json:"max_daily,omitempty"`  // daily total with this payment at most this; 0: no limit
+	Action     string   `json:"action"`               // approve, challenge, decline or hold
+}
+
+type fallbackPolicy struct {
+	Rules     []fallbackRule    `json:"rules"`
+	UserTiers map[string]string `json:"user_tiers,omitempty"` // user ID -> tier
+}
+
+// tier is the user's tier as the rules file records it.
+func (p *fallbackPolicy) tier(userID string) string {
+	if t, ok := p.UserTiers[userID]; ok && t != "" {
+		return t
+	}
+	return "standard"
+}
+
+func parseFallbackPolicy(data []byte) (*fallbackPolicy, error) {
+	var p fallbackPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i, r := range p.Rules {
+		switch {
+		case r.Name == "":
+			return nil, fmt.Errorf("rule %d: no name", i)
+		case seen[r.Name]:
+			return nil, fmt.Errorf("rule %q: duplicate name", r.Name)
+		case r.MaxAmount < 0 || r.MaxDaily < 0:
+			return nil, fmt.Errorf("rule %q: negative limit", r.Name)
+		}
+		switch r.Action {
+		case "approve", "challenge", "decline", "hold":
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q (want approve, challenge, decline or hold)", r.Name, r.Action)
+		}
+		seen[r.Name] = true
+	}
+	return &p, nil
+}
+
+func (r *fallbackRule) matches(in PayReq, tier string, dailyTotal float64) bool {
+	return listed(r.Merchants, in.MerchantID) &&
+		listed(r.Currencies, in.Currency) &&
+		listed(r.Tiers, tier) &&
+		(r.MaxAmount == 0 || in.Amount <= r.MaxAmount) &&
+		(r.MaxDaily == 0 || dailyTotal+in.Amount <= r.MaxDaily)
+}
+
+// listed reports whether v is in list; an empty list allows anything.
+func listed(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackEngine holds the current rules and the per-user daily totals.
+type fallbackEngine struct {
+	file    *watch.File
+	current atomic.Pointer[fallbackPolicy]
+
+	mu     sync.Mutex
+	day    string             // UTC date the totals are for
+	totals map[string]float64 // user ID -> amount approved in fallback mode that day
+}
+
+func newFallbackEngine(path string) (*fallbackEngine, error) {
+	e := &fallbackEngine{file: watch.NewFile(path), totals: map[string]float64{}}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// decide applies the first matching rule. Approvals (and challenges) are
+// added to the user's daily total in the same step, so concurrent small
+// payments can't all pass under the cap.
+func (e *fallbackEngine) decide(in PayReq, now time.Time) Decision {
+	policy := e.current.Load()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != e.day {
+		e.day, e.totals = day, map[string]float64{}
+	}
+	total := e.totals[in.UserID]
+
+	if !(in.Amount > 0) {
+		return Decision{Mode: "fallback", Reason: "invalid_amount"}
+	}
+	if strings.TrimSpace(in.UserID) == "" {
+		return Decision{Mode: "fallback", Reason: "missing_user_id"}
+	}
+	d := Decision{Mode: "fallback", Reason: "no_fallback_rule"}
+	tier := policy.tier(in.UserID)
+	for _, r := range policy.Rules {
+		if !r.matches(in, tier, total) {
+			continue
+		}
+		d.Reason = r.Name
+		d.Approved = r.Action == "approve" || r.Action == "challenge"
+		if d.Approved {
+			e.totals[in.UserID] = total + in.Amount
+		}
+		break
+	}
+	return d
+}
+
+func (e *fallbackEngine) reload() error {
+	data, err := e.file.Read()
+	if err != nil {
+		return err
+	}
+	p, err := parseFallbackPolicy(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.file.Path(), err)
+	}
+	e.current.Store(p)
+	return nil
+}
+
+// watch reloads the rules on SIGHUP or when the file changes on disk.
+// It blocks, so run it in its own goroutine.
+func (e *fallbackEngine) watch(interval time.Duration) {
+	e.file.Watch(interval, e.reloadAndLog)
+}
+
+func (e *fallbackEngine) reloadAndLog(why string) {
+	if err := e.reload(); err != nil {
+		log.Printf("[payments] fallback rules reload (%s) failed, keeping previous rules: %v", why, err)
+		return
+	}
+	log.Printf("[payments] fallback rules reloaded (%s): %d rules", why, len(e.current.Load().Rules))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustFallbacks(t *testing.T, rules string) *fallbackEngine {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fallback.json")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newFallbackEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestFallbackRules(t *testing.T) {
+	e := mustFallbacks(t, `{"rules": [
+		{"name": "blocked", "merchants": ["m_bad"], "action": "decline"},
+		{"name": "gold", "tiers": ["gold"], "currencies": ["USD"], "max_amount": 200, "action": "approve"},
+		{"name": "small", "max_amount": 50, "action": "challenge"},
+		{"name": "hold", "action": "hold"}],
+		"user_tiers": {"b": "gold", "c": "gold", "e": "gold"}}`)
+	now := time.Now()
+	for _, tc := range []struct {
+		in       PayReq
+		reason   string
+		approved bool
+	}{
+		{PayReq{UserID: "a", Amount: 10, MerchantID: "m_bad"}, "blocked", false},
+		{PayReq{UserID: "b", Amount: 150, Currency: "usd"}, "gold", true},
+		{PayReq{UserID: "c", Amount: 150, Currency: "EUR"}, "hold", false},
+		{PayReq{UserID: "d", Amount: 40}, "small", true},
+		{PayReq{UserID: "d", Amount: 150, Currency: "USD"}, "hold", false}, // not gold
+		{PayReq{UserID: "e", Amount: 400, Currency: "USD"}, "hold", false},
+	} {
+		d := e.decide(tc.in, now)
+		if d.Reason != tc.reason || d.Approved != tc.approved || d.Mode != "fallback" {
+			t.Errorf("%+v: got %+v, want %s (approved %v)", tc.in, d, tc.reason, tc.approved)
+		}
+	}
+
+	// A tier in the request body is ignored: d is not gold.
+	var in PayReq
+	if err := json.Unmarshal([]byte(`{"user_id":"d","amount":150,"currency":"USD","tier":"gold"}`), &in); err != nil {
+		t.Fatal(err)
+	}
+	if d := e.decide(in, now); d.Reason != "hold" || d.Approved {
+		t.Errorf("self-declared gold tier: got %+v, want hold", d)
+	}
+
+	empty := mustFallbacks(t, `{"rules": []}`)
+	if d := empty.decide(PayReq{UserID: "a", Amount: 1}, now); d.Reason != "no_fallback_rule" || d.Approved {
+		t.Errorf("no rules: %+v", d)
+	}
+}
+
+func TestFallbackDailyTotal(t *testing.T) {
+	e := mustFallbacks(t, `{"rules": [{"name": "small", "max_amount": 50, "max_daily": 100, "action": "approve"}]}`)
+	day := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+
+	// Many small payments at once: only 100 in total gets through.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	approved := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e.decide(PayReq{UserID: "u1", Amount: 30}, day).Approved {
+				mu.Lock()
+				approved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if approved != 3 {
+		t.Fatalf("approved %d payments of 30 under a daily cap of 100", approved)
+	}
+	if d := e.decide(PayReq{UserID: "u1", Amount: 10}, day); !d.Approved {
+		t.Fatalf("10 more fits under the cap: %+v", d)
+	}
+	if d := e.decide(PayReq{UserID: "u2", Amount: 30}, day); !d.Approved {
+		t.Fatalf("another user has their own total: %+v", d)
+	}
+	if d := e.decide(PayReq{UserID: "u1", Amount: 30}, day.Add(2*time.Hour)); !d.Approved {
+		t.Fatalf("the total starts over the next day: %+v", d)
+	}
+}
+
+func TestFallbackRejectsNonPositiveAmounts(t *testing.T) {
+	e := mustFallbacks(t, `{"rules": [{"name": "small", "max_amount": 50, "max_daily": 100, "action": "approve"}]}`)
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, amount := range []float64{-1000000, 0} {
+		if d := e.decide(PayReq{UserID: "u1", Amount: amount}, day); d.Approved || d.Reason != "invalid_amount" {
+			t.Fatalf("amount %v: %+v", amount, d)
+		}
+	}
+	// The daily total is untouched: only 100 worth of payments get through.
+	approved := 0
+	for i := 0; i < 10; i++ {
+		if e.decide(PayReq{UserID: "u1", Amount: 30}, day).Approved {
+			approved++
+		}
+	}
+	if approved != 3 {
+		t.Fatalf("approved %d payments of 30 under a daily cap of 100", approved)
+	}
+
+	// /pay turns them away before Risk or the rules see them.
+	w := httptest.NewRecorder()
+	handlePay(w, httptest.NewRequest("POST", "/pay", strings.NewReader(`{"user_id":"u1","amount":-1000000}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("/pay with a negative amount: status %d, want 400", w.Code)
+	}
+}
+
+func TestFallbackDeclinesPaymentsWithoutAUser(t *testing.T) {
+	e := mustFallbacks(t, `{"rules": [{"name": "small", "max_amount": 50, "max_daily": 100, "action": "approve"}]}`)
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, user := range []string{"", "  "} {
+		if d := e.decide(PayReq{UserID: user, Amount: 30}, day); d.Approved || d.Reason != "missing_user_id" {
+			t.Fatalf("user %q: %+v", user, d)
+		}
+	}
+	if len(e.totals) != 0 {
+		t.Fatalf("daily totals %v, want none", e.totals)
+	}
+	if d := e.decide(PayReq{UserID: "u1", Amount: 30}, day); !d.Approved {
+		t.Fatalf("a known user: %+v", d)
+	}
+}
+
+func TestFallbackReload(t *testing.T) {
+	e := mustFallbacks(t, `{"rules": [{"name": "hold", "action": "hold"}]}`)
+	write := func(rules string) {
+		if err := os.WriteFile(e.file.Path(), []byte(rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"rules": [{"name": "approve_all", "action": "approve"}]}`)
+	if err := e.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if d := e.decide(PayReq{UserID: "a", Amount: 5}, time.Now()); d.Reason != "approve_all" {
+		t.Fatalf("after reload: %+v", d)
+	}
+
+	// A broken file is rejected and the previous rules stay.
+	for _, bad := range []string{`{`, `{"rules": [{"name": "x", "action": "maybe"}]}`, `{"rules": [{"action": "hold"}]}`,
+		`{"rules": [{"name": "x", "action": "hold"}, {"name": "x", "action": "hold"}]}`} {
+		write(bad)
+		if err := e.reload(); err == nil {
+			t.Errorf("%s: accepted", bad)
+		}
+	}
+	if d := e.decide(PayReq{UserID: "a", Amount: 5}, time.Now()); d.Reason != "approve_all" {
+		t.Fatalf("after a bad reload: %+v", d)
+	}
+}
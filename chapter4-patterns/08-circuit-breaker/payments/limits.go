@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"patterns/internal/breaker"
+	"patterns/internal/bulkhead"
+)
+
+/*
+	Bulkhead on calls to Risk (see internal/bulkhead):
+
+- At most PAYMENTS_RISK_MAX_CONCURRENT (default 20) calls in flight
+- Up to PAYMENTS_RISK_MAX_QUEUE (default 10) more wait for a slot, each for
+  at most PAYMENTS_RISK_QUEUE_TIMEOUT (default 100ms)
+- Anything beyond that gets the fallback decision at once
+- With PAYMENTS_RISK_LATENCY_TARGET set (e.g. 300ms) the limit is adaptive:
+  it grows while calls are faster than the target and shrinks when they are
+  slower or fail, between 2 and PAYMENTS_RISK_MAX_LIMIT (default 100)
+*/
+
+func riskBulkheadFromEnv() (*bulkhead.Bulkhead, error) {
+	cfg := bulkhead.Config{Name: "risk", MaxConcurrent: 20, MaxQueue: 10, QueueTimeout: 100 * time.Millisecond}
+	maxLimit := 100
+	for name, v := range map[string]*int{
+		"PAYMENTS_RISK_MAX_CONCURRENT": &cfg.MaxConcurrent,
+		"PAYMENTS_RISK_MAX_QUEUE":      &cfg.MaxQueue,
+		"PAYMENTS_RISK_MAX_LIMIT":      &maxLimit,
+	} {
+		if s := os.Getenv(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: invalid count %q", name, s)
+			}
+			*v = n
+		}
+	}
+	var target time.Duration
+	for name, v := range map[string]*time.Duration{
+		"PAYMENTS_RISK_QUEUE_TIMEOUT":  &cfg.QueueTimeout,
+		"PAYMENTS_RISK_LATENCY_TARGET": &target,
+	} {
+		if s := os.Getenv(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("%s: invalid duration %q", name, s)
+			}
+			*v = d
+		}
+	}
+	if target > 0 {
+		cfg.Adaptive = &bulkhead.Adaptive{MinLimit: 2, MaxLimit: maxLimit, LatencyTarget: target,
+			// Calls the breaker refused never reached Risk.
+			IsFailure: func(err error) bool {
+				return isRiskFailure(err) && !errors.Is(err, breaker.ErrOpen)
+			},
+		}
+		cfg.OnLimitChange = func(name string, from, to int) {
+			log.Printf("[payments] bulkhead %s: limit %d -> %d", name, from, to)
+		}
+	}
+	return bulkhead.New(cfg)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"patterns/internal/breaker"
+)
+
+func TestSaturatedBulkheadFallsBack(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Write([]byte(`{"score": 10}`))
+	}))
+	defer srv.Close()
+	risk = newRiskClient(srv.URL, 600*time.Millisecond, 0)
+	brk, _ = breaker.New(breaker.Config{})
+	fallbacks = mustFallbacks(t, `{"rules": [{"name": "hold_all", "action": "hold"}]}`)
+
+	t.Setenv("PAYMENTS_RISK_MAX_CONCURRENT", "1")
+	t.Setenv("PAYMENTS_RISK_MAX_QUEUE", "1")
+	t.Setenv("PAYMENTS_RISK_QUEUE_TIMEOUT", "50ms")
+	var err error
+	if riskLimit, err = riskBulkheadFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	pay := func() Decision {
+		w := httptest.NewRecorder()
+		handlePay(w, httptest.NewRequest("POST", "/pay", strings.NewReader(`{"user_id":"U1","amount":20}`)))
+		var d Decision
+		json.NewDecoder(w.Body).Decode(&d)
+		return d
+	}
+	first := make(chan Decision)
+	go func() { first <- pay() }()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// One call in flight, so this one queues, times out and falls back.
+	start := time.Now()
+	if d := pay(); d.Mode != "fallback" || d.Reason != "hold_all" {
+		t.Fatalf("while saturated: %+v", d)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("queued for only %s", waited)
+	}
+	close(release)
+	if d := <-first; d.Mode != "normal" {
+		t.Fatalf("first call: %+v", d)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("risk called %d times, want 1", n)
+	}
+}
@@ -1,127 +1,176 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
-	"sync"
+	"os"
 	"time"
+
+	"patterns/internal/breaker"
+	"patterns/internal/bulkhead"
+	"patterns/internal/server"
 )
 
 const riskURL = "http://localhost:7002/score"
 
 type PayReq struct {
-	UserID string  `json:"user_id"`
-	Amount float64 `json:"amount"`
+	UserID     string  `json:"user_id"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency,omitempty"`
+	MerchantID string  `json:"merchant_id,omitempty"`
 }
 
 type Decision struct {
 	Approved bool   `json:"approved"`
 	Reason   string `json:"reason"`
 	Mode     string `json:"mode"` // "normal" or "fallback"
-}
 
-/* Tiny Circuit Breaker (aligned):
-- Trip OPEN after 3 consecutive failures
-- Stay OPEN 10s (fast-fail)
-- After 10s allow 1 probe (HALF-OPEN): success -> CLOSED, fail -> OPEN
-*/
-type breaker struct {
-	mu        sync.Mutex
-	state     string // "closed","open","half"
-	failCount int
-	openUntil time.Time
+	// Normal mode only: Risk's score and the thresholds applied to it (score.go)
+	Score      *int        `json:"score,omitempty"`
+	Thresholds *Thresholds `json:"thresholds,omitempty"`
 }
 
-func (b *breaker) allow() bool {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+/*
+		Circuit breaker on calls to Risk (see internal/breaker):
 
-	now := time.Now()
-	if b.state == "open" {
-		if now.After(b.openUntil) {
-			b.state = "half"
-			return true
-		}
-		return false
+	  - Looks at the last 10 calls, once there are at least 5 of them
+	  - Trips OPEN when half of them failed (5xx, error, >600ms timeout)
+	    or 80% of them took 400ms or more
+	  - Stays OPEN 10s (fast-fail)
+	  - Then lets 2 probes through (HALF-OPEN): if they pass -> CLOSED, else -> OPEN
+*/
+var brk = mustBreaker(breaker.Config{
+	Name:                  "risk",
+	Window:                breaker.CountBased,
+	WindowSize:            10,
+	MinimumCalls:          5,
+	FailureRateThreshold:  50,
+	SlowCallDuration:      400 * time.Millisecond,
+	SlowCallRateThreshold: 80,
+	OpenDuration:          10 * time.Second,
+	HalfOpenProbes:        2,
+	IsFailure:             isRiskFailure, // a caller's short budget isn't Risk's fault (riskclient.go)
+	IsAbandoned:           isRiskAbandoned,
+	OnStateChange: func(name string, from, to breaker.State) {
+		log.Printf("[payments] breaker %s: %s -> %s", name, from, to)
+	},
+})
+
+func mustBreaker(cfg breaker.Config) *breaker.Breaker {
+	b, err := breaker.New(cfg)
+	if err != nil {
+		log.Fatalf("[payments] %v", err)
 	}
-	return true // closed or half
+	return b
 }
 
-func (b *breaker) report(err error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+var (
+	// Concurrent calls to Risk, set from PAYMENTS_RISK_* (limits.go)
+	riskLimit *bulkhead.Bulkhead
+	// Hedged calls to Risk, set from PAYMENTS_RISK_TIMEOUT and PAYMENTS_RISK_HEDGE_BUDGET (riskclient.go)
+	risk *riskClient
+)
 
-	if b.state == "half" {
-		if err == nil {
-			b.state, b.failCount = "closed", 0
-		} else {
-			b.state, b.openUntil = "open", time.Now().Add(10*time.Second)
-		}
-		return
+func main() {
+	var err error
+	if riskLimit, err = riskBulkheadFromEnv(); err != nil {
+		log.Fatalf("[payments] %v", err)
 	}
-
-	if err == nil {
-		b.failCount = 0
-		return
+	log.Printf("[payments] at most %d concurrent risk calls", riskLimit.Stats().Limit)
+	if risk, err = riskClientFromEnv(riskURL, riskLimit); err != nil {
+		log.Fatalf("[payments] %v", err)
 	}
-
-	b.failCount++
-	if b.failCount >= 3 {
-		b.state, b.openUntil = "open", time.Now().Add(10*time.Second)
+	if thresholds, err = thresholdsFromEnv(); err != nil {
+		log.Fatalf("[payments] %v", err)
 	}
-}
+	log.Printf("[payments] approve below score %d, decline at %d", thresholds.ApproveBelow, thresholds.DeclineAt)
 
-var brk = &breaker{state: "closed"}
+	rulesPath := os.Getenv("PAYMENTS_FALLBACK_RULES")
+	if rulesPath == "" {
+		rulesPath = "fallback.json"
+	}
+	if fallbacks, err = newFallbackEngine(rulesPath); err != nil {
+		log.Fatalf("[payments] loading fallback rules: %v", err)
+	}
+	go fallbacks.watch(2 * time.Second)
+	log.Printf("[payments] loaded %d fallback rules from %s", len(fallbacks.current.Load().Rules), rulesPath)
 
-func main() {
 	http.HandleFunc("/pay", handlePay)
-	http.ListenAndServe(":9000", nil)
+	http.HandleFunc("/risk/stats", handleRiskStats)
+	server.Main("payments", ":9000", nil)
 }
 
 func handlePay(w http.ResponseWriter, r *http.Request) {
+	arrived := time.Now()
 	var in PayReq
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		http.Error(w, "bad json", http.StatusBadRequest)
 		return
 	}
+	if !(in.Amount > 0) {
+		http.Error(w, "amount must be positive", http.StatusBadRequest)
+		return
+	}
 
-	// 1) Ask breaker if we should try Risk
-	if !brk.allow() {
+	// 1) Work out how long we may wait for Risk: the caller's remaining
+	// budget, at most 600ms (riskclient.go)
+	ctx, cancel, err := callerBudget(r, arrived)
+	if err != nil {
+		log.Printf("[payments] %v, falling back", err)
 		json.NewEncoder(w).Encode(fallback(in))
 		return
 	}
+	defer cancel()
 
-	// 2) Call Risk with a short timeout (600ms)
-	body, _ := json.Marshal(in)
-	req, _ := http.NewRequest("POST", riskURL, bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 600 * time.Millisecond}
-	resp, err := client.Do(req)
+	// 2) Take a bulkhead slot: when too many calls to Risk are in flight
+	// already, fall back instead of piling on (bulkhead.ErrFull or
+	// bulkhead.ErrQueueTimeout)
+	done, err := riskLimit.Acquire(ctx)
 	if err != nil {
-		brk.report(err)
+		log.Printf("[payments] risk bulkhead saturated, falling back: %v", err)
 		json.NewEncoder(w).Encode(fallback(in))
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 500 {
-		brk.report(errors.New("5xx"))
+	// 3) Call Risk through the breaker, hedging slow calls. While the
+	// breaker is open this fails at once with breaker.ErrOpen. An answer
+	// without a usable score is a failure too.
+	body, _ := json.Marshal(in)
+	var score ScoreResp
+	err = brk.Do(func() error {
+		var err error
+		score, err = risk.score(ctx, body)
+		return err
+	})
+	done(err)
+
+	// 4) Fall back if Risk is unavailable
+	if err != nil {
+		if !errors.Is(err, breaker.ErrOpen) {
+			log.Printf("[payments] risk call failed, falling back: %v", err)
+		}
 		json.NewEncoder(w).Encode(fallback(in))
 		return
 	}
 
-	// Success path
-	brk.report(nil)
-	json.NewEncoder(w).Encode(Decision{Approved: true, Reason: "risk_ok", Mode: "normal"})
+	// 5) Approve, challenge or decline by score
+	json.NewEncoder(w).Encode(decide(score, thresholds))
+}
+
+func handleRiskStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Client   riskStats      `json:"client"`
+		Breaker  string         `json:"breaker"`
+		Bulkhead bulkhead.Stats `json:"bulkhead"`
+	}{risk.stats(), brk.State().String(), riskLimit.Stats()})
 }
 
+// Rules for degraded mode, loaded from PAYMENTS_FALLBACK_RULES (fallback.go)
+var fallbacks *fallbackEngine
+
 func fallback(in PayReq) Decision {
-	// Simple, safe:
-	if in.Amount <= 50 {
-		return Decision{Approved: true, Reason: "challenge_small", Mode: "fallback"}
-	}
-	return Decision{Approved: false, Reason: "hold_high_amount", Mode: "fallback"}
-}
\ No newline at end of file
+	return fallbacks.decide(in, time.Now())
+}
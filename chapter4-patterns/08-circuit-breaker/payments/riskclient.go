@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"patterns/internal/breaker"
+	"patterns/internal/bulkhead"
+)
+
+/*
+	Risk client (hedged requests, deadlines from the caller's budget):
+
+- The deadline for a score is the caller's remaining time budget (its
+  context deadline, or X-Request-Timeout-Ms counted from arrival) minus a
+  little to answer with, and never more than PAYMENTS_RISK_TIMEOUT (600ms)
+- The client keeps the latencies of Risk's recent calls (a call cut off at
+  its deadline counts as taking the whole deadline). When a call is still
+  running at the p95 latency, a second identical request (a hedge) is
+  sent and whichever answers first wins; the other one is cancelled
+- A call cut off because the caller's budget ran out fails with
+  errCallerBudget. It isn't Risk's fault, so the breaker and the bulkhead
+  don't count it (isRiskFailure); otherwise a few callers with tiny
+  budgets could open the breaker for everyone. Nor is it an answer, so a
+  half-open probe cut off this way doesn't close the breaker either
+  (isRiskAbandoned)
+- Hedges are limited by a budget (PAYMENTS_RISK_HEDGE_BUDGET, default 0.1):
+  each call earns 0.1 of a hedge, so at most ~10% extra load on Risk
+- A hedge is a second call in flight, so it needs a bulkhead slot of its
+  own. It takes one only if one is free at once; otherwise it is skipped
+- Risk's slow answers are random (~20%), so the hedge is usually fast
+*/
+
+const (
+	answerReserve = 20 * time.Millisecond // kept back from the caller's budget to send the answer
+	minRiskBudget = 50 * time.Millisecond // less than this left: don't call Risk at all
+	minSamples    = 20                    // latencies needed before hedging
+)
+
+var (
+	errNoTimeBudget = errors.New("not enough time budget left to call risk")
+	errCallerBudget = errors.New("caller's time budget ran out")
+)
+
+// isRiskAbandoned is the breaker's IsAbandoned: the caller gave up
+// (context.Canceled) or ran out of budget before Risk answered.
+func isRiskAbandoned(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, errCallerBudget)
+}
+
+// isRiskFailure is the breaker's IsFailure: any error except an abandoned
+// call.
+func isRiskFailure(err error) bool {
+	return err != nil && !isRiskAbandoned(err)
+}
+
+type riskClient struct {
+	url        string
+	http       *http.Client // no Timeout: every call has a context deadline
+	maxTimeout time.Duration
+	latency    *latencyTracker
+	budget     *hedgeBudget       // nil: no hedging
+	slots      *bulkhead.Bulkhead // where hedges take a slot; nil: no limit
+
+	calls, hedges, hedgeWins atomic.Int64
+}
+
+func newRiskClient(url string, maxTimeout time.Duration, hedgeRatio float64) *riskClient {
+	c := &riskClient{url: url, http: &http.Client{}, maxTimeout: maxTimeout, latency: newLatencyTracker(512)}
+	if hedgeRatio > 0 {
+		c.budget = &hedgeBudget{ratio: hedgeRatio, max: 10}
+	}
+	return c
+}
+
+func riskClientFromEnv(url string, slots *bulkhead.Bulkhead) (*riskClient, error) {
+	timeout, ratio := 600*time.Millisecond, 0.1
+	if s := os.Getenv("PAYMENTS_RISK_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("PAYMENTS_RISK_TIMEOUT: invalid duration %q", s)
+		}
+		timeout = d
+	}
+	if s := os.Getenv("PAYMENTS_RISK_HEDGE_BUDGET"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("PAYMENTS_RISK_HEDGE_BUDGET: want a fraction in [0, 1], got %q", s)
+		}
+		ratio = f
+	}
+	c := newRiskClient(url, timeout, ratio)
+	c.slots = slots
+	return c, nil
+}
+
+// callerBudget derives the context for a call to Risk from the incoming
+// request: its deadline, if any, and X-Request-Timeout-Ms, less the answer
+// reserve. When that deadline passes, the context's cause is errCallerBudget.
+func callerBudget(r *http.Request, arrived time.Time) (context.Context, context.CancelFunc, error) {
+	deadline, ok := r.Context().Deadline()
+	if s := r.Header.Get("X-Request-Timeout-Ms"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err == nil && ms > 0 {
+			if d := arrived.Add(time.Duration(ms) * time.Millisecond); !ok || d.Before(deadline) {
+				deadline, ok = d, true
+			}
+		}
+	}
+	if !ok {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	deadline = deadline.Add(-answerReserve)
+	if time.Until(deadline) < minRiskBudget {
+		return nil, nil, errNoTimeBudget
+	}
+	ctx, cancel := context.WithDeadlineCause(r.Context(), deadline, errCallerBudget)
+	return ctx, cancel, nil
+}
+
+type attemptResult struct {
+	score ScoreResp
+	err   error
+	hedge bool
+}
+
+// score asks Risk for a score before ctx's deadline (and within
+// maxTimeout), hedging once the call is slower than usual.
+func (c *riskClient) score(ctx context.Context, body []byte) (ScoreResp, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.maxTimeout)
+	defer cancel() // also stops the attempt that lost
+	c.calls.Add(1)
+	if c.budget != nil {
+		c.budget.deposit()
+	}
+
+	results := make(chan attemptResult, 2)
+	launch := func(hedge bool, done func(error)) {
+		go func() {
+			start := time.Now()
+			s, err := c.attempt(ctx, body)
+			// Answers are timed, and so are attempts cut off by the deadline:
+			// Risk took at least that long, and leaving them out would pull
+			// the p95 down (and hedge early) just when Risk is slow. An
+			// attempt stopped because the other one won, or the caller left,
+			// says nothing about Risk.
+			var status *breaker.StatusError
+			answered := err == nil || errors.As(err, &status) || errors.Is(err, errBadScore)
+			if answered || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				c.latency.observe(time.Since(start))
+			}
+			if done != nil { // the hedge's own bulkhead slot
+				outcome := err
+				if err != nil && errors.Is(context.Cause(ctx), errCallerBudget) {
+					outcome = errCallerBudget
+				}
+				done(outcome)
+			}
+			results <- attemptResult{s, err, hedge}
+		}()
+	}
+	launch(false, nil) // runs in the slot the caller took
+	pending := 1
+
+	var hedgeAt <-chan time.Time
+	if p95, ok := c.latency.percentile(95); ok && c.budget != nil {
+		t := time.NewTimer(p95)
+		defer t.Stop()
+		hedgeAt = t.C
+	}
+
+	var firstErr error
+	for {
+		select {
+		case <-hedgeAt:
+			hedgeAt = nil
+			if !c.budget.withdraw() {
+				break
+			}
+			var done func(error)
+			if c.slots != nil {
+				var ok bool
+				if done, ok = c.slots.TryAcquire(); !ok {
+					c.budget.refund() // no free slot: skip the hedge
+					break
+				}
+			}
+			c.hedges.Add(1)
+			launch(true, done)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.hedge {
+					c.hedgeWins.Add(1)
+				}
+				return res.score, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if pending == 0 {
+				if errors.Is(context.Cause(ctx), errCallerBudget) && !errors.Is(firstErr, errCallerBudget) {
+					return ScoreResp{}, fmt.Errorf("%w: %v", errCallerBudget, firstErr)
+				}
+				return ScoreResp{}, firstErr
+			}
+			// The other attempt may still succeed.
+		}
+	}
+}
+
+func (c *riskClient) attempt(ctx context.Context, body []byte) (ScoreResp, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return ScoreResp{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return ScoreResp{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ScoreResp{}, &breaker.StatusError{StatusCode: resp.StatusCode}
+	}
+	return parseScore(resp.Body)
+}
+
+// riskStats is what GET /risk/stats reports.
+type riskStats struct {
+	Calls     int64             `json:"calls"`
+	Hedges    int64             `json:"hedges"`
+	HedgeWins int64             `json:"hedge_wins"`
+	Latency   map[string]string `json:"latency,omitempty"` // p50, p95, p99
+}
+
+func (c *riskClient) stats() riskStats {
+	s := riskStats{Calls: c.calls.Load(), Hedges: c.hedges.Load(), HedgeWins: c.hedgeWins.Load()}
+	for _, p := range []float64{50, 95, 99} {
+		if d, ok := c.latency.percentile(p); ok {
+			if s.Latency == nil {
+				s.Latency = map[string]string{}
+			}
+			s.Latency[fmt.Sprintf("p%g", p)] = d.String()
+		}
+	}
+	return s
+}
+
+// latencyTracker keeps the last len(ring) latencies.
+type latencyTracker struct {
+	mu     sync.Mutex
+	ring   []time.Duration
+	next   int
+	n      int
+	sorted []time.Duration // sorted copy, rebuilt after 16 new samples
+	stale  int
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{ring: make([]time.Duration, size)}
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ring[t.next] = d
+	t.next = (t.next + 1) % len(t.ring)
+	if t.n < len(t.ring) {
+		t.n++
+	}
+	t.stale++
+}
+
+// percentile reports the p-th percentile (nearest rank), once there are
+// enough samples to mean something.
+func (t *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n < minSamples {
+		return 0, false
+	}
+	if t.sorted == nil || t.stale >= 16 {
+		t.sorted = append(t.sorted[:0], t.ring[:t.n]...)
+		sort.Slice(t.sorted, func(i, j int) bool { return t.sorted[i] < t.sorted[j] })
+		t.stale = 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(t.sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return t.sorted[rank], true
+}
+
+// hedgeBudget is a token bucket: every call deposits ratio, every hedge
+// withdraws 1, so hedges stay under ratio of the calls.
+type hedgeBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	max    float64
+}
+
+func (b *hedgeBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+	b.mu.Unlock()
+}
+
+// refund returns a withdrawn hedge that wasn't sent.
+func (b *hedgeBudget) refund() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.max, b.tokens+1)
+	b.mu.Unlock()
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
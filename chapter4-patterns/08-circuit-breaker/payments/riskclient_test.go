@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"patterns/internal/breaker"
+	"patterns/internal/bulkhead"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	tr := newLatencyTracker(100)
+	for i := 1; i < minSamples; i++ {
+		tr.observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := tr.percentile(95); ok {
+		t.Fatal("percentile from too few samples")
+	}
+	for i := minSamples; i <= 100; i++ {
+		tr.observe(time.Duration(i) * time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{50: 50 * time.Millisecond, 95: 95 * time.Millisecond, 100: 100 * time.Millisecond} {
+		if got, _ := tr.percentile(p); got != want {
+			t.Errorf("p%g = %s, want %s", p, got, want)
+		}
+	}
+	// The ring forgets the oldest samples.
+	for i := 0; i < 100; i++ {
+		tr.observe(time.Second)
+	}
+	if got, _ := tr.percentile(50); got != time.Second {
+		t.Errorf("p50 after a slowdown = %s", got)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	b := &hedgeBudget{ratio: 0.1, max: 10}
+	hedges := 0
+	for i := 0; i < 1000; i++ {
+		b.deposit()
+		if b.withdraw() {
+			hedges++
+		}
+	}
+	if hedges < 99 || hedges > 100 { // 0.1 isn't exact in floating point
+		t.Fatalf("%d hedges for 1000 calls at 10%%", hedges)
+	}
+}
+
+// slowFirst answers every other request slowly, starting with the first.
+func slowFirst(t *testing.T, slow time.Duration) (*httptest.Server, *atomic.Int64) {
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1)%2 == 1 {
+			select {
+			case <-time.After(slow):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte(`{"score": 10}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+func TestHedgedRequestWins(t *testing.T) {
+	srv, requests := slowFirst(t, 400*time.Millisecond)
+	c := newRiskClient(srv.URL, time.Second, 1)
+	for i := 0; i < minSamples; i++ {
+		c.latency.observe(20 * time.Millisecond)
+	}
+	c.budget.tokens = 1
+
+	start := time.Now()
+	s, err := c.score(context.Background(), []byte(`{}`))
+	if err != nil || s.Score != 10 {
+		t.Fatalf("score %+v, %v", s, err)
+	}
+	if took := time.Since(start); took > 200*time.Millisecond {
+		t.Fatalf("took %s, the hedge should have answered after ~20ms", took)
+	}
+	if requests.Load() != 2 || c.hedges.Load() != 1 || c.hedgeWins.Load() != 1 {
+		t.Fatalf("requests %d, hedges %d, hedge wins %d", requests.Load(), c.hedges.Load(), c.hedgeWins.Load())
+	}
+}
+
+func TestHedgeNeedsAFreeBulkheadSlot(t *testing.T) {
+	srv, requests := slowFirst(t, 100*time.Millisecond)
+	c := newRiskClient(srv.URL, time.Second, 1)
+	for i := 0; i < minSamples; i++ {
+		c.latency.observe(10 * time.Millisecond)
+	}
+	c.slots, _ = bulkhead.New(bulkhead.Config{MaxConcurrent: 1})
+
+	// The caller holds the only slot: no hedge, and the budget is kept.
+	done, _ := c.slots.Acquire(context.Background())
+	c.budget.tokens = 1
+	if _, err := c.score(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	done(nil)
+	if requests.Load() != 1 || c.hedges.Load() != 0 || !c.budget.withdraw() {
+		t.Fatalf("requests %d, hedges %d with every slot taken", requests.Load(), c.hedges.Load())
+	}
+
+	// With a slot free the hedge takes it, and gives it back when done.
+	requests.Store(0)
+	c.budget.tokens = 1
+	if _, err := c.score(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 || c.hedges.Load() != 1 {
+		t.Fatalf("requests %d, hedges %d with a free slot", requests.Load(), c.hedges.Load())
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.slots.Stats().InFlight != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("hedge kept its slot: %+v", c.slots.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNoHedgeWithoutBudget(t *testing.T) {
+	srv, requests := slowFirst(t, 100*time.Millisecond)
+	c := newRiskClient(srv.URL, time.Second, 0.1)
+	for i := 0; i < minSamples; i++ {
+		c.latency.observe(10 * time.Millisecond)
+	}
+	if _, err := c.score(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 || c.hedges.Load() != 0 {
+		t.Fatalf("requests %d, hedges %d with an empty budget", requests.Load(), c.hedges.Load())
+	}
+}
+
+func TestScoreKeepsToTheDeadline(t *testing.T) {
+	srv, _ := slowFirst(t, time.Second)
+	c := newRiskClient(srv.URL, 100*time.Millisecond, 0)
+	start := time.Now()
+	if _, err := c.score(context.Background(), []byte(`{}`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("slow answer: %v", err)
+	}
+	if took := time.Since(start); took > 300*time.Millisecond {
+		t.Fatalf("gave up after %s, want ~100ms", took)
+	}
+	// The call that ran out of time still counts, at the deadline.
+	if c.latency.n != 1 || c.latency.ring[0] < 100*time.Millisecond {
+		t.Fatalf("latency samples %v, want one of at least 100ms", c.latency.ring[:c.latency.n])
+	}
+}
+
+func TestLosingAttemptsAreNotTimed(t *testing.T) {
+	srv, _ := slowFirst(t, time.Second)
+	c := newRiskClient(srv.URL, time.Second, 1)
+	for i := 0; i < minSamples; i++ {
+		c.latency.observe(10 * time.Millisecond)
+	}
+	c.budget.tokens = 1
+	if _, err := c.score(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond) // for the cancelled attempt to finish
+	c.latency.mu.Lock()
+	defer c.latency.mu.Unlock()
+	if c.latency.n != minSamples+1 {
+		t.Fatalf("%d samples, want only the winner's added", c.latency.n-minSamples)
+	}
+}
+
+func TestCallerBudget(t *testing.T) {
+	now := time.Now()
+	req := func(timeout string) *http.Request {
+		r := httptest.NewRequest("POST", "/pay", nil)
+		if timeout != "" {
+			r.Header.Set("X-Request-Timeout-Ms", timeout)
+		}
+		return r
+	}
+
+	ctx, cancel, err := callerBudget(req(""), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("deadline without a budget")
+	}
+	cancel()
+
+	ctx, cancel, err = callerBudget(req("500"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := ctx.Deadline(); !d.Equal(now.Add(500*time.Millisecond - answerReserve)) {
+		t.Fatalf("deadline %s after arrival", d.Sub(now))
+	}
+	cancel()
+
+	if _, _, err := callerBudget(req("60"), now); !errors.Is(err, errNoTimeBudget) {
+		t.Fatalf("60ms budget: %v", err)
+	}
+}
+
+func TestShortCallerBudgetsDontOpenTheBreaker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	risk = newRiskClient(srv.URL, 600*time.Millisecond, 0)
+	b, err := breaker.New(breaker.Config{WindowSize: 5, MinimumCalls: 5, IsFailure: isRiskFailure})
+	if err != nil {
+		t.Fatal(err)
+	}
+	brk = b
+	riskLimit, _ = bulkhead.New(bulkhead.Config{MaxConcurrent: 10})
+	fallbacks = mustFallbacks(t, `{"rules": [{"name": "hold", "action": "hold"}]}`)
+
+	// Risk is slow, but every caller allows just 80ms.
+	slow := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/pay", strings.NewReader(`{"user_id":"U1","amount":20}`))
+		r.Header.Set("X-Request-Timeout-Ms", "80")
+		w := httptest.NewRecorder()
+		handlePay(w, r)
+		return w
+	}
+	for i := 0; i < 5; i++ {
+		var d Decision
+		json.NewDecoder(slow().Body).Decode(&d)
+		if d.Mode != "fallback" {
+			t.Fatalf("call %d: %+v", i, d)
+		}
+	}
+	if s := brk.State(); s != breaker.Closed {
+		t.Fatalf("breaker %s after calls cut off by the callers' own budgets", s)
+	}
+
+	ctx, cancel, err := callerBudget(func() *http.Request {
+		r := httptest.NewRequest("POST", "/pay", nil)
+		r.Header.Set("X-Request-Timeout-Ms", "80")
+		return r
+	}(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if _, err := risk.score(ctx, []byte(`{}`)); !errors.Is(err, errCallerBudget) || isRiskFailure(err) {
+		t.Fatalf("score within a caller's budget: %v", err)
+	}
+}
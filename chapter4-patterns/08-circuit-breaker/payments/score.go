@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+/*
+	Scoring (normal mode):
+
+- Risk answers {"score": 0-100, "note": "..."}; higher is riskier
+- score <  approve_below -> approve   ("risk_ok")
+- score >= decline_at    -> decline   ("risk_decline")
+- in between             -> challenge ("risk_challenge": approved, pending step-up)
+- Anything else from Risk (no score, not JSON, out of range) is rejected:
+  the payment falls back and the call counts as a breaker failure
+*/
+
+type ScoreResp struct {
+	Score int    `json:"score"`
+	Note  string `json:"note"`
+}
+
+// Thresholds are the score limits a decision was made with. They are
+// returned with every normal-mode decision, for auditing.
+type Thresholds struct {
+	ApproveBelow int `json:"approve_below"`
+	DeclineAt    int `json:"decline_at"`
+}
+
+// Set by PAYMENTS_APPROVE_BELOW and PAYMENTS_DECLINE_AT
+var thresholds = Thresholds{ApproveBelow: 30, DeclineAt: 80}
+
+var errBadScore = errors.New("unusable risk response")
+
+func thresholdsFromEnv() (Thresholds, error) {
+	t := thresholds
+	for name, v := range map[string]*int{
+		"PAYMENTS_APPROVE_BELOW": &t.ApproveBelow,
+		"PAYMENTS_DECLINE_AT":    &t.DeclineAt,
+	} {
+		s := os.Getenv(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return Thresholds{}, fmt.Errorf("%s: invalid score %q", name, s)
+		}
+		*v = n
+	}
+	if t.ApproveBelow < 0 || t.ApproveBelow > t.DeclineAt || t.DeclineAt > 101 {
+		return Thresholds{}, fmt.Errorf("want 0 <= PAYMENTS_APPROVE_BELOW (%d) <= PAYMENTS_DECLINE_AT (%d) <= 101", t.ApproveBelow, t.DeclineAt)
+	}
+	return t, nil
+}
+
+// parseScore decodes Risk's answer. The score must be there and in 0-100.
+func parseScore(r io.Reader) (ScoreResp, error) {
+	var raw struct {
+		Score *float64 `json:"score"`
+		Note  string   `json:"note"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return ScoreResp{}, fmt.Errorf("%w: %v", errBadScore, err)
+	}
+	if raw.Score == nil {
+		return ScoreResp{}, fmt.Errorf("%w: no score", errBadScore)
+	}
+	n := *raw.Score
+	if n != math.Trunc(n) || n < 0 || n > 100 {
+		return ScoreResp{}, fmt.Errorf("%w: score %v is not an integer in 0-100", errBadScore, n)
+	}
+	return ScoreResp{Score: int(n), Note: raw.Note}, nil
+}
+
+// decide turns a score into a normal-mode decision.
+func decide(s ScoreResp, t Thresholds) Decision {
+	d := Decision{Mode: "normal", Score: &s.Score, Thresholds: &t}
+	switch {
+	case s.Score < t.ApproveBelow:
+		d.Approved, d.Reason = true, "risk_ok"
+	case s.Score >= t.DeclineAt:
+		d.Approved, d.Reason = false, "risk_decline"
+	default:
+		d.Approved, d.Reason = true, "risk_challenge"
+	}
+	return d
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"patterns/internal/breaker"
+	"patterns/internal/bulkhead"
+)
+
+func TestParseScore(t *testing.T) {
+	for body, want := range map[string]int{
+		`{"score": 10, "note": "ok"}`: 10,
+		`{"score": 0}`:                0,
+		`{"score": 100}`:              100,
+	} {
+		got, err := parseScore(strings.NewReader(body))
+		if err != nil || got.Score != want {
+			t.Errorf("%s: %v, %v", body, got, err)
+		}
+	}
+	for _, body := range []string{``, `not json`, `{}`, `{"score": "10"}`, `{"score": 10.5}`, `{"score": -1}`, `{"score": 101}`, `{"score": null}`} {
+		if _, err := parseScore(strings.NewReader(body)); !errors.Is(err, errBadScore) {
+			t.Errorf("%q: %v", body, err)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	th := Thresholds{ApproveBelow: 30, DeclineAt: 80}
+	for score, want := range map[int]string{0: "risk_ok", 29: "risk_ok", 30: "risk_challenge", 79: "risk_challenge", 80: "risk_decline", 100: "risk_decline"} {
+		d := decide(ScoreResp{Score: score}, th)
+		if d.Reason != want || d.Approved != (want != "risk_decline") || *d.Score != score || *d.Thresholds != th || d.Mode != "normal" {
+			t.Errorf("score %d: %+v", score, d)
+		}
+	}
+}
+
+func TestUnparseableScoreCountsAsFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"note":"no score"}`))
+	}))
+	defer srv.Close()
+	risk = newRiskClient(srv.URL, 600*time.Millisecond, 0)
+	b, err := breaker.New(breaker.Config{WindowSize: 2, MinimumCalls: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	brk = b
+	riskLimit, _ = bulkhead.New(bulkhead.Config{})
+	fallbacks = mustFallbacks(t, `{"rules": [{"name": "challenge_small", "max_amount": 50, "action": "challenge"}]}`)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handlePay(w, httptest.NewRequest("POST", "/pay", strings.NewReader(`{"user_id":"U1","amount":20}`)))
+		var d Decision
+		json.NewDecoder(w.Body).Decode(&d)
+		if d.Mode != "fallback" || d.Score != nil {
+			t.Fatalf("decision %+v", d)
+		}
+	}
+	if s := brk.State(); s != breaker.Open {
+		t.Fatalf("breaker %s after unparseable scores", s)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"math/rand"
+	"log"
 	"net/http"
 	"time"
+
+	"patterns/internal/fault"
+	"patterns/internal/server"
 )
 
 type ScoreReq struct {
@@ -17,8 +20,21 @@ type ScoreResp struct {
 	Note  string `json:"note"`
 }
 
+// Unless RISK_FAULTS says otherwise: ~20% of calls take 1.2s, ~15% fail
+// with a 5xx (see internal/fault for the admin API and X-Fault-* headers)
+var defaultFaults = fault.Config{Endpoints: map[string]fault.Profile{
+	"/score": {
+		Latency:   fault.Latency{Rate: 0.2, Delay: fault.Duration(1200 * time.Millisecond)},
+		ErrorRate: 0.15, ErrorStatus: http.StatusInternalServerError, ErrorBody: `{"error":"risk_down"}`,
+		Exclusive: true, // slow or failing, never both
+	},
+}}
+
 func main() {
-	rand.Seed(time.Now().UnixNano())
+	faults, err := fault.FromEnv("risk", defaultFaults)
+	if err != nil {
+		log.Fatalf("[risk] %v", err)
+	}
 
 	http.HandleFunc("/score", func(w http.ResponseWriter, r *http.Request) {
 		var in ScoreReq
@@ -26,19 +42,11 @@ func main() {
 			http.Error(w, "bad json", http.StatusBadRequest)
 			return
 		}
-
-		n := rand.Intn(100)
-		if n < 20 { // ~20% slow
-			time.Sleep(1200 * time.Millisecond)
-		} else if n < 35 { // next ~15% 5xx
-			http.Error(w, `{"error":"risk_down"}`, http.StatusInternalServerError)
-			return
-		}
-
 		json.NewEncoder(w).Encode(ScoreResp{Score: base(in.Amount), Note: "ok"})
 	})
+	http.Handle("/admin/faults", faults.AdminHandler())
 
-	http.ListenAndServe(":7002", nil)
+	server.Main("risk", ":7002", faults.Handler(http.DefaultServeMux))
 }
 
 func base(amount float64) int {
@@ -50,4 +58,4 @@ func base(amount float64) int {
 		score = 100
 	}
 	return score
-}
\ No newline at end of file
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"sync"
+
+	"patterns/internal/server"
 )
 
 // --- Write model (ledger) ---
@@ -64,6 +65,5 @@ func main() {
 	http.HandleFunc("/command/pay", handlePay)
 	http.HandleFunc("/query/balance", handleBalance)
 
-	log.Println("[cqrs] listening on :9000")
-	log.Fatal(http.ListenAndServe(":9000", nil))
-}
\ No newline at end of file
+	server.Main("cqrs", ":9000", nil)
+}
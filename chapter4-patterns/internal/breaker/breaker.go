@@ -0,0 +1,290 @@
+// Package breaker is a circuit breaker for calls to a remote dependency.
+//
+// While Closed, every call goes through and its outcome is recorded in a
+// sliding window, either the last N calls (CountBased) or the calls of the
+// last N seconds (TimeBased). Once the window holds at least MinimumCalls,
+// the breaker trips Open when the failure rate or the slow-call rate reaches
+// its threshold.
+//
+// While Open, calls are refused with ErrOpen, so callers fail fast (and can
+// serve a fallback) instead of piling onto a struggling service.
+//
+// After OpenDuration the breaker goes HalfOpen and lets HalfOpenProbes calls
+// through; more are refused. When all of them have finished, the same
+// thresholds decide: back to Closed, or Open for another OpenDuration. A
+// probe the caller abandoned (IsAbandoned) is no answer either way: its
+// slot goes to the next call.
+//
+//	b, err := breaker.New(breaker.Config{Name: "risk", FailureRateThreshold: 50})
+//	done, err := b.Allow()
+//	if err != nil {
+//		return fallback() // open
+//	}
+//	resp, err := client.Do(req)
+//	done(err)
+//
+// Transport wraps an http.RoundTripper the same way.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is where the breaker is.
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// WindowType picks how the sliding window is measured.
+type WindowType int
+
+const (
+	CountBased WindowType = iota // the last WindowSize calls
+	TimeBased                    // the calls of the last WindowDuration, in one-second buckets
+)
+
+// ErrOpen is returned instead of making the call, while the breaker is open
+// or while every half-open probe is taken.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Config is the breaker's settings. Zero values get the defaults below.
+type Config struct {
+	Name string // for callbacks and errors
+
+	Window         WindowType
+	WindowSize     int           // CountBased: calls (default 20)
+	WindowDuration time.Duration // TimeBased: whole seconds (default 10s)
+	MinimumCalls   int           // calls in the window before the rates count (default 10)
+
+	FailureRateThreshold  float64       // percent of failed calls that trips the breaker (default 50)
+	SlowCallDuration      time.Duration // calls at least this long are slow (default 0: none are)
+	SlowCallRateThreshold float64       // percent of slow calls that trips the breaker (default 100)
+
+	OpenDuration   time.Duration // how long to refuse calls before probing (default 10s)
+	HalfOpenProbes int           // calls let through while half-open (default 1)
+
+	// IsFailure decides whether a call's error counts as a failure.
+	// Default: any error except context.Canceled (the caller gave up).
+	IsFailure func(err error) bool
+	// IsAbandoned decides whether the caller gave up on a call before the
+	// dependency answered. Such a half-open probe isn't counted, and frees
+	// its slot. Default: context.Canceled.
+	IsAbandoned func(err error) bool
+	// OnStateChange is called after every transition, outside the breaker's lock.
+	OnStateChange func(name string, from, to State)
+	// Now is the clock (default time.Now); tests replace it.
+	Now func() time.Time
+}
+
+func (c *Config) setDefaults() error {
+	if c.WindowSize == 0 {
+		c.WindowSize = 20
+	}
+	if c.WindowDuration == 0 {
+		c.WindowDuration = 10 * time.Second
+	}
+	if c.MinimumCalls == 0 {
+		c.MinimumCalls = 10
+	}
+	if c.FailureRateThreshold == 0 {
+		c.FailureRateThreshold = 50
+	}
+	if c.SlowCallRateThreshold == 0 {
+		c.SlowCallRateThreshold = 100
+	}
+	if c.OpenDuration == 0 {
+		c.OpenDuration = 10 * time.Second
+	}
+	if c.HalfOpenProbes == 0 {
+		c.HalfOpenProbes = 1
+	}
+	if c.IsFailure == nil {
+		c.IsFailure = func(err error) bool { return err != nil && !errors.Is(err, context.Canceled) }
+	}
+	if c.IsAbandoned == nil {
+		c.IsAbandoned = func(err error) bool { return errors.Is(err, context.Canceled) }
+	}
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+
+	switch {
+	case c.Window != CountBased && c.Window != TimeBased:
+		return fmt.Errorf("breaker %s: unknown window type %d", c.Name, c.Window)
+	case c.WindowSize < 0, c.WindowDuration < time.Second, c.MinimumCalls < 0, c.HalfOpenProbes < 0:
+		return fmt.Errorf("breaker %s: window size, minimum calls and probes must be positive, window duration at least 1s", c.Name)
+	case c.FailureRateThreshold < 0 || c.FailureRateThreshold > 100, c.SlowCallRateThreshold < 0 || c.SlowCallRateThreshold > 100:
+		return fmt.Errorf("breaker %s: rate thresholds are percentages (0-100]", c.Name)
+	case c.SlowCallDuration < 0, c.OpenDuration < 0:
+		return fmt.Errorf("breaker %s: negative duration", c.Name)
+	}
+	return nil
+}
+
+// Breaker is safe for concurrent use.
+type Breaker struct {
+	cfg Config
+
+	mu         sync.Mutex
+	state      State
+	generation uint64 // bumped on every transition; outcomes of older calls are dropped
+	window     window
+	openUntil  time.Time
+	probes     int    // half-open: calls let through
+	probed     counts // half-open: outcomes so far
+}
+
+// New builds a closed breaker.
+func New(cfg Config) (*Breaker, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	b := &Breaker{cfg: cfg}
+	if cfg.Window == CountBased {
+		b.window = newCountWindow(cfg.WindowSize)
+	} else {
+		b.window = newTimeWindow(int(cfg.WindowDuration / time.Second))
+	}
+	return b, nil
+}
+
+// State reports the current state. An open breaker whose OpenDuration has
+// passed reports HalfOpen.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	changed := b.advance(b.cfg.Now())
+	s := b.state
+	b.mu.Unlock()
+	b.notify(changed)
+	return s
+}
+
+// Allow asks to make one call. When the call is allowed, done must be
+// called exactly once with its outcome; otherwise err is ErrOpen.
+func (b *Breaker) Allow() (done func(err error), err error) {
+	now := b.cfg.Now()
+	b.mu.Lock()
+	changed := b.advance(now)
+	switch {
+	case b.state == Open, b.state == HalfOpen && b.probes >= b.cfg.HalfOpenProbes:
+		b.mu.Unlock()
+		b.notify(changed)
+		return nil, fmt.Errorf("%s: %w", b.cfg.Name, ErrOpen)
+	case b.state == HalfOpen:
+		b.probes++
+	}
+	gen := b.generation
+	b.mu.Unlock()
+	b.notify(changed)
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.record(gen, now, err) })
+	}, nil
+}
+
+// Do runs fn if the breaker allows it and records its error.
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+func (b *Breaker) record(gen uint64, start time.Time, err error) {
+	now := b.cfg.Now()
+	o := outcome{
+		failed: b.cfg.IsFailure(err),
+		slow:   b.cfg.SlowCallDuration > 0 && now.Sub(start) >= b.cfg.SlowCallDuration,
+	}
+
+	b.mu.Lock()
+	var changed []transition
+	if gen == b.generation {
+		switch b.state {
+		case Closed:
+			b.window.add(now, o)
+			if c := b.window.counts(now); c.calls >= b.cfg.MinimumCalls && b.tripped(c) {
+				changed = b.moveTo(Open, now)
+			}
+		case HalfOpen:
+			if b.cfg.IsAbandoned(err) {
+				b.probes-- // no answer: the next call probes instead
+				break
+			}
+			b.probed.add(o)
+			if b.probed.calls >= b.cfg.HalfOpenProbes {
+				if b.tripped(b.probed) {
+					changed = b.moveTo(Open, now)
+				} else {
+					changed = b.moveTo(Closed, now)
+				}
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.notify(changed)
+}
+
+func (b *Breaker) tripped(c counts) bool {
+	if c.calls == 0 {
+		return false
+	}
+	failureRate := 100 * float64(c.failures) / float64(c.calls)
+	slowRate := 100 * float64(c.slow) / float64(c.calls)
+	return failureRate >= b.cfg.FailureRateThreshold || (b.cfg.SlowCallDuration > 0 && slowRate >= b.cfg.SlowCallRateThreshold)
+}
+
+// advance moves an open breaker to half-open once its time is up.
+func (b *Breaker) advance(now time.Time) []transition {
+	if b.state == Open && !now.Before(b.openUntil) {
+		return b.moveTo(HalfOpen, now)
+	}
+	return nil
+}
+
+type transition struct{ from, to State }
+
+func (b *Breaker) moveTo(to State, now time.Time) []transition {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.probes, b.probed = 0, counts{}
+	b.window.reset()
+	if to == Open {
+		b.openUntil = now.Add(b.cfg.OpenDuration)
+	}
+	return []transition{{from, to}}
+}
+
+func (b *Breaker) notify(changed []transition) {
+	if b.cfg.OnStateChange == nil {
+		return
+	}
+	for _, t := range changed {
+		b.cfg.OnStateChange(b.cfg.Name, t.from, t.to)
+	}
+}
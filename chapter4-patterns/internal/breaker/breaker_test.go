@@ -0,0 +1,276 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock is a manual time source.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock() *clock { return &clock{now: time.Unix(1_700_000_000, 0)} }
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+var errBoom = errors.New("boom")
+
+func mustNew(t *testing.T, cfg Config) *Breaker {
+	t.Helper()
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// calls records n calls with the given error.
+func calls(b *Breaker, n int, err error) {
+	for i := 0; i < n; i++ {
+		b.Do(func() error { return err })
+	}
+}
+
+func TestCountWindowFailureRate(t *testing.T) {
+	c := newClock()
+	var changes []string
+	b := mustNew(t, Config{
+		Name: "risk", WindowSize: 10, MinimumCalls: 5, FailureRateThreshold: 50,
+		OpenDuration: 10 * time.Second, Now: c.Now,
+		OnStateChange: func(name string, from, to State) { changes = append(changes, name+":"+from.String()+">"+to.String()) },
+	})
+
+	// 4 failures out of 10 is 40%.
+	calls(b, 6, nil)
+	calls(b, 4, errBoom)
+	if s := b.State(); s != Closed {
+		t.Fatalf("at 40%%: %s", s)
+	}
+	// The oldest success slides out: 5 of the last 10 failed.
+	calls(b, 1, errBoom)
+	if s := b.State(); s != Open {
+		t.Fatalf("at 50%%: %s", s)
+	}
+	if err := b.Do(func() error { t.Fatal("called while open"); return nil }); !errors.Is(err, ErrOpen) {
+		t.Fatalf("while open: %v", err)
+	}
+
+	c.advance(10 * time.Second)
+	if s := b.State(); s != HalfOpen {
+		t.Fatalf("after the open duration: %s", s)
+	}
+	calls(b, 1, nil)
+	if s := b.State(); s != Closed {
+		t.Fatalf("after a good probe: %s", s)
+	}
+	want := []string{"risk:closed>open", "risk:open>half-open", "risk:half-open>closed"}
+	if len(changes) != len(want) {
+		t.Fatalf("state changes %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("state changes %v, want %v", changes, want)
+		}
+	}
+}
+
+func TestMinimumCalls(t *testing.T) {
+	b := mustNew(t, Config{WindowSize: 10, MinimumCalls: 5})
+	calls(b, 4, errBoom)
+	if s := b.State(); s != Closed {
+		t.Fatalf("4 failures, below the minimum: %s", s)
+	}
+	calls(b, 1, errBoom)
+	if s := b.State(); s != Open {
+		t.Fatalf("5 failures: %s", s)
+	}
+}
+
+func TestTimeWindowForgetsOldCalls(t *testing.T) {
+	c := newClock()
+	b := mustNew(t, Config{Window: TimeBased, WindowDuration: 5 * time.Second, MinimumCalls: 4, FailureRateThreshold: 50, Now: c.Now})
+
+	calls(b, 3, errBoom)
+	c.advance(5 * time.Second) // those failures are out of the window now
+	calls(b, 3, nil)
+	calls(b, 1, errBoom)
+	if s := b.State(); s != Closed {
+		t.Fatalf("1 of 4 recent calls failed: %s", s)
+	}
+	c.advance(2 * time.Second)
+	calls(b, 3, errBoom)
+	if s := b.State(); s != Open {
+		t.Fatalf("3 of 6 recent calls failed: %s", s)
+	}
+}
+
+func TestSlowCallRate(t *testing.T) {
+	c := newClock()
+	b := mustNew(t, Config{WindowSize: 4, MinimumCalls: 4, SlowCallDuration: time.Second, SlowCallRateThreshold: 75, Now: c.Now})
+	slow := func() error { c.advance(time.Second); return nil }
+
+	b.Do(slow)
+	b.Do(slow)
+	calls(b, 2, nil)
+	if s := b.State(); s != Closed {
+		t.Fatalf("2 of 4 slow: %s", s)
+	}
+	b.Do(slow)
+	b.Do(slow)
+	b.Do(slow)
+	if s := b.State(); s != Open {
+		t.Fatalf("3 of the last 4 slow: %s", s)
+	}
+}
+
+func TestHalfOpenProbes(t *testing.T) {
+	c := newClock()
+	b := mustNew(t, Config{WindowSize: 2, MinimumCalls: 2, HalfOpenProbes: 2, FailureRateThreshold: 50, OpenDuration: time.Second, Now: c.Now})
+	calls(b, 2, errBoom)
+	c.advance(time.Second)
+
+	// Two probes at a time; a third caller is refused until they report.
+	done1, err1 := b.Allow()
+	done2, err2 := b.Allow()
+	if err1 != nil || err2 != nil {
+		t.Fatalf("probes refused: %v, %v", err1, err2)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("third probe: %v", err)
+	}
+	done1(nil)
+	if s := b.State(); s != HalfOpen {
+		t.Fatalf("after one probe: %s", s)
+	}
+	done2(errBoom) // 1 of 2 probes failed: 50%, back to open
+	if s := b.State(); s != Open {
+		t.Fatalf("after a failed probe: %s", s)
+	}
+
+	c.advance(time.Second)
+	calls(b, 2, nil)
+	if s := b.State(); s != Closed {
+		t.Fatalf("after good probes: %s", s)
+	}
+}
+
+func TestLateOutcomesAreIgnored(t *testing.T) {
+	c := newClock()
+	b := mustNew(t, Config{WindowSize: 2, MinimumCalls: 2, Now: c.Now})
+	done, _ := b.Allow() // started while closed
+	calls(b, 2, errBoom)
+	c.advance(10 * time.Second)
+	b.State() // half-open
+	done(nil) // must not count as the probe
+	if s := b.State(); s != HalfOpen {
+		t.Fatalf("a call from before the trip closed the breaker: %s", s)
+	}
+	done(errBoom) // and only the first report counts
+}
+
+func TestCanceledCallsAreNotFailures(t *testing.T) {
+	b := mustNew(t, Config{WindowSize: 2, MinimumCalls: 2})
+	calls(b, 2, context.Canceled)
+	if s := b.State(); s != Closed {
+		t.Fatalf("caller cancellations tripped the breaker: %s", s)
+	}
+	calls(b, 2, context.DeadlineExceeded)
+	if s := b.State(); s != Open {
+		t.Fatalf("timeouts did not trip the breaker: %s", s)
+	}
+}
+
+func TestAbandonedProbesAreNoAnswer(t *testing.T) {
+	c := newClock()
+	b := mustNew(t, Config{WindowSize: 2, MinimumCalls: 2, OpenDuration: time.Second, Now: c.Now})
+	calls(b, 2, errBoom)
+	c.advance(time.Second)
+
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	done(context.Canceled)
+	if s := b.State(); s != HalfOpen {
+		t.Fatalf("an abandoned probe moved the breaker to %s", s)
+	}
+	// Its slot is free again, and a real answer decides.
+	if err := b.Do(func() error { return errBoom }); !errors.Is(err, errBoom) {
+		t.Fatalf("second probe: %v", err)
+	}
+	if s := b.State(); s != Open {
+		t.Fatalf("after a failed probe: %s", s)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"window type":    {Window: 7},
+		"threshold":      {FailureRateThreshold: 150},
+		"short window":   {Window: TimeBased, WindowDuration: time.Millisecond},
+		"negative probe": {HalfOpenProbes: -1},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	c := newClock()
+	b := mustNew(t, Config{WindowSize: 3, MinimumCalls: 3, OpenDuration: time.Second, Now: c.Now})
+	client := &http.Client{Transport: b.Transport(nil)}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrOpen) {
+		t.Fatalf("open breaker: %v", err)
+	}
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	c.advance(time.Second)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := b.State(); s != Closed {
+		t.Fatalf("after a good probe: %s", s)
+	}
+}
@@ -0,0 +1,54 @@
+package breaker
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Transport wraps base (nil: http.DefaultTransport) so that requests go
+// through the breaker: while it is open they fail with ErrOpen without
+// leaving the process. Transport errors and 5xx responses count as
+// failures; a call's duration is the time to the response headers.
+//
+//	client := &http.Client{Transport: b.Transport(nil), Timeout: time.Second}
+func (b *Breaker) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{b: b, base: base}
+}
+
+type transport struct {
+	b    *Breaker
+	base http.RoundTripper
+}
+
+// StatusError is what the breaker records for a 5xx response. The caller
+// still gets the response itself.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream answered %d", e.StatusCode)
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	done, err := t.b.Allow()
+	if err != nil {
+		if r.Body != nil {
+			r.Body.Close() // RoundTrip must close it, even on error
+		}
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(r)
+	switch {
+	case err != nil:
+		done(err)
+	case resp.StatusCode >= 500:
+		done(&StatusError{StatusCode: resp.StatusCode})
+	default:
+		done(nil)
+	}
+	return resp, err
+}
@@ -0,0 +1,115 @@
+package breaker
+
+import "time"
+
+// outcome is one finished call.
+type outcome struct {
+	failed bool
+	slow   bool
+}
+
+// counts sums outcomes.
+type counts struct {
+	calls, failures, slow int
+}
+
+func (c *counts) add(o outcome) {
+	c.calls++
+	if o.failed {
+		c.failures++
+	}
+	if o.slow {
+		c.slow++
+	}
+}
+
+func (c *counts) sub(o outcome) {
+	c.calls--
+	if o.failed {
+		c.failures--
+	}
+	if o.slow {
+		c.slow--
+	}
+}
+
+// window is the sliding window of a closed breaker.
+type window interface {
+	add(now time.Time, o outcome)
+	counts(now time.Time) counts
+	reset()
+}
+
+// countWindow keeps the last len(ring) outcomes.
+type countWindow struct {
+	ring  []outcome
+	next  int
+	full  bool
+	total counts
+}
+
+func newCountWindow(size int) *countWindow {
+	return &countWindow{ring: make([]outcome, size)}
+}
+
+func (w *countWindow) add(_ time.Time, o outcome) {
+	if w.full {
+		w.total.sub(w.ring[w.next])
+	}
+	w.ring[w.next] = o
+	w.total.add(o)
+	w.next++
+	if w.next == len(w.ring) {
+		w.next, w.full = 0, true
+	}
+}
+
+func (w *countWindow) counts(time.Time) counts { return w.total }
+
+func (w *countWindow) reset() {
+	w.next, w.full, w.total = 0, false, counts{}
+}
+
+// timeWindow keeps one bucket per second for the last len(buckets) seconds.
+// A bucket belongs to the second in its sec field; one from an older lap
+// of the ring is stale and counts as empty.
+type timeWindow struct {
+	buckets []bucket
+}
+
+type bucket struct {
+	sec int64
+	counts
+}
+
+func newTimeWindow(seconds int) *timeWindow {
+	return &timeWindow{buckets: make([]bucket, seconds)}
+}
+
+func (w *timeWindow) add(now time.Time, o outcome) {
+	sec := now.Unix()
+	b := &w.buckets[sec%int64(len(w.buckets))]
+	if b.sec != sec {
+		*b = bucket{sec: sec}
+	}
+	b.add(o)
+}
+
+func (w *timeWindow) counts(now time.Time) counts {
+	oldest := now.Unix() - int64(len(w.buckets)) + 1
+	var total counts
+	for _, b := range w.buckets {
+		if b.sec >= oldest && b.calls > 0 {
+			total.calls += b.calls
+			total.failures += b.failures
+			total.slow += b.slow
+		}
+	}
+	return total
+}
+
+func (w *timeWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = bucket{}
+	}
+}
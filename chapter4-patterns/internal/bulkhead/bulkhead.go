@@ -0,0 +1,238 @@
+// Package bulkhead caps the number of concurrent calls to a dependency, so
+// that a slow dependency holds on to a bounded number of goroutines and
+// sockets instead of all of them.
+//
+// A call takes a slot with Acquire and gives it back with done. When every
+// slot is taken, up to MaxQueue callers wait, each for at most QueueTimeout;
+// the others are turned away at once with ErrFull. Callers are expected to
+// serve a fallback when they are turned away.
+//
+//	b, err := bulkhead.New(bulkhead.Config{Name: "risk", MaxConcurrent: 20, MaxQueue: 10, QueueTimeout: 100 * time.Millisecond})
+//	done, err := b.Acquire(ctx)
+//	if err != nil {
+//		return fallback() // saturated
+//	}
+//	resp, err := client.Do(req)
+//	done(err)
+//
+// With Config.Adaptive set, the limit itself moves with the dependency's
+// latency (AIMD): it grows by about one slot per limit's worth of calls that
+// finish within the latency target, and shrinks by a factor on every slow or
+// failed call. A dependency that slows down gets fewer concurrent calls,
+// which is usually what lets it recover.
+package bulkhead
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned when every slot is taken and the queue is full.
+	ErrFull = errors.New("bulkhead full")
+	// ErrQueueTimeout is returned when a queued caller waited QueueTimeout
+	// without getting a slot.
+	ErrQueueTimeout = errors.New("bulkhead queue timeout")
+)
+
+// Config is the bulkhead's settings.
+type Config struct {
+	Name string // for errors
+
+	MaxConcurrent int           // slots; the starting limit in adaptive mode (default 10)
+	MaxQueue      int           // callers that may wait for a slot (default 0: none)
+	QueueTimeout  time.Duration // longest wait in the queue (default 0: until the caller's context ends)
+
+	Adaptive *Adaptive // nil: the limit stays MaxConcurrent
+
+	// OnLimitChange is called when an adaptive limit changes, outside the
+	// bulkhead's lock.
+	OnLimitChange func(name string, from, to int)
+	// Now is the clock (default time.Now); tests replace it.
+	Now func() time.Time
+}
+
+// Adaptive moves the limit with latency, between MinLimit and MaxLimit.
+type Adaptive struct {
+	MinLimit      int           // default 1
+	MaxLimit      int           // default 10 * MaxConcurrent
+	LatencyTarget time.Duration // calls slower than this (or failing) shrink the limit
+	Backoff       float64       // the factor the limit shrinks by (default 0.9)
+	// IsFailure decides whether a call's error shrinks the limit. Default:
+	// any error except context.Canceled (the caller gave up).
+	IsFailure func(err error) bool
+}
+
+func (c *Config) setDefaults() error {
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 10
+	}
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+	if c.MaxConcurrent < 0 || c.MaxQueue < 0 || c.QueueTimeout < 0 {
+		return fmt.Errorf("bulkhead %s: negative limit, queue or timeout", c.Name)
+	}
+	if a := c.Adaptive; a != nil {
+		if a.MinLimit == 0 {
+			a.MinLimit = 1
+		}
+		if a.MaxLimit == 0 {
+			a.MaxLimit = 10 * c.MaxConcurrent
+		}
+		if a.Backoff == 0 {
+			a.Backoff = 0.9
+		}
+		if a.IsFailure == nil {
+			a.IsFailure = func(err error) bool { return err != nil && !errors.Is(err, context.Canceled) }
+		}
+		switch {
+		case a.LatencyTarget <= 0:
+			return fmt.Errorf("bulkhead %s: adaptive mode needs a latency target", c.Name)
+		case a.MinLimit < 1 || a.MinLimit > c.MaxConcurrent || c.MaxConcurrent > a.MaxLimit:
+			return fmt.Errorf("bulkhead %s: want 1 <= min limit (%d) <= max concurrent (%d) <= max limit (%d)", c.Name, a.MinLimit, c.MaxConcurrent, a.MaxLimit)
+		case a.Backoff <= 0 || a.Backoff >= 1:
+			return fmt.Errorf("bulkhead %s: backoff %v is not in (0, 1)", c.Name, a.Backoff)
+		}
+	}
+	return nil
+}
+
+// Bulkhead is safe for concurrent use.
+type Bulkhead struct {
+	cfg Config
+
+	mu       sync.Mutex
+	limit    float64 // fractional, so that additive increase can be gradual
+	inFlight int
+	queue    []chan struct{} // waiting callers, oldest first; closed when granted a slot
+}
+
+// New builds a bulkhead with every slot free.
+func New(cfg Config) (*Bulkhead, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	return &Bulkhead{cfg: cfg, limit: float64(cfg.MaxConcurrent)}, nil
+}
+
+// Stats is a snapshot of the bulkhead.
+type Stats struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+// Stats reports the current limit and usage.
+func (b *Bulkhead) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Stats{Limit: int(b.limit), InFlight: b.inFlight, Queued: len(b.queue)}
+}
+
+// Acquire takes a slot, waiting in the queue if there is room. When it
+// succeeds, done must be called exactly once with the call's outcome;
+// otherwise err is ErrFull, ErrQueueTimeout or the context's error.
+func (b *Bulkhead) Acquire(ctx context.Context) (done func(err error), err error) {
+	b.mu.Lock()
+	if b.inFlight < int(b.limit) && len(b.queue) == 0 {
+		b.inFlight++
+		b.mu.Unlock()
+		return b.doneFunc(), nil
+	}
+	if len(b.queue) >= b.cfg.MaxQueue {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w", b.cfg.Name, ErrFull)
+	}
+	granted := make(chan struct{})
+	b.queue = append(b.queue, granted)
+	b.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if b.cfg.QueueTimeout > 0 {
+		t := time.NewTimer(b.cfg.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-granted:
+		return b.doneFunc(), nil
+	case <-timeout:
+		err = fmt.Errorf("%s: %w", b.cfg.Name, ErrQueueTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, ch := range b.queue {
+		if ch == granted {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			return nil, err
+		}
+	}
+	// Granted a slot just as we gave up: keep it.
+	return b.doneFunc(), nil
+}
+
+// TryAcquire takes a slot only if one is free right now: it never waits,
+// and never jumps ahead of queued callers. It suits optional extra calls,
+// such as a hedge, that are skipped rather than delayed. When ok, done must
+// be called exactly once with the call's outcome.
+func (b *Bulkhead) TryAcquire() (done func(err error), ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inFlight < int(b.limit) && len(b.queue) == 0 {
+		b.inFlight++
+		return b.doneFunc(), true
+	}
+	return nil, false
+}
+
+// Do runs fn in a slot and records its error.
+func (b *Bulkhead) Do(ctx context.Context, fn func() error) error {
+	done, err := b.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+func (b *Bulkhead) doneFunc() func(error) {
+	start := b.cfg.Now()
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.release(b.cfg.Now().Sub(start), err) })
+	}
+}
+
+func (b *Bulkhead) release(latency time.Duration, err error) {
+	b.mu.Lock()
+	b.inFlight--
+	from := int(b.limit)
+	if a := b.cfg.Adaptive; a != nil {
+		if a.IsFailure(err) || latency > a.LatencyTarget {
+			b.limit = math.Max(float64(a.MinLimit), b.limit*a.Backoff)
+		} else if b.inFlight+1 >= int(b.limit)/2 {
+			// Only grow a limit that is being used.
+			b.limit = math.Min(float64(a.MaxLimit), b.limit+1/b.limit)
+		}
+	}
+	to := int(b.limit)
+	for b.inFlight < to && len(b.queue) > 0 {
+		b.inFlight++
+		close(b.queue[0])
+		b.queue = b.queue[1:]
+	}
+	b.mu.Unlock()
+
+	if from != to && b.cfg.OnLimitChange != nil {
+		b.cfg.OnLimitChange(b.cfg.Name, from, to)
+	}
+}
@@ -0,0 +1,229 @@
+package bulkhead
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustNew(t *testing.T, cfg Config) *Bulkhead {
+	t.Helper()
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLimitAndQueue(t *testing.T) {
+	b := mustNew(t, Config{Name: "risk", MaxConcurrent: 2, MaxQueue: 1, QueueTimeout: time.Second})
+	ctx := context.Background()
+
+	done1, err1 := b.Acquire(ctx)
+	done2, err2 := b.Acquire(ctx)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("free slots refused: %v, %v", err1, err2)
+	}
+
+	queued := make(chan error)
+	go func() {
+		done, err := b.Acquire(ctx)
+		if err == nil {
+			done(nil)
+		}
+		queued <- err
+	}()
+	for b.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Both slots and the one queue place are taken.
+	if _, err := b.Acquire(ctx); !errors.Is(err, ErrFull) {
+		t.Fatalf("with a full queue: %v", err)
+	}
+
+	done1(nil)
+	if err := <-queued; err != nil {
+		t.Fatalf("queued caller: %v", err)
+	}
+	done2(nil)
+	if s := b.Stats(); s != (Stats{Limit: 2}) {
+		t.Fatalf("stats after all calls: %+v", s)
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	b := mustNew(t, Config{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: time.Second})
+	done, ok := b.TryAcquire()
+	if !ok {
+		t.Fatal("free slot refused")
+	}
+	if _, ok := b.TryAcquire(); ok {
+		t.Fatal("took a slot over the limit")
+	}
+
+	// The slot freed next goes to the queued caller.
+	queued := make(chan func(error))
+	go func() {
+		d, _ := b.Acquire(context.Background())
+		queued <- d
+	}()
+	for b.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done(nil)
+	d := <-queued
+	if _, ok := b.TryAcquire(); ok {
+		t.Fatal("took the slot handed to the queued caller")
+	}
+	d(nil)
+	if s := b.Stats(); s != (Stats{Limit: 1}) {
+		t.Fatalf("stats after all calls: %+v", s)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	b := mustNew(t, Config{MaxConcurrent: 1, MaxQueue: 5, QueueTimeout: 20 * time.Millisecond})
+	done, _ := b.Acquire(context.Background())
+	start := time.Now()
+	if _, err := b.Acquire(context.Background()); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("waited past the timeout: %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Fatalf("gave up after %s", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled caller: %v", err)
+	}
+	if s := b.Stats(); s.Queued != 0 || s.InFlight != 1 {
+		t.Fatalf("stats: %+v", s)
+	}
+	done(nil)
+}
+
+func TestNoQueue(t *testing.T) {
+	b := mustNew(t, Config{MaxConcurrent: 1})
+	err := b.Do(context.Background(), func() error {
+		if _, err := b.Acquire(context.Background()); !errors.Is(err, ErrFull) {
+			t.Errorf("second call: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrencyNeverExceedsLimit(t *testing.T) {
+	b := mustNew(t, Config{MaxConcurrent: 3, MaxQueue: 100})
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Do(context.Background(), func() error {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if peak != 3 {
+		t.Fatalf("peak concurrency %d, want 3", peak)
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Unix(1_700_000_000, 0)
+	clock := func() time.Time { mu.Lock(); defer mu.Unlock(); return now }
+	call := func(b *Bulkhead, latency time.Duration, err error) {
+		done, aerr := b.Acquire(context.Background())
+		if aerr != nil {
+			t.Fatal(aerr)
+		}
+		mu.Lock()
+		now = now.Add(latency)
+		mu.Unlock()
+		done(err)
+	}
+
+	var changes [][2]int
+	b := mustNew(t, Config{
+		MaxConcurrent: 4, Now: clock,
+		Adaptive:      &Adaptive{MinLimit: 2, MaxLimit: 5, LatencyTarget: 100 * time.Millisecond, Backoff: 0.5},
+		OnLimitChange: func(_ string, from, to int) { changes = append(changes, [2]int{from, to}) },
+	})
+
+	// Slow calls halve the limit, down to the minimum.
+	call(b, time.Second, nil)
+	if l := b.Stats().Limit; l != 2 {
+		t.Fatalf("after a slow call: limit %d", l)
+	}
+	call(b, time.Millisecond, errors.New("boom"))
+	if l := b.Stats().Limit; l != 2 {
+		t.Fatalf("below the minimum: limit %d", l)
+	}
+
+	// Fast calls grow it by about one per limit's worth of calls.
+	for i := 0; i < 3; i++ {
+		call(b, time.Millisecond, nil)
+	}
+	if l := b.Stats().Limit; l != 3 {
+		t.Fatalf("after 3 fast calls: limit %d", l)
+	}
+	// But only while at least half of it is in use: one call at a time
+	// is half of 3 (rounded down), not of 4.
+	for i := 0; i < 100; i++ {
+		call(b, time.Millisecond, nil)
+	}
+	if l := b.Stats().Limit; l != 4 {
+		t.Fatalf("after one call at a time: limit %d", l)
+	}
+	held1, _ := b.Acquire(context.Background())
+	held2, _ := b.Acquire(context.Background())
+	for i := 0; i < 100; i++ {
+		call(b, time.Millisecond, nil)
+	}
+	held1(nil)
+	held2(nil)
+	if l := b.Stats().Limit; l != 5 {
+		t.Fatalf("after many fast calls in a busy bulkhead: limit %d", l)
+	}
+	// A caller giving up isn't the dependency's fault.
+	call(b, time.Millisecond, context.Canceled)
+	if l := b.Stats().Limit; l != 5 {
+		t.Fatalf("after a canceled call: limit %d", l)
+	}
+	if len(changes) == 0 || changes[0] != [2]int{4, 2} {
+		t.Fatalf("limit changes %v", changes)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"negative queue": {MaxQueue: -1},
+		"no target":      {Adaptive: &Adaptive{}},
+		"min over start": {MaxConcurrent: 2, Adaptive: &Adaptive{LatencyTarget: time.Second, MinLimit: 3}},
+		"backoff":        {Adaptive: &Adaptive{LatencyTarget: time.Second, Backoff: 1.5}},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
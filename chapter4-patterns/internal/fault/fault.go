@@ -0,0 +1,414 @@
+// Package fault injects latency, errors and connection resets into the
+// simulated services, so that resilience behaviour (timeouts, retries,
+// circuit breakers) can be demonstrated, and reproduced in tests.
+//
+// Faults are set per endpoint (request path) by a Profile. Every request to
+// a profiled endpoint draws three numbers from that endpoint's random
+// source, whether or not a fault fires, in this order: reset, error, delay
+// (plus what the delay's distribution needs, when it fires). The sources
+// are seeded from Config.Seed, so the same seed and the same sequence of
+// requests give the same faults. The seed in use is always reported by the
+// admin API, even when it was picked at random.
+//
+// Each fault fires on its own draw, so a request can be both slow and
+// failing. An Exclusive profile decides on the first draw alone: reset,
+// error and delay then take separate slices of it, and a request gets at
+// most one of them.
+//
+// Faults can be changed at runtime through the admin API:
+//
+//	GET    /admin/faults   the current config, with its seed
+//	PUT    /admin/faults   replace it, and start the random sources over
+//	DELETE /admin/faults   back to the startup config, reseeded
+//
+// and, when <PREFIX>_FAULT_HEADERS=true, overridden for one request with
+// headers:
+//
+//	X-Fault-Delay: 300ms   delay this request by this much (at most MaxHeaderDelay)
+//	X-Fault-Status: 503    answer with this status
+//	X-Fault-Reset: true    reset the connection instead of answering
+//	X-Fault-Skip: true     no random faults for this request
+package fault
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the faults of every endpoint.
+type Config struct {
+	Seed      int64              `json:"seed"` // 0: pick one at random
+	Endpoints map[string]Profile `json:"endpoints"`
+}
+
+// Profile is the faults of one endpoint. Rates are fractions of requests,
+// from 0 to 1.
+type Profile struct {
+	Latency     Latency `json:"latency"`
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	ErrorStatus int     `json:"error_status,omitempty"` // default 500
+	ErrorBody   string  `json:"error_body,omitempty"`   // default {"error":"injected_fault"}
+	ResetRate   float64 `json:"reset_rate,omitempty"`   // connections closed with a TCP reset
+	// At most one fault per request; the three rates must add up to 1 or less.
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// Latency is the extra delay of some requests.
+type Latency struct {
+	Rate float64 `json:"rate,omitempty"`
+	// fixed (default): Delay. uniform: between Delay and Delay+Jitter.
+	// normal: mean Delay, standard deviation Jitter. exponential: mean Delay.
+	Distribution string   `json:"distribution,omitempty"`
+	Delay        Duration `json:"delay,omitempty"`
+	Jitter       Duration `json:"jitter,omitempty"`
+}
+
+// Duration is a time.Duration written as a string in JSON ("1.2s").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"300ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (c *Config) validate() error {
+	for path, p := range c.Endpoints {
+		switch {
+		case !strings.HasPrefix(path, "/"):
+			return fmt.Errorf("endpoint %q: must be a path starting with /", path)
+		case !isRate(p.ErrorRate), !isRate(p.ResetRate), !isRate(p.Latency.Rate):
+			return fmt.Errorf("endpoint %s: rates must be between 0 and 1", path)
+		case p.ErrorStatus != 0 && (p.ErrorStatus < 400 || p.ErrorStatus > 599):
+			return fmt.Errorf("endpoint %s: error_status %d is not a 4xx or 5xx", path, p.ErrorStatus)
+		case p.Latency.Delay < 0, p.Latency.Jitter < 0:
+			return fmt.Errorf("endpoint %s: negative delay", path)
+		case p.Exclusive && p.ResetRate+p.ErrorRate+p.Latency.Rate > 1:
+			return fmt.Errorf("endpoint %s: exclusive rates add up to more than 1", path)
+		}
+		switch p.Latency.Distribution {
+		case "", "fixed", "uniform", "normal", "exponential":
+		default:
+			return fmt.Errorf("endpoint %s: unknown distribution %q (want fixed, uniform, normal or exponential)", path, p.Latency.Distribution)
+		}
+	}
+	return nil
+}
+
+func isRate(f float64) bool { return f >= 0 && f <= 1 }
+
+// MaxHeaderDelay caps X-Fault-Delay, so that one request can't hold a
+// handler (and its connection) for as long as it likes.
+const MaxHeaderDelay = 10 * time.Second
+
+// Injector applies a Config to requests. It is safe for concurrent use.
+type Injector struct {
+	name       string // log prefix
+	headers    bool   // honour X-Fault-* request headers; off by default
+	adminToken string // X-Admin-Token for the admin API; empty: disabled
+
+	mu       sync.Mutex
+	startup  Config
+	current  Config
+	random   map[string]*rand.Rand // per endpoint
+	injected map[string]int        // per fault kind, since the last reconfiguration
+}
+
+// New builds an injector applying cfg. A zero seed is replaced by a random
+// one.
+func New(name string, cfg Config) (*Injector, error) {
+	in := &Injector{name: name}
+	if err := in.configure(cfg); err != nil {
+		return nil, err
+	}
+	in.startup = in.current
+	return in, nil
+}
+
+// FromEnv builds an injector for service name, starting from defaults,
+// then reading <PREFIX>_FAULTS (a JSON Config file that replaces them),
+// <PREFIX>_FAULT_SEED, <PREFIX>_FAULT_HEADERS ("true" to honour the
+// X-Fault-* request headers) and <PREFIX>_ADMIN_TOKEN, where PREFIX is name
+// in upper case.
+func FromEnv(name string, defaults Config) (*Injector, error) {
+	prefix := strings.ToUpper(name)
+	cfg := defaults
+	if path := os.Getenv(prefix + "_FAULTS"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg = Config{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if s := os.Getenv(prefix + "_FAULT_SEED"); s != "" {
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s_FAULT_SEED: invalid seed %q", prefix, s)
+		}
+		cfg.Seed = seed
+	}
+	in, err := New(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	in.headers = os.Getenv(prefix+"_FAULT_HEADERS") == "true"
+	in.adminToken = os.Getenv(prefix + "_ADMIN_TOKEN")
+	log.Printf("[%s] fault injection: %d endpoints, seed %d, headers %v", name, len(in.current.Endpoints), in.current.Seed, in.headers)
+	return in, nil
+}
+
+func (in *Injector) configure(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	endpoints := make(map[string]Profile, len(cfg.Endpoints))
+	random := make(map[string]*rand.Rand, len(cfg.Endpoints))
+	for path, p := range cfg.Endpoints {
+		endpoints[path] = p
+		// Each endpoint has its own source, so that traffic to one doesn't
+		// shift the faults of another.
+		h := fnv.New64a()
+		h.Write([]byte(path))
+		random[path] = rand.New(rand.NewSource(cfg.Seed ^ int64(h.Sum64())))
+	}
+	cfg.Endpoints = endpoints
+
+	in.mu.Lock()
+	in.current, in.random, in.injected = cfg, random, map[string]int{}
+	in.mu.Unlock()
+	return nil
+}
+
+// fault is what happens to one request.
+type fault struct {
+	reset  bool
+	status int
+	body   string
+	delay  time.Duration
+}
+
+func (in *Injector) draw(r *http.Request) (f fault, ok bool) {
+	in.mu.Lock()
+	p, ok := in.current.Endpoints[r.URL.Path]
+	if ok {
+		rng := in.random[r.URL.Path]
+		resetDraw, errorDraw, delayDraw := rng.Float64(), rng.Float64(), rng.Float64()
+		if p.Exclusive {
+			// The first draw alone, cut into [reset | error | delay | none].
+			x := resetDraw
+			errorDraw, delayDraw = 1, 1
+			switch {
+			case x < p.ResetRate:
+			case x < p.ResetRate+p.ErrorRate:
+				errorDraw = x - p.ResetRate
+			default:
+				delayDraw = x - p.ResetRate - p.ErrorRate
+			}
+		}
+		f.reset = resetDraw < p.ResetRate
+		if errorDraw < p.ErrorRate {
+			f.status, f.body = p.ErrorStatus, p.ErrorBody
+			if f.status == 0 {
+				f.status = http.StatusInternalServerError
+			}
+		}
+		if delayDraw < p.Latency.Rate {
+			f.delay = p.Latency.sample(rng)
+		}
+	}
+	in.mu.Unlock()
+
+	if in.headers {
+		if r.Header.Get("X-Fault-Skip") == "true" {
+			f = fault{}
+		}
+		if d, err := time.ParseDuration(r.Header.Get("X-Fault-Delay")); err == nil && d >= 0 {
+			f.delay, ok = min(d, MaxHeaderDelay), true
+		}
+		if code, err := strconv.Atoi(r.Header.Get("X-Fault-Status")); err == nil && code >= 400 && code <= 599 {
+			f.status, f.body, ok = code, "", true
+		}
+		if r.Header.Get("X-Fault-Reset") == "true" {
+			f.reset, ok = true, true
+		}
+	}
+	if f.status != 0 && f.body == "" {
+		f.body = `{"error":"injected_fault"}`
+	}
+	return f, ok
+}
+
+func (l Latency) sample(rng *rand.Rand) time.Duration {
+	delay, jitter := float64(l.Delay), float64(l.Jitter)
+	var d float64
+	switch l.Distribution {
+	case "uniform":
+		d = delay + rng.Float64()*jitter
+	case "normal":
+		d = delay + rng.NormFloat64()*jitter
+	case "exponential":
+		d = rng.ExpFloat64() * delay
+	default:
+		d = delay
+	}
+	return time.Duration(math.Max(0, d))
+}
+
+// Handler injects faults into the requests for profiled endpoints (and,
+// when headers are honoured, any request with X-Fault-* headers) before
+// passing them to next.
+func (in *Injector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/faults") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f, ok := in.draw(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if f.delay > 0 {
+			in.count("delay")
+			select {
+			case <-time.After(f.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case f.reset:
+			in.count("reset")
+			reset(w)
+		case f.status != 0:
+			in.count("error")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(f.status)
+			w.Write([]byte(f.body))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (in *Injector) count(kind string) {
+	in.mu.Lock()
+	in.injected[kind]++
+	in.mu.Unlock()
+}
+
+// reset closes the client connection with a TCP RST, so the client sees
+// "connection reset by peer" rather than a clean EOF.
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler) // HTTP/2: the stream is reset instead
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// AdminHandler serves /admin/faults. It answers 404 when no admin token
+// is configured.
+func (in *Injector) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if in.adminToken == "" {
+			http.Error(w, `{"error":"admin_api_disabled"}`, http.StatusNotFound)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(in.adminToken)) != 1 {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var cfg Config
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&cfg)
+			if err == nil {
+				err = in.configure(cfg)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+		case http.MethodDelete:
+			startup := in.startup
+			startup.Seed = 0 // a fresh seed, unless the request asks for one
+			if s := r.URL.Query().Get("seed"); s != "" {
+				seed, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					http.Error(w, `{"error":"invalid seed"}`, http.StatusBadRequest)
+					return
+				}
+				startup.Seed = seed
+			}
+			if err := in.configure(startup); err != nil {
+				http.Error(w, `{"error":"internal"}`, http.StatusInternalServerError)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		json.NewEncoder(w).Encode(in.snapshot())
+	})
+}
+
+// Snapshot is the admin API's view of the injector.
+type Snapshot struct {
+	Config
+	Headers  bool           `json:"headers"`  // whether X-Fault-* headers are honoured
+	Injected map[string]int `json:"injected"` // faults injected since the last change, by kind
+}
+
+func (in *Injector) snapshot() Snapshot {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	injected := make(map[string]int, len(in.injected))
+	for k, v := range in.injected {
+		injected[k] = v
+	}
+	return Snapshot{Config: in.current, Headers: in.headers, Injected: injected}
+}
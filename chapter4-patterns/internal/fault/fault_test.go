@@ -0,0 +1,249 @@
+package fault
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+
+func mustNew(t *testing.T, cfg Config) *Injector {
+	t.Helper()
+	in, err := New("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+// statuses sends n requests to path and returns the status codes.
+func statuses(h http.Handler, path string, n int) []int {
+	var codes []int
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		codes = append(codes, w.Code)
+	}
+	return codes
+}
+
+func TestSeededFaultsRepeat(t *testing.T) {
+	cfg := Config{Seed: 42, Endpoints: map[string]Profile{"/score": {ErrorRate: 0.3, ErrorStatus: 503}}}
+	first := statuses(mustNew(t, cfg).Handler(ok), "/score", 50)
+	again := statuses(mustNew(t, cfg).Handler(ok), "/score", 50)
+	errs := 0
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("request %d: %d, then %d with the same seed", i, first[i], again[i])
+		}
+		if first[i] == 503 {
+			errs++
+		}
+	}
+	if errs < 5 || errs > 25 {
+		t.Fatalf("%d errors in 50 requests at 30%%", errs)
+	}
+
+	cfg.Seed = 43
+	other := statuses(mustNew(t, cfg).Handler(ok), "/score", 50)
+	if equal(first, other) {
+		t.Fatal("another seed gave the same faults")
+	}
+}
+
+func equal(a, b []int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUnprofiledEndpointsAreUntouched(t *testing.T) {
+	h := mustNew(t, Config{Endpoints: map[string]Profile{"/score": {ErrorRate: 1}}}).Handler(ok)
+	if codes := statuses(h, "/other", 5); !equal(codes, []int{200, 200, 200, 200, 200}) {
+		t.Fatalf("codes %v", codes)
+	}
+}
+
+func TestExclusiveFaults(t *testing.T) {
+	profile := Profile{Latency: Latency{Rate: 0.2, Delay: Duration(time.Second)}, ErrorRate: 0.15}
+	count := func(p Profile) (slow, failed, both int) {
+		in := mustNew(t, Config{Seed: 1, Endpoints: map[string]Profile{"/score": p}})
+		for i := 0; i < 10000; i++ {
+			f, _ := in.draw(httptest.NewRequest("POST", "/score", nil))
+			switch {
+			case f.delay > 0 && f.status != 0:
+				both++
+			case f.delay > 0:
+				slow++
+			case f.status != 0:
+				failed++
+			}
+		}
+		return slow, failed, both
+	}
+
+	if _, _, both := count(profile); both == 0 {
+		t.Fatal("independent draws never gave a slow error")
+	}
+	profile.Exclusive = true
+	slow, failed, both := count(profile)
+	if both != 0 || slow < 1800 || slow > 2200 || failed < 1300 || failed > 1700 {
+		t.Fatalf("exclusive: %d slow, %d failed, %d both of 10000; want ~2000, ~1500, 0", slow, failed, both)
+	}
+
+	profile.ResetRate = 0.7
+	if _, err := New("test", Config{Endpoints: map[string]Profile{"/score": profile}}); err == nil {
+		t.Fatal("accepted exclusive rates adding up to more than 1")
+	}
+}
+
+func TestLatencyDistributions(t *testing.T) {
+	src := mustNew(t, Config{Seed: 1, Endpoints: map[string]Profile{"/x": {}}}).random["/x"]
+	for _, tc := range []struct {
+		l        Latency
+		min, max time.Duration
+	}{
+		{Latency{Delay: Duration(100 * time.Millisecond)}, 100 * time.Millisecond, 100 * time.Millisecond},
+		{Latency{Distribution: "uniform", Delay: Duration(100 * time.Millisecond), Jitter: Duration(50 * time.Millisecond)}, 100 * time.Millisecond, 150 * time.Millisecond},
+		{Latency{Distribution: "normal", Delay: Duration(100 * time.Millisecond), Jitter: Duration(10 * time.Millisecond)}, 0, time.Second},
+		{Latency{Distribution: "exponential", Delay: Duration(100 * time.Millisecond)}, 0, 10 * time.Second},
+	} {
+		var sum time.Duration
+		for i := 0; i < 1000; i++ {
+			d := tc.l.sample(src)
+			if d < tc.min || d > tc.max {
+				t.Fatalf("%+v: sample %s out of [%s, %s]", tc.l, d, tc.min, tc.max)
+			}
+			sum += d
+		}
+		if mean := sum / 1000; tc.l.Distribution != "uniform" && (mean < 90*time.Millisecond || mean > 110*time.Millisecond) {
+			t.Errorf("%+v: mean %s, want ~100ms", tc.l, mean)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	in := mustNew(t, Config{Endpoints: map[string]Profile{"/score": {ErrorRate: 1}}})
+	in.headers = true
+	h := in.Handler(ok)
+	do := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/score", nil)
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("X-Fault-Skip", "true"); w.Code != 200 {
+		t.Fatalf("skip: %d", w.Code)
+	}
+	if w := do("X-Fault-Status", "429"); w.Code != 429 || !strings.Contains(w.Body.String(), "injected_fault") {
+		t.Fatalf("status: %d %q", w.Code, w.Body)
+	}
+	start := time.Now()
+	r := httptest.NewRequest("GET", "/elsewhere", nil)
+	r.Header.Set("X-Fault-Delay", "30ms")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if took := time.Since(start); took < 30*time.Millisecond || w.Code != 200 {
+		t.Fatalf("delay: %d after %s", w.Code, took)
+	}
+
+	r = httptest.NewRequest("GET", "/elsewhere", nil)
+	r.Header.Set("X-Fault-Delay", "24h")
+	if f, _ := in.draw(r); f.delay != MaxHeaderDelay {
+		t.Fatalf("X-Fault-Delay: 24h gave a %s delay, want %s", f.delay, MaxHeaderDelay)
+	}
+
+	in.headers = false
+	if w := do("X-Fault-Skip", "true"); w.Code != 500 {
+		t.Fatalf("headers off: %d", w.Code)
+	}
+}
+
+func TestHeadersAreOptIn(t *testing.T) {
+	t.Setenv("RISK_FAULT_HEADERS", "")
+	in, err := FromEnv("risk", Config{Endpoints: map[string]Profile{"/score": {ErrorRate: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/score", nil)
+	r.Header.Set("X-Fault-Skip", "true")
+	w := httptest.NewRecorder()
+	in.Handler(ok).ServeHTTP(w, r)
+	if w.Code != 500 {
+		t.Fatalf("X-Fault-Skip honoured without RISK_FAULT_HEADERS: %d", w.Code)
+	}
+
+	t.Setenv("RISK_FAULT_HEADERS", "true")
+	if in, err = FromEnv("risk", Config{}); err != nil || !in.headers {
+		t.Fatalf("RISK_FAULT_HEADERS=true: headers %v, err %v", in != nil && in.headers, err)
+	}
+}
+
+func TestConnectionReset(t *testing.T) {
+	in := mustNew(t, Config{Endpoints: map[string]Profile{"/ledger/debit": {ResetRate: 1}}})
+	srv := httptest.NewServer(in.Handler(ok))
+	defer srv.Close()
+
+	tr := &http.Transport{DisableKeepAlives: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", srv.URL+"/ledger/debit", nil)
+	_, err := tr.RoundTrip(req)
+	if err == nil {
+		t.Fatal("request survived a reset")
+	}
+	if !errors.Is(err, syscall.ECONNRESET) && !strings.Contains(err.Error(), "EOF") {
+		t.Fatalf("error %v, want a connection reset", err)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	in := mustNew(t, Config{Seed: 7, Endpoints: map[string]Profile{"/score": {ErrorRate: 0.5}}})
+	admin := in.AdminHandler()
+	call := func(method, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/faults", strings.NewReader(body))
+		r.Header.Set("X-Admin-Token", token)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call("GET", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("without a configured token: %d", w.Code)
+	}
+	in.adminToken = "s3cret"
+	if w := call("GET", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", w.Code)
+	}
+	if w := call("GET", "", "s3cret"); w.Code != 200 || !strings.Contains(w.Body.String(), `"seed":7`) {
+		t.Fatalf("get: %d %s", w.Code, w.Body)
+	}
+
+	w := call("PUT", `{"seed": 9, "endpoints": {"/score": {"error_rate": 1, "error_status": 502, "latency": {"rate": 0.1, "delay": "5ms"}}}}`, "s3cret")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"delay":"5ms"`) {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	if codes := statuses(in.Handler(ok), "/score", 2); !equal(codes, []int{502, 502}) {
+		t.Fatalf("after put: %v", codes)
+	}
+	for _, bad := range []string{`{"endpoints": {"/score": {"error_rate": 2}}}`, `{"endpoints": {"score": {}}}`, `{"unknown": 1}`,
+		`{"endpoints": {"/score": {"latency": {"distribution": "pareto"}}}}`, `{"endpoints": {"/score": {"error_status": 200}}}`} {
+		if w := call("PUT", bad, "s3cret"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", bad, w.Code)
+		}
+	}
+
+	if w := call("DELETE", "", "s3cret"); w.Code != 200 || !strings.Contains(w.Body.String(), `"error_rate":0.5`) || strings.Contains(w.Body.String(), `"seed":7,`) {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+}
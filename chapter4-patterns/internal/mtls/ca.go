@@ -0,0 +1,244 @@
+// Package mtls is the mesh's mutual TLS: a small local certificate
+// authority that issues short-lived SPIFFE-style certificates, and the
+// workload side that keeps one of them fresh and checks peers by identity.
+//
+// A workload's identity is a SPIFFE ID, the only URI SAN of its
+// certificate:
+//
+//	spiffe://mesh.local/ns/default/sa/payments
+//
+// Certificates carry no host names. A peer is trusted because its
+// certificate chains to the CA and carries the expected ID, wherever it
+// runs.
+//
+// The CA signs certificate requests; it never sees a workload's private
+// key. A workload gets its first certificate with NewIdentity and runs
+// Rotate, which renews it at two thirds of its lifetime, so certificates
+// can live for minutes:
+//
+//	me := mtls.ServiceID("payments")
+//	id, err := mtls.NewIdentity(ctx, mtls.Config{ID: me, Issuer: &mtls.Client{URL: caURL, ID: me}})
+//	go id.Rotate(ctx)
+//	transport := &http.Transport{TLSClientConfig: id.ClientTLS(mtls.ServiceID("ledger"))}
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TrustDomain is the SPIFFE trust domain of every identity in the mesh.
+const TrustDomain = "mesh.local"
+
+// CAValidity is how long a newly created root certificate is valid.
+const CAValidity = 365 * 24 * time.Hour
+
+// clockSkew backdates certificates, so that a peer whose clock is a little
+// behind accepts them.
+const clockSkew = time.Minute
+
+// ServiceID is the identity of the service account service in the default
+// namespace.
+func ServiceID(service string) string {
+	return "spiffe://" + TrustDomain + "/ns/default/sa/" + service
+}
+
+// ParseID checks that id is a SPIFFE ID in TrustDomain.
+func ParseID(id string) (*url.URL, error) {
+	u, err := url.Parse(id)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("identity %q: %w", id, err)
+	case u.Scheme != "spiffe" || u.Host != TrustDomain:
+		return nil, fmt.Errorf("identity %q: not in trust domain spiffe://%s", id, TrustDomain)
+	case u.Path == "" || u.Path == "/" || u.User != nil || u.RawQuery != "" || u.Fragment != "" || u.Port() != "":
+		return nil, fmt.Errorf("identity %q: want spiffe://%s/<path>", id, TrustDomain)
+	}
+	return u, nil
+}
+
+// IDFromCert returns the SPIFFE ID of a certificate: its only URI SAN.
+func IDFromCert(c *x509.Certificate) (string, error) {
+	if len(c.URIs) != 1 {
+		return "", fmt.Errorf("certificate has %d URI SANs, want one SPIFFE ID", len(c.URIs))
+	}
+	id := c.URIs[0].String()
+	if _, err := ParseID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// CA is a self-signed root that signs workload certificates. It is safe for
+// concurrent use.
+type CA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	bundle []byte // cert, PEM
+}
+
+// NewCA creates a root in memory.
+func NewCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{Organization: []string{"mesh"}, CommonName: TrustDomain + " root CA"},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: TrustDomain}},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return newCA(der, key)
+}
+
+func newCA(der []byte, key *ecdsa.PrivateKey) (*CA, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("not a CA certificate")
+	}
+	return &CA{cert: cert, key: key, bundle: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+// LoadOrCreateCA loads the root from dir (ca.crt and ca.key), creating it
+// there if it doesn't exist yet, so that the trust bundle survives restarts.
+// An expired root is an error: delete the files to start a new one.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		ca, err := NewCA()
+		if err != nil {
+			return nil, err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(ca.key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(certPath, ca.bundle, 0o644); err != nil {
+			return nil, err
+		}
+		return ca, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("%s: no PEM data in ca.crt or ca.key", dir)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	ca, err := newCA(certBlock.Bytes, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	if pub, ok := ca.cert.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return nil, fmt.Errorf("%s: ca.key doesn't match ca.crt", dir)
+	}
+	if time.Now().After(ca.cert.NotAfter) {
+		return nil, fmt.Errorf("%s: root certificate expired on %s", certPath, ca.cert.NotAfter.Format(time.RFC3339))
+	}
+	return ca, nil
+}
+
+// Bundle is the root certificate in PEM: what workloads trust.
+func (ca *CA) Bundle() []byte { return ca.bundle }
+
+// Sign issues a certificate for id, valid for ttl (at most until the root
+// expires), to the key of a PEM certificate request. If the request names
+// URI SANs, they must be exactly id. The certificate is returned in PEM.
+func (ca *CA) Sign(csrPEM []byte, id string, ttl time.Duration) ([]byte, error) {
+	u, err := ParseID(id)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl %s is not positive", ttl)
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("certificate request: %w", err)
+	}
+	for _, asked := range csr.URIs {
+		if asked.String() != id {
+			return nil, fmt.Errorf("certificate request asks for %s, not %s", asked, id)
+		}
+	}
+	if len(csr.DNSNames)+len(csr.IPAddresses)+len(csr.EmailAddresses) > 0 {
+		return nil, errors.New("certificate request asks for names other than the SPIFFE ID")
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{Organization: []string{"mesh"}, CommonName: strings.TrimPrefix(u.Path, "/")},
+		URIs:         []*url.URL{u},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func randomSerial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return n
+}
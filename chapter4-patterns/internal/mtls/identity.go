@@ -0,0 +1,274 @@
+package mtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// RetryDelay is how long Rotate waits after a failed renewal.
+const RetryDelay = 5 * time.Second
+
+// Issuer gets a certificate signed for a PEM certificate request. It
+// returns the certificate and the current trust bundle, both in PEM.
+type Issuer interface {
+	Issue(ctx context.Context, csrPEM []byte) (certPEM, bundlePEM []byte, err error)
+}
+
+// LocalIssuer issues from a CA in the same process.
+type LocalIssuer struct {
+	CA  *CA
+	ID  string
+	TTL time.Duration
+}
+
+func (l *LocalIssuer) Issue(_ context.Context, csrPEM []byte) ([]byte, []byte, error) {
+	cert, err := l.CA.Sign(csrPEM, l.ID, l.TTL)
+	return cert, l.CA.Bundle(), err
+}
+
+// Config is an identity's settings.
+type Config struct {
+	ID     string // the SPIFFE ID to hold a certificate for
+	Issuer Issuer
+
+	// OnRenew is called after every renewal attempt by Rotate, with the new
+	// certificate's expiry or the error.
+	OnRenew func(id string, notAfter time.Time, err error)
+	// Now is the clock (default time.Now); tests replace it.
+	Now func() time.Time
+}
+
+// Identity is a workload's current certificate and trust bundle. It is safe
+// for concurrent use; the TLS configs it builds always use the current
+// ones, so renewals apply to the next handshake.
+type Identity struct {
+	cfg     Config
+	current atomic.Pointer[current]
+}
+
+type current struct {
+	cert    *tls.Certificate // Leaf is set
+	roots   *x509.CertPool
+	renewAt time.Time
+}
+
+// NewIdentity gets the first certificate for cfg.ID.
+func NewIdentity(ctx context.Context, cfg Config) (*Identity, error) {
+	if _, err := ParseID(cfg.ID); err != nil {
+		return nil, err
+	}
+	if cfg.Issuer == nil {
+		return nil, fmt.Errorf("identity %s: no issuer", cfg.ID)
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	i := &Identity{cfg: cfg}
+	if err := i.Renew(ctx); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// ID is the identity's SPIFFE ID.
+func (i *Identity) ID() string { return i.cfg.ID }
+
+// Certificate is the current certificate.
+func (i *Identity) Certificate() *tls.Certificate { return i.current.Load().cert }
+
+// Renew replaces the certificate with a new one, for a new key, and the
+// trust bundle with the issuer's.
+func (i *Identity) Renew(ctx context.Context) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(i.cfg.ID) // checked by NewIdentity
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{URIs: []*url.URL{u}}, key)
+	if err != nil {
+		return err
+	}
+	certPEM, bundlePEM, err := i.cfg.Issuer.Issue(ctx, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+	if err != nil {
+		return fmt.Errorf("identity %s: %w", i.cfg.ID, err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundlePEM) {
+		return fmt.Errorf("identity %s: no certificates in the trust bundle", i.cfg.ID)
+	}
+	var chain [][]byte
+	for rest := certPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		chain = append(chain, block.Bytes)
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("identity %s: no certificate issued", i.cfg.ID)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("identity %s: %w", i.cfg.ID, err)
+	}
+	if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return fmt.Errorf("identity %s: the issued certificate is for another key", i.cfg.ID)
+	}
+	id, err := verify(roots, leaf, chain[1:], i.cfg.Now())
+	if err != nil {
+		return fmt.Errorf("identity %s: the issued certificate doesn't verify: %w", i.cfg.ID, err)
+	}
+	if id != i.cfg.ID {
+		return fmt.Errorf("identity %s: the issued certificate is for %s", i.cfg.ID, id)
+	}
+
+	// Counted from now rather than NotBefore, which the CA backdates.
+	now := i.cfg.Now()
+	i.current.Store(&current{
+		cert:    &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf},
+		roots:   roots,
+		renewAt: now.Add(leaf.NotAfter.Sub(now) * 2 / 3),
+	})
+	return nil
+}
+
+// RenewAt is when the current certificate should be renewed: two thirds of
+// the way from when it was received to its expiry, leaving a third for
+// retries.
+func (i *Identity) RenewAt() time.Time { return i.current.Load().renewAt }
+
+// Rotate renews the certificate whenever it is due, retrying every
+// RetryDelay after a failure, until ctx is done. Run it in its own
+// goroutine.
+func (i *Identity) Rotate(ctx context.Context) {
+	for {
+		wait := i.RenewAt().Sub(i.cfg.Now())
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		for {
+			err := i.Renew(ctx)
+			if i.cfg.OnRenew != nil {
+				i.cfg.OnRenew(i.cfg.ID, i.Certificate().Leaf.NotAfter, err)
+			}
+			if err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(RetryDelay):
+			}
+		}
+	}
+}
+
+// ServerTLS is the config for a server that asks clients for a
+// certificate. A client without one is let through with no identity (see
+// PeerID), so that probes and plain clients can still be answered; a
+// client with a certificate that doesn't verify is refused.
+func (i *Identity) ServerTLS() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cur := i.current.Load()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{*cur.cert},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    cur.roots,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					if len(cs.PeerCertificates) == 0 {
+						return nil
+					}
+					_, err := IDFromCert(cs.PeerCertificates[0])
+					return err
+				},
+			}, nil
+		},
+	}
+}
+
+// ClientTLS is the config for a client that presents the identity's
+// certificate and only talks to a server holding serverID.
+func (i *Identity) ClientTLS(serverID string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return i.Certificate(), nil
+		},
+		// Certificates carry no host names: VerifyConnection checks the
+		// chain and the identity instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			id, err := verify(i.current.Load().roots, cs.PeerCertificates[0], rawCerts(cs.PeerCertificates[1:]), i.cfg.Now())
+			if err != nil {
+				return err
+			}
+			if id != serverID {
+				return fmt.Errorf("server is %s, want %s", id, serverID)
+			}
+			return nil
+		},
+	}
+}
+
+// PeerID is the verified identity of the other side of a connection, for
+// example r.TLS in a handler behind ServerTLS. ok is false when the peer
+// presented no certificate (or cs is nil: no TLS).
+func PeerID(cs *tls.ConnectionState) (id string, ok bool) {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return "", false
+	}
+	id, err := IDFromCert(cs.VerifiedChains[0][0])
+	return id, err == nil
+}
+
+// verify checks that leaf chains to roots (through intermediates) and
+// returns its identity.
+func verify(roots *x509.CertPool, leaf *x509.Certificate, intermediates [][]byte, now time.Time) (string, error) {
+	pool := x509.NewCertPool()
+	for _, der := range intermediates {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", err
+		}
+		pool.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", err
+	}
+	return IDFromCert(leaf)
+}
+
+func rawCerts(certs []*x509.Certificate) [][]byte {
+	out := make([][]byte, len(certs))
+	for i, c := range certs {
+		out[i] = c.Raw
+	}
+	return out
+}
@@ -0,0 +1,235 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustCA(t *testing.T) *CA {
+	t.Helper()
+	ca, err := NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func mustIdentity(t *testing.T, ca *CA, service string, ttl time.Duration) *Identity {
+	t.Helper()
+	id := ServiceID(service)
+	i, err := NewIdentity(context.Background(), Config{ID: id, Issuer: &LocalIssuer{CA: ca, ID: id, TTL: ttl}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestIssuedCertificate(t *testing.T) {
+	ca := mustCA(t)
+	i := mustIdentity(t, ca, "payments", 10*time.Minute)
+
+	leaf := i.Certificate().Leaf
+	if id, err := IDFromCert(leaf); err != nil || id != "spiffe://mesh.local/ns/default/sa/payments" {
+		t.Fatalf("id %q, %v", id, err)
+	}
+	if len(leaf.DNSNames) != 0 || leaf.IsCA {
+		t.Errorf("leaf has DNS names %v or is a CA", leaf.DNSNames)
+	}
+	if life := leaf.NotAfter.Sub(leaf.NotBefore); life != 10*time.Minute+clockSkew {
+		t.Errorf("lifetime %s", life)
+	}
+	if left := time.Until(i.RenewAt()); left < 6*time.Minute || left > 7*time.Minute {
+		t.Errorf("renewal due in %s, want two thirds of 10m", left)
+	}
+
+	serial := leaf.SerialNumber
+	if err := i.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if i.Certificate().Leaf.SerialNumber.Cmp(serial) == 0 {
+		t.Error("renewal kept the old certificate")
+	}
+}
+
+func TestSignRejects(t *testing.T) {
+	ca := mustCA(t)
+	for _, id := range []string{"spiffe://other.domain/ns/default/sa/payments", "https://mesh.local/x", "spiffe://mesh.local", "payments"} {
+		_, err := NewIdentity(context.Background(), Config{ID: id, Issuer: &LocalIssuer{CA: ca, ID: id, TTL: time.Minute}})
+		if err == nil {
+			t.Errorf("%s: issued", id)
+		}
+	}
+	// A request for one identity, signed for another.
+	i, err := NewIdentity(context.Background(), Config{ID: ServiceID("payments"), Issuer: &LocalIssuer{CA: ca, ID: ServiceID("ledger"), TTL: time.Minute}})
+	if err == nil || !strings.Contains(err.Error(), "asks for") {
+		t.Fatalf("identity %v, err %v", i, err)
+	}
+}
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Bundle()) != string(second.Bundle()) {
+		t.Fatal("the root changed across loads")
+	}
+}
+
+// serve starts a TLS server for id that reports the caller's identity.
+func serve(t *testing.T, id *Identity) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := PeerID(r.TLS)
+		if !ok {
+			peer = "anonymous"
+		}
+		io.WriteString(w, peer)
+	}))
+	srv.TLS = id.ServerTLS()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := mustCA(t)
+	ledger := mustIdentity(t, ca, "ledger", time.Minute)
+	payments := mustIdentity(t, ca, "payments", time.Minute)
+	srv := serve(t, ledger)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: payments.ClientTLS(ServiceID("ledger"))}}
+	if got, err := get(client, srv.URL); err != nil || got != ServiceID("payments") {
+		t.Fatalf("peer %q, %v", got, err)
+	}
+
+	// The server isn't who the client wants to talk to.
+	wrong := &http.Client{Transport: &http.Transport{TLSClientConfig: payments.ClientTLS(ServiceID("risk"))}}
+	if _, err := get(wrong, srv.URL); err == nil || !strings.Contains(err.Error(), "want "+ServiceID("risk")) {
+		t.Errorf("talked to the wrong server: %v", err)
+	}
+
+	// No client certificate: served, without an identity.
+	anon := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if got, err := get(anon, srv.URL); err != nil || got != "anonymous" {
+		t.Errorf("anonymous peer %q, %v", got, err)
+	}
+
+	// A certificate from another CA is refused.
+	intruder := mustIdentity(t, mustCA(t), "payments", time.Minute)
+	cfg := intruder.ClientTLS(ServiceID("ledger"))
+	cfg.VerifyConnection = nil // the intruder doesn't care who the server is
+	forged := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	if got, err := get(forged, srv.URL); err == nil {
+		t.Errorf("accepted a certificate from another CA, as %q", got)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ca := mustCA(t)
+	ledger := mustIdentity(t, ca, "ledger", time.Minute)
+	srv := serve(t, ledger)
+
+	// Renewed after a second.
+	renewed := make(chan error, 1)
+	id := ServiceID("payments")
+	payments, err := NewIdentity(context.Background(), Config{
+		ID:     id,
+		Issuer: &LocalIssuer{CA: ca, ID: id, TTL: 1500 * time.Millisecond},
+		OnRenew: func(_ string, _ time.Time, err error) {
+			select {
+			case renewed <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := payments.Certificate().Leaf
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go payments.Rotate(ctx)
+
+	select {
+	case err := <-renewed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not renewed")
+	}
+	if payments.Certificate().Leaf.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Fatal("still the first certificate")
+	}
+
+	// New connections present the new certificate.
+	var seen *x509.Certificate
+	cfg := payments.ClientTLS(ServiceID("ledger"))
+	get := cfg.GetClientCertificate
+	cfg.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		c, err := get(info)
+		seen = c.Leaf
+		return c, err
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seen == nil || seen.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("handshake used the old certificate")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ca := mustCA(t)
+	srv := httptest.NewServer(ca.Handler("secret", time.Minute))
+	defer srv.Close()
+	id := ServiceID("payments")
+
+	_, err := NewIdentity(context.Background(), Config{ID: id, Issuer: &Client{URL: srv.URL, ID: id, Token: "wrong"}})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("wrong token: %v", err)
+	}
+	i, err := NewIdentity(context.Background(), Config{ID: id, Issuer: &Client{URL: srv.URL, ID: id, Token: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := IDFromCert(i.Certificate().Leaf); got != id {
+		t.Errorf("id %q", got)
+	}
+
+	resp, err := http.Get(srv.URL + "/bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != string(ca.Bundle()) {
+		t.Error("bundle differs")
+	}
+}
@@ -0,0 +1,125 @@
+package mtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SignRequest is the body of POST /sign.
+type SignRequest struct {
+	ID  string `json:"id"`  // the SPIFFE ID to certify
+	CSR string `json:"csr"` // PEM certificate request
+}
+
+// SignResponse is the answer to POST /sign.
+type SignResponse struct {
+	Cert      string    `json:"cert"`   // PEM
+	Bundle    string    `json:"bundle"` // PEM: the roots to trust
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Handler serves the CA over HTTP:
+//
+//	POST /sign     a SignRequest -> a SignResponse, for a certificate valid for ttl
+//	GET  /bundle   the root certificate (PEM)
+//
+// When token is set, /sign needs it in X-CA-Token. Without a token anyone
+// who can reach the handler gets certificates for any identity, which is
+// only acceptable on a loopback address.
+func (ca *CA) Handler(token string, ttl time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bundle", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(ca.bundle)
+	})
+	mux.HandleFunc("/sign", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-CA-Token")), []byte(token)) != 1 {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		var in SignRequest
+		dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&in)
+		var cert []byte
+		if err == nil {
+			cert, err = ca.Sign([]byte(in.CSR), in.ID, ttl)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(SignResponse{
+			Cert:      string(cert),
+			Bundle:    string(ca.bundle),
+			ExpiresAt: expiry(cert),
+		})
+	})
+	return mux
+}
+
+// Client is an Issuer that asks a CA served by Handler.
+type Client struct {
+	URL   string // the CA's base URL, e.g. "http://127.0.0.1:15000"
+	Token string // sent in X-CA-Token, if set
+	ID    string
+	HTTP  *http.Client // default: a client with a 5s timeout
+}
+
+func (c *Client) Issue(ctx context.Context, csrPEM []byte) ([]byte, []byte, error) {
+	body, _ := json.Marshal(SignRequest{ID: c.ID, CSR: string(csrPEM)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+"/sign", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("X-CA-Token", c.Token)
+	}
+	client := c.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, nil, fmt.Errorf("CA answered %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var out SignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, nil, fmt.Errorf("CA answer: %w", err)
+	}
+	return []byte(out.Cert), []byte(out.Bundle), nil
+}
+
+func expiry(certPEM []byte) time.Time {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return time.Time{}
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+	return c.NotAfter
+}
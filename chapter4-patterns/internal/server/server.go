@@ -0,0 +1,225 @@
+// Package server is the HTTP bootstrap shared by the services in this
+// chapter: listen address and timeouts from the environment, health
+// endpoints, and a graceful shutdown on SIGTERM.
+//
+// Shutdown happens in three steps, so that a Kubernetes rolling update
+// doesn't drop requests:
+//
+//  1. SIGTERM (or SIGINT) arrives. GET /readyz starts answering 503, so the
+//     readiness probe fails and the pod is taken out of the Service.
+//     Requests keep being served, with Connection: close so that clients
+//     reconnect to another pod.
+//  2. After DrainDelay (long enough for the endpoints to update), the
+//     listener closes and in-flight requests are allowed to finish.
+//  3. Whatever is still running after ShutdownTimeout is cut off.
+//
+// GET /healthz (liveness) answers 200 for as long as the process runs.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config says how to listen and how to shut down.
+type Config struct {
+	Name string // log prefix, e.g. "gateway"
+	Addr string // e.g. ":8000"
+
+	ReadTimeout       time.Duration // whole request, body included
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration // from the end of the headers to the end of the response
+	IdleTimeout       time.Duration // keep-alive connections
+
+	DrainDelay      time.Duration // unready but still serving, before the listener closes
+	ShutdownTimeout time.Duration // for in-flight requests to finish
+
+	TLS *tls.Config // serve HTTPS with this (it must supply the certificate); nil: plain HTTP
+}
+
+// Defaults fit a pod with the default 30s termination grace period:
+// DrainDelay + ShutdownTimeout stays under it.
+const (
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultWriteTimeout      = 60 * time.Second
+	DefaultIdleTimeout       = 120 * time.Second
+	DefaultDrainDelay        = 5 * time.Second
+	DefaultShutdownTimeout   = 20 * time.Second
+)
+
+// FromEnv builds a Config for service name, reading <PREFIX>_ADDR,
+// <PREFIX>_READ_TIMEOUT, <PREFIX>_READ_HEADER_TIMEOUT, <PREFIX>_WRITE_TIMEOUT,
+// <PREFIX>_IDLE_TIMEOUT, <PREFIX>_DRAIN_DELAY and <PREFIX>_SHUTDOWN_TIMEOUT,
+// where PREFIX is name in upper case. Durations are Go durations ("15s").
+func FromEnv(name, defaultAddr string) (Config, error) {
+	cfg := Config{
+		Name:              name,
+		Addr:              defaultAddr,
+		ReadTimeout:       DefaultReadTimeout,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		WriteTimeout:      DefaultWriteTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		DrainDelay:        DefaultDrainDelay,
+		ShutdownTimeout:   DefaultShutdownTimeout,
+	}
+	prefix := envPrefix(name)
+	if v := os.Getenv(prefix + "_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+	for suffix, d := range map[string]*time.Duration{
+		"_READ_TIMEOUT":        &cfg.ReadTimeout,
+		"_READ_HEADER_TIMEOUT": &cfg.ReadHeaderTimeout,
+		"_WRITE_TIMEOUT":       &cfg.WriteTimeout,
+		"_IDLE_TIMEOUT":        &cfg.IdleTimeout,
+		"_DRAIN_DELAY":         &cfg.DrainDelay,
+		"_SHUTDOWN_TIMEOUT":    &cfg.ShutdownTimeout,
+	} {
+		v := os.Getenv(prefix + suffix)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			return Config{}, fmt.Errorf("%s%s: invalid duration %q", prefix, suffix, v)
+		}
+		*d = parsed
+	}
+	return cfg, nil
+}
+
+func envPrefix(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Server is an http.Server with health endpoints and a drain sequence.
+type Server struct {
+	cfg      Config
+	srv      *http.Server
+	draining atomic.Bool
+}
+
+// New wraps h (nil: http.DefaultServeMux). /healthz and /readyz are
+// answered before h sees the request.
+func New(cfg Config, h http.Handler) *Server {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	s := &Server{cfg: cfg}
+	s.srv = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.wrap(h),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		TLSConfig:         cfg.TLS,
+	}
+	return s
+}
+
+func (s *Server) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte("ok\n"))
+			return
+		case "/readyz":
+			if s.draining.Load() {
+				http.Error(w, "draining", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok\n"))
+			return
+		}
+		if s.draining.Load() {
+			w.Header().Set("Connection", "close")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Main is the last line of a service's main: it reads the Config for name
+// from the environment, serves h and exits the process on error.
+func Main(name, defaultAddr string, h http.Handler) {
+	cfg, err := FromEnv(name, defaultAddr)
+	if err != nil {
+		log.Fatalf("[%s] %v", name, err)
+	}
+	if err := Run(cfg, h); err != nil {
+		log.Fatalf("[%s] %v", name, err)
+	}
+}
+
+// Run serves until SIGTERM or SIGINT, then drains and returns. A clean
+// shutdown returns nil.
+func Run(cfg Config, h http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return New(cfg, h).Serve(ctx)
+}
+
+// Serve listens on cfg.Addr and serves until ctx is done, then drains.
+func (s *Server) Serve(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeListener(ctx, ln)
+}
+
+// ServeListener is Serve on a listener the caller opened.
+func (s *Server) ServeListener(ctx context.Context, ln net.Listener) error {
+	log.Printf("[%s] listening on %s", s.cfg.Name, ln.Addr())
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.cfg.TLS != nil {
+			errc <- s.srv.ServeTLS(ln, "", "")
+			return
+		}
+		errc <- s.srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err // the listener failed; nothing to drain
+	case <-ctx.Done():
+	}
+
+	s.draining.Store(true)
+	log.Printf("[%s] shutting down: unready for %s, then up to %s to drain", s.cfg.Name, s.cfg.DrainDelay, s.cfg.ShutdownTimeout)
+	time.Sleep(s.cfg.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		s.srv.Close()
+		return fmt.Errorf("drain: %w", err)
+	}
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("[%s] stopped", s.cfg.Name)
+	return nil
+}
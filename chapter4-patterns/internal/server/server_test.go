@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainSequence(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "done")
+	})
+	s := New(Config{Name: "test", DrainDelay: 200 * time.Millisecond, ShutdownTimeout: 5 * time.Second}, h)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- s.ServeListener(ctx, ln) }()
+
+	if code := status(t, base+"/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz before shutdown: %d", code)
+	}
+	slow := make(chan string)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		slow <- string(b)
+	}()
+	<-started
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	// Unready, but still serving until the drain delay is over.
+	if code := status(t, base+"/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz while draining: %d", code)
+	}
+	if code := status(t, base+"/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz while draining: %d", code)
+	}
+
+	time.Sleep(300 * time.Millisecond) // the listener is closed now
+	if _, err := http.Get(base + "/"); err == nil {
+		t.Fatal("new connection accepted after the drain delay")
+	}
+	close(release)
+	if got := <-slow; got != "done" {
+		t.Fatalf("in-flight request got %q", got)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Serve returned %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	s := New(Config{Name: "test", ShutdownTimeout: 100 * time.Millisecond}, h)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- s.ServeListener(ctx, ln) }()
+
+	go http.Get("http://" + ln.Addr().String() + "/stuck")
+	<-started
+	cancel()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Fatal("a request outlived the deadline but Serve returned nil")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not give up at the shutdown deadline")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("RISK_ADDR", ":7102")
+	t.Setenv("RISK_WRITE_TIMEOUT", "3s")
+	cfg, err := FromEnv("risk", ":7002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":7102" || cfg.WriteTimeout != 3*time.Second || cfg.ReadTimeout != DefaultReadTimeout {
+		t.Fatalf("%+v", cfg)
+	}
+	t.Setenv("RISK_IDLE_TIMEOUT", "soon")
+	if _, err := FromEnv("risk", ":7002"); err == nil {
+		t.Fatal("accepted RISK_IDLE_TIMEOUT=soon")
+	}
+}
+
+func status(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,88 @@
+// Package watch re-reads a config file when it changes on disk or when the
+// process gets SIGHUP. It is shared by the services in this chapter that
+// hot-reload a JSON file: the gateway's routes, the payments fallback rules
+// and the mesh authorization policy.
+//
+// Changes are noticed by polling the file's modification time and size.
+// The state is recorded whenever the file is read, whether or not the
+// caller manages to parse it, so that a broken file is reported once rather
+// than on every poll until someone fixes it.
+package watch
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// File is a file on disk and the state it was in when it was last read.
+// It is safe for concurrent use.
+type File struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewFile watches path. Nothing is read until the first Read, so the first
+// Changed reports true.
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Path is the path given to NewFile, for error messages.
+func (f *File) Path() string { return f.path }
+
+// Read reads the file and records its state, so that Changed reports false
+// until the file is written again.
+func (f *File) Read() ([]byte, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.modTime, f.size = info.ModTime(), info.Size()
+	f.mu.Unlock()
+	return data, nil
+}
+
+// Changed reports whether the file differs from what Read last saw. A file
+// that can't be stat'ed (being replaced, say) doesn't count as changed.
+func (f *File) Changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+// Watch calls reload on SIGHUP (with why "SIGHUP") and when the file has
+// changed (with why "file change"), checking every interval. reload is
+// expected to call Read. Watch blocks, so run it in its own goroutine.
+func (f *File) Watch(interval time.Duration, reload func(why string)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			reload("SIGHUP")
+		case <-ticker.C:
+			if f.Changed() {
+				reload("file change")
+			}
+		}
+	}
+}
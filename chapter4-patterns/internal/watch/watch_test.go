@@ -0,0 +1,109 @@
+package watch
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadRecordsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write(t, path, `{"rules": []}`)
+	f := NewFile(path)
+	if !f.Changed() {
+		t.Fatal("a file never read is unchanged")
+	}
+	data, err := f.Read()
+	if err != nil || string(data) != `{"rules": []}` {
+		t.Fatalf("Read: %q, %v", data, err)
+	}
+	if f.Changed() {
+		t.Fatal("changed right after Read")
+	}
+	write(t, path, `{"rules": [{}]}`)
+	if !f.Changed() {
+		t.Fatal("a rewritten file is unchanged")
+	}
+
+	os.Remove(path)
+	if f.Changed() {
+		t.Fatal("a missing file counts as changed")
+	}
+	if _, err := f.Read(); err == nil {
+		t.Fatal("Read of a missing file succeeded")
+	}
+}
+
+func TestWatchReportsABrokenFileOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write(t, path, `{"rules": []}`)
+	f := NewFile(path)
+	if _, err := f.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reload reads the file and fails to parse it, as it would with a typo.
+	// (The watcher outlives the test, so SIGHUPs sent by later tests are
+	// left out of the count.)
+	var reloads atomic.Int32
+	go f.Watch(5*time.Millisecond, func(why string) {
+		f.Read()
+		if why == "file change" {
+			reloads.Add(1)
+		}
+	})
+
+	write(t, path, `{"rules": [`)
+	time.Sleep(100 * time.Millisecond) // about 20 polls
+	if n := reloads.Load(); n != 1 {
+		t.Fatalf("%d reloads of the same broken file, want 1", n)
+	}
+	write(t, path, `{"rules": [{}]}`)
+	deadline := time.Now().Add(time.Second)
+	for reloads.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the fixed file was never reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchReloadsOnSIGHUP(t *testing.T) {
+	// Keep SIGHUP from terminating the test binary before Watch has
+	// registered for it.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write(t, path, `{"rules": []}`)
+	f := NewFile(path)
+	reloads := make(chan string, 10)
+	go f.Watch(time.Hour, func(why string) { reloads <- why }) // only a signal can trigger a reload
+
+	deadline := time.After(time.Second)
+	for {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		select {
+		case why := <-reloads:
+			if why != "SIGHUP" {
+				t.Fatalf("why = %q, want SIGHUP", why)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no reload after SIGHUP")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}